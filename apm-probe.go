@@ -2,79 +2,220 @@ package apm_probe
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"time"
+	"net/http"
+	"strings"
+	"sync/atomic"
 
+	"github.com/fllarpy/apm-probe/config"
 	"github.com/fllarpy/apm-probe/exporter"
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/internal/ports/http_reporter"
 	"github.com/fllarpy/apm-probe/nplusone"
 	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/runtimestats"
 	"github.com/fllarpy/apm-probe/storage/inmemory"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 type Probe struct {
-	tp *sdktrace.TracerProvider
+	tp               *sdktrace.TracerProvider
+	store            *inmemory.Store
+	reporterEndpoint string
+
+	profiler        *profiling.Profiler
+	detector        *nplusone.Detector
+	collector       *runtimestats.Collector
+	sampler         *dynamicSampler
+	customExporter  *switchableExporter
+	loggingExporter *switchableExporter
+
+	config atomic.Pointer[config.Config]
+	// appliedProfiler is the profiler section last applied by the
+	// configuration watcher.
+	appliedProfiler config.ProfilerConfig
+	stopWatch       context.CancelFunc
+	watchDone       <-chan struct{}
 }
 
 func (p *Probe) Shutdown(ctx context.Context) {
+	if p.stopWatch != nil {
+		p.stopWatch()
+		<-p.watchDone
+	}
+	if p.collector != nil {
+		p.collector.Stop()
+	}
 	if err := p.tp.Shutdown(ctx); err != nil {
-		log.Printf("Error shutting down tracer provider: %v", err)
+		logging.Errorf("Error shutting down tracer provider: %v", err)
+	}
+	// The profiler and detector go last: shutting down the tracer provider
+	// flushes the remaining spans into them.
+	if p.profiler != nil {
+		p.profiler.Close()
+	}
+	if p.detector != nil {
+		p.detector.Close()
+	}
+}
+
+// ReporterEndpoint returns the path the metrics endpoint should be mounted
+// on, or an empty string when the reporter is disabled.
+func (p *Probe) ReporterEndpoint() string {
+	return p.reporterEndpoint
+}
+
+// MetricsHandler returns the JSON metrics endpoint backed by the probe's
+// store, or nil when the reporter is disabled. Mount it on ReporterEndpoint.
+func (p *Probe) MetricsHandler() http.Handler {
+	if p.reporterEndpoint == "" {
+		return nil
+	}
+	var stats http_reporter.ProfilerStats
+	if p.profiler != nil {
+		stats = p.profiler
+	}
+	return http_reporter.NewHandler(p.store, stats)
+}
+
+// ProfilesEndpoint returns the path prefix the profiles endpoint should be
+// mounted on, or an empty string when the reporter or the profiler is
+// disabled.
+func (p *Probe) ProfilesEndpoint() string {
+	if p.reporterEndpoint == "" || p.profiler == nil {
+		return ""
 	}
+	return strings.TrimSuffix(p.reporterEndpoint, "/") + "/profiles/"
+}
+
+// ProfilesHandler returns the endpoint listing, serving and deleting the
+// profiles captured for slow endpoints and serving the windows of continuous
+// profiling, or nil when ProfilesEndpoint is empty. Mount it on
+// ProfilesEndpoint.
+func (p *Probe) ProfilesHandler() http.Handler {
+	endpoint := p.ProfilesEndpoint()
+	if endpoint == "" {
+		return nil
+	}
+	return http.StripPrefix(strings.TrimSuffix(endpoint, "/"), http_reporter.NewProfilesHandler(p.profiler.Store(), p.profiler))
+}
+
+// TracerProvider returns the tracer provider owned by the probe. It is mainly
+// useful together with WithoutGlobalProvider.
+func (p *Probe) TracerProvider() *sdktrace.TracerProvider {
+	return p.tp
 }
 
-func NewProbe(ctx context.Context, serviceName string) (*Probe, *inmemory.Store, error) {
-	store := inmemory.NewStore()
+func NewProbe(ctx context.Context, serviceName string, opts ...Option) (*Probe, *inmemory.Store, error) {
+	if serviceName == "" {
+		return nil, nil, errors.New("service name must not be empty")
+	}
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(o); err != nil {
+			return nil, nil, fmt.Errorf("invalid probe option: %w", err)
+		}
+	}
+
+	if o.logLevel != nil {
+		logging.SetLevel(*o.logLevel)
+	}
+
+	store := o.store
+	if store == nil {
+		store = inmemory.NewStoreWithConfig(o.storeConfig)
+	}
+
+	probe := &Probe{
+		store:            store,
+		reporterEndpoint: o.reporterEndpoint,
+		profiler:         profiling.NewProfiler(o.profilerConfig),
+		detector:         nplusone.NewDetector(o.nPlusOneConfig, store),
+	}
 
-	profilerCfg := profiling.Config{
-		Enabled:          true,
-		LatencyThreshold: 500 * time.Millisecond,
-		Duration:         10 * time.Second,
-		Cooldown:         1 * time.Minute,
+	var runtimeObserver runtimestats.Observer
+	if probe.profiler != nil {
+		runtimeObserver = profilerRuntimeObserver{probe.profiler}
 	}
-	profiler := profiling.NewProfiler(profilerCfg)
+	probe.collector = runtimestats.NewCollector(o.runtimeConfig, store, runtimeObserver)
 
-	n1detectorCfg := nplusone.Config{
-		Enabled:   true,
-		Threshold: 5,
+	var profiler exporter.Profiler
+	if probe.profiler != nil {
+		profiler = probe.profiler
+	}
+
+	var n1detector exporter.N1Detector
+	if probe.detector != nil {
+		n1detector = probe.detector
 	}
-	n1detector := nplusone.NewDetector(n1detectorCfg, store)
 
 	customExporter, err := exporter.NewCustomExporter(store, profiler, n1detector)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create custom exporter: %w", err)
 	}
 
-	res, err := newResource(serviceName, "1.0.0")
+	res, err := newResource(serviceName, o.serviceVersion, o.resourceAttributes...)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("failed to create resource: %w", err)
 	}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(customExporter),
+	sampler := o.sampler
+	if sampler == nil {
+		sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+	probe.sampler = newDynamicSampler(sampler)
+	probe.customExporter = newSwitchableExporter(customExporter, o.customExporter)
+	probe.loggingExporter = newSwitchableExporter(exporter.NewLoggingExporter(), o.loggingExporter)
+
+	probe.tp = sdktrace.NewTracerProvider(
 		sdktrace.WithResource(res),
+		sdktrace.WithSampler(probe.sampler),
+		sdktrace.WithBatcher(probe.customExporter),
+		sdktrace.WithBatcher(probe.loggingExporter),
 	)
 
-	otel.SetTracerProvider(tp)
+	if o.setGlobalProvider {
+		otel.SetTracerProvider(probe.tp)
+	}
 
-	probe := &Probe{
-		tp: tp,
+	if probe.collector != nil {
+		probe.collector.Start()
 	}
 
-	log.Println("APM Probe initialized with custom exporter, profiler, and N+1 detector.")
+	logging.Infof("APM Probe initialized with custom exporter, profiler, and N+1 detector.")
 	return probe, store, nil
 }
 
-func newResource(serviceName, serviceVersion string) (*resource.Resource, error) {
+// profilerRuntimeObserver feeds runtime samples to the runtime policies of
+// the profiler.
+type profilerRuntimeObserver struct {
+	profiler *profiling.Profiler
+}
+
+func (o profilerRuntimeObserver) ObserveRuntime(sample inmemory.RuntimeSample) {
+	o.profiler.ObserveRuntime(profiling.RuntimeStats{
+		Goroutines: sample.Goroutines,
+		HeapAlloc:  sample.HeapAlloc,
+		At:         sample.Timestamp,
+	})
+}
+
+func newResource(serviceName, serviceVersion string, attrs ...attribute.KeyValue) (*resource.Resource, error) {
+	attrs = append([]attribute.KeyValue{
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(serviceVersion),
+	}, attrs...)
 	return resource.Merge(
 		resource.Default(),
-		resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(serviceName),
-			semconv.ServiceVersion(serviceVersion),
-		),
+		resource.NewWithAttributes(semconv.SchemaURL, attrs...),
 	)
 }
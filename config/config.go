@@ -1,36 +1,486 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/fllarpy/apm-probe/internal/logging"
 	"github.com/spf13/viper"
 )
 
+// EnvPrefix is prepended to every environment variable the loader reads,
+// e.g. APM_PROFILER_LATENCY_THRESHOLD overrides profiler.latency_threshold.
+const EnvPrefix = "APM"
+
 type Config struct {
-	ServiceName string `mapstructure:"service_name"`
-	Exporter string `mapstructure:"exporter"`
-	LogLevel string `mapstructure:"log_level"`
+	Enabled        bool            `mapstructure:"enabled"`
+	HotReload      bool            `mapstructure:"hot_reload"`
+	ServiceName    string          `mapstructure:"service_name"`
+	ServiceVersion string          `mapstructure:"service_version"`
+	LogLevel       string          `mapstructure:"log_level"`
+	Profiler       ProfilerConfig  `mapstructure:"profiler"`
+	NPlusOne       NPlusOneConfig  `mapstructure:"nplusone"`
+	Store          StoreConfig     `mapstructure:"store"`
+	Exporters      ExportersConfig `mapstructure:"exporters"`
+	Sampling       SamplingConfig  `mapstructure:"sampling"`
+	Reporter       ReporterConfig  `mapstructure:"reporter"`
+	Runtime        RuntimeConfig   `mapstructure:"runtime"`
+}
+
+// ProfilerConfig mirrors profiling.Config.
+type ProfilerConfig struct {
+	Enabled          bool          `mapstructure:"enabled"`
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+	Duration         time.Duration `mapstructure:"duration"`
+	Cooldown         time.Duration `mapstructure:"cooldown"`
+	Types            []string      `mapstructure:"types"`
+	Dir              string        `mapstructure:"dir"`
+	// MaxBytes and MaxAge bound the profiles kept in Dir.
+	MaxBytes int64         `mapstructure:"max_bytes"`
+	MaxAge   time.Duration `mapstructure:"max_age"`
+	// MutexProfileFraction and BlockProfileRate apply only while a mutex
+	// or block profile is being captured.
+	MutexProfileFraction int `mapstructure:"mutex_profile_fraction"`
+	BlockProfileRate     int `mapstructure:"block_profile_rate"`
+	// MinInterval limits how often a capture may start, across endpoints.
+	MinInterval time.Duration `mapstructure:"min_interval"`
+	// Triggers adds policies to the latency threshold.
+	Triggers TriggersConfig `mapstructure:"triggers"`
+	// Continuous profiles in fixed windows, independent of the triggers.
+	Continuous ContinuousConfig `mapstructure:"continuous"`
+	// Baselines records a profile per route while its latency is normal
+	// and compares captures to it.
+	Baselines BaselinesConfig `mapstructure:"baselines"`
+}
+
+// BaselinesConfig mirrors profiling.BaselinesConfig.
+type BaselinesConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Refresh  time.Duration `mapstructure:"refresh"`
+	Interval time.Duration `mapstructure:"interval"`
+	Top      int           `mapstructure:"top"`
+}
+
+// ContinuousConfig mirrors profiling.ContinuousConfig.
+type ContinuousConfig struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Interval  time.Duration `mapstructure:"interval"`
+	Duration  time.Duration `mapstructure:"duration"`
+	Types     []string      `mapstructure:"types"`
+	Retention time.Duration `mapstructure:"retention"`
 }
 
-func Load(path string) (config Config, err error) {
-	viper.SetDefault("service_name", "unknown-service")
-	viper.SetDefault("exporter", "logging")
-	viper.SetDefault("log_level", "info")
+// TriggersConfig mirrors the profiling policies. A policy is off while its
+// first setting (latency threshold, percentile threshold, multiple, rate,
+// goroutine limit or ratio) is zero.
+type TriggersConfig struct {
+	// Routes overrides latency_threshold for single routes.
+	Routes     []RouteTrigger    `mapstructure:"routes"`
+	Percentile PercentileTrigger `mapstructure:"percentile"`
+	Baseline   BaselineTrigger   `mapstructure:"baseline"`
+	ErrorRate  ErrorRateTrigger  `mapstructure:"error_rate"`
+	Goroutines uint64            `mapstructure:"goroutines"`
+	HeapGrowth HeapGrowthTrigger `mapstructure:"heap_growth"`
+}
+
+// RouteTrigger is a list entry rather than a map key because viper lowers
+// the case of keys, and routes are case sensitive.
+type RouteTrigger struct {
+	Route            string        `mapstructure:"route"`
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+}
 
-	viper.AddConfigPath(path)
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
+// PercentileTrigger mirrors profiling.PercentilePolicy.
+type PercentileTrigger struct {
+	Threshold  time.Duration `mapstructure:"threshold"`
+	Percentile float64       `mapstructure:"percentile"`
+	Window     time.Duration `mapstructure:"window"`
+	MinSamples int           `mapstructure:"min_samples"`
+}
 
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+// BaselineTrigger mirrors profiling.BaselinePolicy.
+type BaselineTrigger struct {
+	Multiple   float64 `mapstructure:"multiple"`
+	MinSamples int     `mapstructure:"min_samples"`
+}
+
+// ErrorRateTrigger mirrors profiling.ErrorRatePolicy.
+type ErrorRateTrigger struct {
+	Rate       float64       `mapstructure:"rate"`
+	Window     time.Duration `mapstructure:"window"`
+	MinSamples int           `mapstructure:"min_samples"`
+}
+
+// HeapGrowthTrigger mirrors profiling.HeapGrowthPolicy.
+type HeapGrowthTrigger struct {
+	Ratio  float64       `mapstructure:"ratio"`
+	Window time.Duration `mapstructure:"window"`
+}
+
+// profileTypes are the names accepted by profiler.types. They match
+// profiling.ProfileTypes.
+var profileTypes = []string{"cpu", "heap", "allocs", "goroutine", "mutex", "block", "trace"}
+
+// NPlusOneConfig mirrors nplusone.Config.
+type NPlusOneConfig struct {
+	Enabled    bool           `mapstructure:"enabled"`
+	Threshold  int            `mapstructure:"threshold"`
+	Thresholds map[string]int `mapstructure:"thresholds"`
+	Extractors []string       `mapstructure:"extractors"`
+	Sequential bool           `mapstructure:"sequential"`
+	MaxGap     time.Duration  `mapstructure:"max_gap"`
+	Allow      AllowConfig    `mapstructure:"allow"`
+	// TraceTTL, SweepInterval and MaxTraces bound the traces held while
+	// waiting for their root span.
+	TraceTTL      time.Duration `mapstructure:"trace_ttl"`
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+	MaxTraces     int           `mapstructure:"max_traces"`
+}
+
+// nPlusOneExtractors are the names accepted by nplusone.extractors and
+// nplusone.thresholds. They match the built-in nplusone extractors.
+var nPlusOneExtractors = []string{"sql", "http"}
+
+// AllowConfig mirrors nplusone.Allowlist.
+type AllowConfig struct {
+	Routes       []string `mapstructure:"routes"`
+	Fingerprints []string `mapstructure:"fingerprints"`
+}
+
+// StoreConfig mirrors inmemory.Config.
+type StoreConfig struct {
+	MaxEvents int           `mapstructure:"max_events"`
+	MaxAge    time.Duration `mapstructure:"max_age"`
+	MaxBytes  int64         `mapstructure:"max_bytes"`
+	MaxRoutes int           `mapstructure:"max_routes"`
+
+	MaxRuntimeSamples int `mapstructure:"max_runtime_samples"`
+}
+
+// ExportersConfig toggles the span exporters registered with the tracer
+// provider.
+type ExportersConfig struct {
+	Custom  ExporterConfig `mapstructure:"custom"`
+	Logging ExporterConfig `mapstructure:"logging"`
+}
 
-	if err = viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-			return
+type ExporterConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// SamplingConfig describes a trace-ID ratio sampler, optionally wrapped in a
+// parent-based sampler so that upstream sampling decisions are honoured.
+type SamplingConfig struct {
+	Ratio       float64 `mapstructure:"ratio"`
+	ParentBased bool    `mapstructure:"parent_based"`
+}
+
+// ReporterConfig controls the JSON metrics endpoint.
+type ReporterConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// RuntimeConfig mirrors runtimestats.Config.
+type RuntimeConfig struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	CollectionInterval time.Duration `mapstructure:"collection_interval"`
+}
+
+// envAliases binds the variable names documented in the README to their
+// config keys. Every key can additionally be set through its canonical
+// APM_<SECTION>_<KEY> name.
+var envAliases = map[string][]string{
+	"reporter.endpoint":           {"APM_DEBUG_ENDPOINT"},
+	"runtime.collection_interval": {"APM_COLLECTION_INTERVAL"},
+}
+
+// Loader reads a Config from a file and the environment. Each Loader owns a
+// private viper instance, so several loaders can be used concurrently.
+type Loader struct {
+	path string
+	v    *viper.Viper
+}
+
+// NewLoader returns a loader for path. path may point to a config file (its
+// extension selects the format), to a directory containing config.yaml, or be
+// empty to use defaults and environment variables only.
+func NewLoader(path string) *Loader {
+	return &Loader{path: path}
+}
+
+// Load is a shortcut for NewLoader(path).Load().
+func Load(path string) (Config, error) {
+	return NewLoader(path).Load()
+}
+
+// Path returns the config file the loader reads, or an empty string when it
+// only uses defaults and the environment.
+func (l *Loader) Path() string {
+	if l.v == nil {
+		return ""
+	}
+	return l.v.ConfigFileUsed()
+}
+
+// Load reads and validates the configuration.
+func (l *Loader) Load() (Config, error) {
+	v, err := l.newViper()
+	if err != nil {
+		return Config{}, err
+	}
+	l.v = v
+	return l.read()
+}
+
+func (l *Loader) read() (Config, error) {
+	var config Config
+	if l.v.ConfigFileUsed() != "" {
+		if err := l.v.ReadInConfig(); err != nil {
+			return Config{}, fmt.Errorf("failed to read config file %s: %w", l.v.ConfigFileUsed(), err)
 		}
-		err = nil
 	}
+	if err := l.v.Unmarshal(&config); err != nil {
+		return Config{}, fmt.Errorf("failed to decode config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func (l *Loader) newViper() (*viper.Viper, error) {
+	v := viper.New()
+	setDefaults(v)
 
-	err = viper.Unmarshal(&config)
-	return
-} 
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for key, names := range envAliases {
+		bindArgs := append([]string{key, EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))}, names...)
+		if err := v.BindEnv(bindArgs...); err != nil {
+			return nil, fmt.Errorf("failed to bind environment for %s: %w", key, err)
+		}
+	}
+
+	if l.path == "" {
+		return v, nil
+	}
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access config path: %w", err)
+	}
+	file := l.path
+	if info.IsDir() {
+		file = filepath.Join(l.path, "config.yaml")
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			return v, nil
+		}
+	}
+	v.SetConfigFile(file)
+	if filepath.Ext(file) == "" {
+		v.SetConfigType("yaml")
+	}
+	return v, nil
+}
+
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("enabled", true)
+	v.SetDefault("hot_reload", true)
+	v.SetDefault("service_name", "unknown-service")
+	v.SetDefault("service_version", "1.0.0")
+	v.SetDefault("log_level", "info")
+
+	v.SetDefault("profiler.enabled", true)
+	v.SetDefault("profiler.latency_threshold", 500*time.Millisecond)
+	v.SetDefault("profiler.duration", 10*time.Second)
+	v.SetDefault("profiler.cooldown", 1*time.Minute)
+	v.SetDefault("profiler.types", []string{"cpu"})
+	v.SetDefault("profiler.dir", "")
+	v.SetDefault("profiler.max_bytes", 256<<20)
+	v.SetDefault("profiler.max_age", 24*time.Hour)
+	v.SetDefault("profiler.mutex_profile_fraction", 5)
+	v.SetDefault("profiler.block_profile_rate", 10000)
+	v.SetDefault("profiler.min_interval", 30*time.Second)
+	v.SetDefault("profiler.triggers.percentile.threshold", 0)
+	v.SetDefault("profiler.triggers.percentile.percentile", 95)
+	v.SetDefault("profiler.triggers.percentile.window", 1*time.Minute)
+	v.SetDefault("profiler.triggers.percentile.min_samples", 20)
+	v.SetDefault("profiler.triggers.baseline.multiple", 0)
+	v.SetDefault("profiler.triggers.baseline.min_samples", 50)
+	v.SetDefault("profiler.triggers.error_rate.rate", 0)
+	v.SetDefault("profiler.triggers.error_rate.window", 1*time.Minute)
+	v.SetDefault("profiler.triggers.error_rate.min_samples", 20)
+	v.SetDefault("profiler.triggers.goroutines", 0)
+	v.SetDefault("profiler.triggers.heap_growth.ratio", 0)
+	v.SetDefault("profiler.triggers.heap_growth.window", 5*time.Minute)
+	v.SetDefault("profiler.continuous.enabled", false)
+	v.SetDefault("profiler.continuous.interval", 1*time.Minute)
+	v.SetDefault("profiler.continuous.duration", 10*time.Second)
+	v.SetDefault("profiler.continuous.types", []string{"cpu", "heap"})
+	v.SetDefault("profiler.continuous.retention", 1*time.Hour)
+	v.SetDefault("profiler.baselines.enabled", false)
+	v.SetDefault("profiler.baselines.refresh", 1*time.Hour)
+	v.SetDefault("profiler.baselines.interval", 1*time.Minute)
+	v.SetDefault("profiler.baselines.top", 10)
+
+	v.SetDefault("nplusone.enabled", true)
+	v.SetDefault("nplusone.threshold", 5)
+	v.SetDefault("nplusone.extractors", nPlusOneExtractors)
+	v.SetDefault("nplusone.sequential", false)
+	v.SetDefault("nplusone.max_gap", 0)
+	v.SetDefault("nplusone.trace_ttl", 2*time.Minute)
+	v.SetDefault("nplusone.sweep_interval", 1*time.Minute)
+	v.SetDefault("nplusone.max_traces", 10000)
+
+	v.SetDefault("store.max_events", 10000)
+	v.SetDefault("store.max_age", 1*time.Hour)
+	v.SetDefault("store.max_bytes", 32<<20)
+	v.SetDefault("store.max_routes", 1000)
+
+	v.SetDefault("exporters.custom.enabled", true)
+	v.SetDefault("exporters.logging.enabled", false)
+
+	v.SetDefault("sampling.ratio", 1.0)
+	v.SetDefault("sampling.parent_based", true)
+
+	v.SetDefault("reporter.enabled", true)
+	v.SetDefault("reporter.endpoint", "/debug/apm")
+
+	v.SetDefault("store.max_runtime_samples", 360)
+
+	v.SetDefault("runtime.enabled", true)
+	v.SetDefault("runtime.collection_interval", 10*time.Second)
+}
+
+// ValidationError describes a single invalid config key.
+type ValidationError struct {
+	Key    string
+	Value  any
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s (got %v)", e.Key, e.Reason, e.Value)
+}
+
+// ValidationErrors collects every problem found by Config.Validate.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks every key and returns ValidationErrors naming each
+// offending key, or nil when the configuration is usable.
+func (c Config) Validate() error {
+	var errs ValidationErrors
+	check := func(ok bool, key string, value any, reason string) {
+		if !ok {
+			errs = append(errs, &ValidationError{Key: key, Value: value, Reason: reason})
+		}
+	}
+
+	check(c.ServiceName != "", "service_name", c.ServiceName, "must not be empty")
+	check(c.ServiceVersion != "", "service_version", c.ServiceVersion, "must not be empty")
+	_, levelErr := logging.ParseLevel(c.LogLevel)
+	check(levelErr == nil, "log_level", c.LogLevel, "must be one of debug, info, warn, error")
+
+	if c.Profiler.Enabled {
+		check(c.Profiler.LatencyThreshold > 0, "profiler.latency_threshold", c.Profiler.LatencyThreshold, "must be positive")
+		check(c.Profiler.Duration > 0, "profiler.duration", c.Profiler.Duration, "must be positive")
+		check(c.Profiler.Cooldown >= 0, "profiler.cooldown", c.Profiler.Cooldown, "must not be negative")
+		for _, t := range c.Profiler.Types {
+			check(slices.Contains(profileTypes, t), "profiler.types", t, "must be one of "+strings.Join(profileTypes, ", "))
+		}
+		check(c.Profiler.MutexProfileFraction >= 0, "profiler.mutex_profile_fraction", c.Profiler.MutexProfileFraction, "must not be negative")
+		check(c.Profiler.MinInterval >= 0, "profiler.min_interval", c.Profiler.MinInterval, "must not be negative")
+		check(c.Profiler.BlockProfileRate >= 0, "profiler.block_profile_rate", c.Profiler.BlockProfileRate, "must not be negative")
+		check(c.Profiler.MaxBytes >= 0, "profiler.max_bytes", c.Profiler.MaxBytes, "must not be negative")
+		check(c.Profiler.MaxAge >= 0, "profiler.max_age", c.Profiler.MaxAge, "must not be negative")
+
+		triggers := c.Profiler.Triggers
+		for _, r := range triggers.Routes {
+			check(r.Route != "", "profiler.triggers.routes", r.Route, "route must not be empty")
+			check(r.LatencyThreshold > 0, "profiler.triggers.routes", r.LatencyThreshold, "latency_threshold of "+r.Route+" must be positive")
+		}
+		if p := triggers.Percentile; p.Threshold != 0 {
+			check(p.Threshold > 0, "profiler.triggers.percentile.threshold", p.Threshold, "must not be negative")
+			check(p.Percentile > 0 && p.Percentile <= 100, "profiler.triggers.percentile.percentile", p.Percentile, "must be in (0, 100]")
+			check(p.Window > 0, "profiler.triggers.percentile.window", p.Window, "must be positive")
+			check(p.MinSamples >= 1, "profiler.triggers.percentile.min_samples", p.MinSamples, "must be at least 1")
+		}
+		if b := triggers.Baseline; b.Multiple != 0 {
+			check(b.Multiple > 1, "profiler.triggers.baseline.multiple", b.Multiple, "must be greater than 1")
+			check(b.MinSamples >= 1, "profiler.triggers.baseline.min_samples", b.MinSamples, "must be at least 1")
+		}
+		if e := triggers.ErrorRate; e.Rate != 0 {
+			check(e.Rate > 0 && e.Rate <= 1, "profiler.triggers.error_rate.rate", e.Rate, "must be in (0, 1]")
+			check(e.Window > 0, "profiler.triggers.error_rate.window", e.Window, "must be positive")
+			check(e.MinSamples >= 1, "profiler.triggers.error_rate.min_samples", e.MinSamples, "must be at least 1")
+		}
+		if h := triggers.HeapGrowth; h.Ratio != 0 {
+			check(h.Ratio > 0, "profiler.triggers.heap_growth.ratio", h.Ratio, "must not be negative")
+			check(h.Window > 0, "profiler.triggers.heap_growth.window", h.Window, "must be positive")
+		}
+
+		if cont := c.Profiler.Continuous; cont.Enabled {
+			check(cont.Interval > 0, "profiler.continuous.interval", cont.Interval, "must be positive")
+			check(cont.Duration > 0 && cont.Duration < cont.Interval, "profiler.continuous.duration", cont.Duration, "must be positive and shorter than profiler.continuous.interval")
+			check(len(cont.Types) > 0, "profiler.continuous.types", cont.Types, "must not be empty")
+			for _, t := range cont.Types {
+				check(slices.Contains(profileTypes, t), "profiler.continuous.types", t, "must be one of "+strings.Join(profileTypes, ", "))
+				check(t != "trace", "profiler.continuous.types", t, "execution traces cannot be merged")
+			}
+			check(cont.Retention > 0, "profiler.continuous.retention", cont.Retention, "must be positive")
+		}
+
+		if b := c.Profiler.Baselines; b.Enabled {
+			check(b.Refresh > 0, "profiler.baselines.refresh", b.Refresh, "must be positive")
+			check(b.Interval > 0, "profiler.baselines.interval", b.Interval, "must be positive")
+			check(b.Top >= 1, "profiler.baselines.top", b.Top, "must be at least 1")
+			check(slices.Contains(c.Profiler.Types, "cpu") || slices.Contains(c.Profiler.Types, "heap"), "profiler.types", c.Profiler.Types, "must include cpu or heap to compare captures to baselines")
+		}
+	}
+	if c.NPlusOne.Enabled {
+		check(c.NPlusOne.Threshold >= 2, "nplusone.threshold", c.NPlusOne.Threshold, "must be at least 2")
+		check(c.NPlusOne.MaxGap >= 0, "nplusone.max_gap", c.NPlusOne.MaxGap, "must not be negative")
+		check(c.NPlusOne.TraceTTL > 0, "nplusone.trace_ttl", c.NPlusOne.TraceTTL, "must be positive")
+		check(c.NPlusOne.SweepInterval > 0, "nplusone.sweep_interval", c.NPlusOne.SweepInterval, "must be positive")
+		check(c.NPlusOne.MaxTraces >= 0, "nplusone.max_traces", c.NPlusOne.MaxTraces, "must not be negative")
+		for _, name := range c.NPlusOne.Extractors {
+			check(slices.Contains(nPlusOneExtractors, name), "nplusone.extractors", name, "must be one of sql, http")
+		}
+		for name, threshold := range c.NPlusOne.Thresholds {
+			key := "nplusone.thresholds." + name
+			check(slices.Contains(nPlusOneExtractors, name), key, threshold, "must name one of sql, http")
+			check(threshold >= 2, key, threshold, "must be at least 2")
+		}
+	}
+	check(c.Store.MaxEvents >= 0, "store.max_events", c.Store.MaxEvents, "must not be negative")
+	check(c.Store.MaxAge >= 0, "store.max_age", c.Store.MaxAge, "must not be negative")
+	check(c.Store.MaxBytes >= 0, "store.max_bytes", c.Store.MaxBytes, "must not be negative")
+	check(c.Store.MaxRoutes >= 0, "store.max_routes", c.Store.MaxRoutes, "must not be negative")
+	check(c.Sampling.Ratio >= 0 && c.Sampling.Ratio <= 1, "sampling.ratio", c.Sampling.Ratio, "must be within [0, 1]")
+	if c.Reporter.Enabled {
+		check(strings.HasPrefix(c.Reporter.Endpoint, "/"), "reporter.endpoint", c.Reporter.Endpoint, "must start with '/'")
+	}
+	check(c.Store.MaxRuntimeSamples >= 0, "store.max_runtime_samples", c.Store.MaxRuntimeSamples, "must not be negative")
+	if c.Runtime.Enabled {
+		check(c.Runtime.CollectionInterval > 0, "runtime.collection_interval", c.Runtime.CollectionInterval, "must be positive")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
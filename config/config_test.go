@@ -0,0 +1,164 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load("")
+	require.NoError(t, err)
+
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, "unknown-service", cfg.ServiceName)
+	assert.Equal(t, 500*time.Millisecond, cfg.Profiler.LatencyThreshold)
+	assert.Equal(t, 5, cfg.NPlusOne.Threshold)
+	assert.Equal(t, []string{"sql", "http"}, cfg.NPlusOne.Extractors)
+	assert.Equal(t, "/debug/apm", cfg.Reporter.Endpoint)
+	assert.Equal(t, 10*time.Second, cfg.Runtime.CollectionInterval)
+}
+
+func TestLoad_ExplicitFile(t *testing.T) {
+	path := writeConfig(t, "probe.yml", `
+service_name: "billing"
+profiler:
+  latency_threshold: 250ms
+  triggers:
+    routes:
+      - route: /Reports/{id}
+        latency_threshold: 2s
+    percentile:
+      threshold: 300ms
+    goroutines: 5000
+  continuous:
+    enabled: true
+    interval: 30s
+  baselines:
+    enabled: true
+    top: 5
+nplusone:
+  allow:
+    routes: ["/export"]
+    fingerprints: ["SELECT 1"]
+`)
+	loader := NewLoader(path)
+	cfg, err := loader.Load()
+	require.NoError(t, err)
+
+	assert.Equal(t, "billing", cfg.ServiceName)
+	assert.Equal(t, 250*time.Millisecond, cfg.Profiler.LatencyThreshold)
+	assert.Equal(t, 10*time.Second, cfg.Profiler.Duration, "unset keys keep their defaults")
+	assert.Equal(t, []RouteTrigger{{Route: "/Reports/{id}", LatencyThreshold: 2 * time.Second}}, cfg.Profiler.Triggers.Routes)
+	assert.Equal(t, PercentileTrigger{Threshold: 300 * time.Millisecond, Percentile: 95, Window: time.Minute, MinSamples: 20}, cfg.Profiler.Triggers.Percentile)
+	assert.EqualValues(t, 5000, cfg.Profiler.Triggers.Goroutines)
+	assert.Zero(t, cfg.Profiler.Triggers.ErrorRate.Rate, "triggers are off by default")
+	assert.Equal(t, ContinuousConfig{Enabled: true, Interval: 30 * time.Second, Duration: 10 * time.Second, Types: []string{"cpu", "heap"}, Retention: time.Hour}, cfg.Profiler.Continuous)
+	assert.Equal(t, BaselinesConfig{Enabled: true, Refresh: time.Hour, Interval: time.Minute, Top: 5}, cfg.Profiler.Baselines)
+	assert.Equal(t, path, loader.Path())
+	assert.Equal(t, []string{"/export"}, cfg.NPlusOne.Allow.Routes)
+	assert.Equal(t, []string{"SELECT 1"}, cfg.NPlusOne.Allow.Fingerprints)
+}
+
+func TestLoad_DirectoryWithConfigYAML(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `service_name: "from-dir"`)
+
+	cfg, err := Load(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Equal(t, "from-dir", cfg.ServiceName)
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestLoad_Environment(t *testing.T) {
+	t.Setenv("APM_SERVICE_NAME", "from-env")
+	t.Setenv("APM_DEBUG_ENDPOINT", "/metrics/apm")
+	t.Setenv("APM_COLLECTION_INTERVAL", "3s")
+	t.Setenv("APM_ENABLED", "false")
+	t.Setenv("SERVICE_NAME", "unprefixed-must-be-ignored")
+
+	cfg, err := Load("")
+	require.NoError(t, err)
+
+	assert.Equal(t, "from-env", cfg.ServiceName)
+	assert.Equal(t, "/metrics/apm", cfg.Reporter.Endpoint)
+	assert.Equal(t, 3*time.Second, cfg.Runtime.CollectionInterval)
+	assert.False(t, cfg.Enabled)
+}
+
+func TestLoad_ValidationNamesKey(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+log_level: "loud"
+profiler:
+  types: [cpu, flame]
+  max_age: -1h
+  triggers:
+    error_rate:
+      rate: 1.5
+  continuous:
+    enabled: true
+    duration: 2m
+  baselines:
+    enabled: true
+    top: 0
+nplusone:
+  threshold: 1
+  max_gap: -1s
+  extractors: [sql, grpc]
+  thresholds:
+    http: 1
+sampling:
+  ratio: 2
+`)
+	_, err := Load(path)
+	require.Error(t, err)
+
+	var verrs ValidationErrors
+	require.True(t, errors.As(err, &verrs))
+
+	keys := make([]string, 0, len(verrs))
+	for _, e := range verrs {
+		keys = append(keys, e.Key)
+	}
+	assert.ElementsMatch(t, []string{"log_level", "profiler.types", "profiler.max_age", "profiler.triggers.error_rate.rate", "profiler.continuous.duration", "profiler.baselines.top", "nplusone.threshold", "nplusone.max_gap", "nplusone.extractors", "nplusone.thresholds.http", "sampling.ratio"}, keys)
+	assert.Contains(t, err.Error(), "nplusone.threshold")
+}
+
+func TestLoad_Isolated(t *testing.T) {
+	a := writeConfig(t, "a.yaml", `service_name: "a"`)
+	b := writeConfig(t, "b.yaml", `service_name: "b"`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cfg, err := Load(a)
+			assert.NoError(t, err)
+			assert.Equal(t, "a", cfg.ServiceName)
+		}()
+		go func() {
+			defer wg.Done()
+			cfg, err := Load(b)
+			assert.NoError(t, err)
+			assert.Equal(t, "b", cfg.ServiceName)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the bursts of events editors and config-map updates
+// produce for a single logical change.
+const reloadDebounce = 100 * time.Millisecond
+
+// Watch starts watching the config file and returns once the watch is in
+// place. Until ctx is done it re-reads the file after each change and passes
+// the result to onChange; the returned channel is closed when watching has
+// stopped. A file that fails to parse or
+// validate is reported through the error argument together with a zero
+// Config; it is up to the caller to keep the previous configuration.
+//
+// Load must have succeeded before Watch is called, and the loader must not be
+// used concurrently with Watch.
+func (l *Loader) Watch(ctx context.Context, onChange func(Config, error)) (<-chan struct{}, error) {
+	file := l.Path()
+	if file == "" {
+		return nil, errors.New("config: nothing to watch, loader did not read a file")
+	}
+	file = filepath.Clean(file)
+	realFile, _ := filepath.EvalSymlinks(file)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config watcher: %w", err)
+	}
+
+	// Watching the directory rather than the file survives editors that
+	// replace the file and Kubernetes' symlink swaps.
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", filepath.Dir(file), err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer watcher.Close()
+		l.watchLoop(ctx, watcher, file, realFile, onChange)
+	}()
+	return done, nil
+}
+
+func (l *Loader) watchLoop(ctx context.Context, watcher *fsnotify.Watcher, file, realFile string, onChange func(Config, error)) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			currentFile, _ := filepath.EvalSymlinks(file)
+			touched := filepath.Clean(event.Name) == file && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create))
+			relinked := currentFile != "" && currentFile != realFile
+			if touched || relinked {
+				realFile = currentFile
+				debounce = time.After(reloadDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			onChange(Config{}, fmt.Errorf("config watcher: %w", err))
+		case <-debounce:
+			debounce = nil
+			onChange(l.read())
+		}
+	}
+}
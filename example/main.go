@@ -13,12 +13,11 @@ import (
 	apm "github.com/fllarpy/apm-probe"
 	httpinstrumentation "github.com/fllarpy/apm-probe/instrumentation/http"
 	sqlinstrumentation "github.com/fllarpy/apm-probe/instrumentation/sql"
-	"github.com/fllarpy/apm-probe/internal/ports/http_reporter"
 )
 
 func main() {
 	ctx := context.Background()
-	probe, store, err := apm.NewProbe(ctx, "hybrid-service")
+	probe, _, err := apm.NewProbeFromConfig(ctx, ".")
 	if err != nil {
 		log.Fatalf("failed to initialize apm probe: %v", err)
 	}
@@ -41,10 +40,16 @@ func main() {
 	mux.HandleFunc("/slow", slowHandler)
 	mux.HandleFunc("/n-plus-one", nPlusOneHandler(db))
 
-	metricsHandler := http_reporter.NewHandler(store)
-	mux.Handle("/debug/apm", metricsHandler)
+	if metricsHandler := probe.MetricsHandler(); metricsHandler != nil {
+		mux.Handle(probe.ReporterEndpoint(), metricsHandler)
+	}
+	if profilesHandler := probe.ProfilesHandler(); profilesHandler != nil {
+		mux.Handle(probe.ProfilesEndpoint(), profilesHandler)
+	}
 
-	instrumentedHandler := httpinstrumentation.NewMiddleware(mux, "http-server")
+	instrumentedHandler := httpinstrumentation.NewMiddleware(mux, "http-server",
+		httpinstrumentation.WithFilteredPaths(probe.ReporterEndpoint(), probe.ProfilesEndpoint()),
+	)
 
 	log.Printf("Starting server for service 'hybrid-service' on :8080")
 	log.Println("Test endpoint: http://localhost:8080/")
@@ -54,6 +59,7 @@ func main() {
 	log.Println("Slow endpoint for profiling: http://localhost:8080/slow")
 	log.Println("N+1 test endpoint: http://localhost:8080/n-plus-one")
 	log.Println("Legacy metrics endpoint: http://localhost:8080/debug/apm")
+	log.Println("Captured profiles: http://localhost:8080/debug/apm/profiles/")
 
 	if err := http.ListenAndServe(":8080", instrumentedHandler); err != nil {
 		log.Fatalf("could not start server: %v", err)
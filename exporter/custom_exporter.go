@@ -2,13 +2,13 @@ package exporter
 
 import (
 	"context"
-	"log"
 	"time"
 
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/internal/spanattr"
 	"github.com/fllarpy/apm-probe/storage/inmemory"
 	"go.opentelemetry.io/otel/codes"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -16,9 +16,11 @@ import (
 // suites to inject lightweight mocks without depending on the concrete
 // implementation from the profiling package.
 type Profiler interface {
-	// ProfileEndpointIfSlow profiles an endpoint when its latency exceeds a
-	// threshold. The real implementation is provided by profiling.Profiler.
-	ProfileEndpointIfSlow(path string, duration time.Duration)
+	// ObserveRequest is called for every server request and profiles the
+	// endpoint when one of the profiler's trigger policies fires. traceID
+	// identifies the request. The real implementation is provided by
+	// profiling.Profiler.
+	ObserveRequest(path string, duration time.Duration, failed bool, traceID string)
 }
 
 // N1Detector is the minimal interface the exporter relies on for detecting
@@ -28,18 +30,29 @@ type N1Detector interface {
 	ProcessSpan(span sdktrace.ReadOnlySpan)
 }
 
+// Store is the subset of inmemory.Store the exporter writes to. Tests wrap
+// the real store to observe calls.
+type Store interface {
+	AddRequest(path string, duration time.Duration, statusCode int)
+	AddClientRequest(call inmemory.ClientCall)
+	AddDependencyEdges(route string, calls []inmemory.ClientCall)
+	AddError(event inmemory.ErrorEvent)
+}
+
 type CustomExporter struct {
-	store      *inmemory.Store
+	store      Store
 	profiler   Profiler
 	n1detector N1Detector
+	calls      *callTracker
 }
 
-func NewCustomExporter(store *inmemory.Store, profiler Profiler, n1detector N1Detector) (*CustomExporter, error) {
-	log.Println("Initializing custom exporter.")
+func NewCustomExporter(store Store, profiler Profiler, n1detector N1Detector) (*CustomExporter, error) {
+	logging.Infof("Initializing custom exporter.")
 	return &CustomExporter{
 		store:      store,
 		profiler:   profiler,
 		n1detector: n1detector,
+		calls:      newCallTracker(),
 	}, nil
 }
 
@@ -48,6 +61,7 @@ func (e *CustomExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadO
 		if e.n1detector != nil {
 			e.n1detector.ProcessSpan(span)
 		}
+		e.calls.observe(span)
 
 		switch span.SpanKind() {
 		case trace.SpanKindServer:
@@ -60,65 +74,64 @@ func (e *CustomExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadO
 }
 
 func (e *CustomExporter) Shutdown(ctx context.Context) error {
-	log.Println("Custom exporter shut down.")
+	logging.Infof("Custom exporter shut down.")
 	return nil
 }
 
 func (e *CustomExporter) processServerSpan(span sdktrace.ReadOnlySpan) {
 	duration := span.EndTime().Sub(span.StartTime())
-	path := span.Name()
+	info := spanattr.Server(span)
 
-	var statusCode int
-	var errorMsg string
 	hasError := span.Status().Code == codes.Error
-
-	for _, attr := range span.Attributes() {
-		if string(attr.Key) == "http.status_code" {
-			statusCode = int(attr.Value.AsInt64())
-		}
-		if string(attr.Key) == "exception.message" {
-			errorMsg = attr.Value.AsString()
-		}
-	}
-
-	if statusCode >= 500 {
+	if info.StatusCode >= 500 {
 		hasError = true
 	}
 
-	log.Printf("CustomExporter: Processed SERVER span: %s, Duration: %s, Status: %d", path, duration, statusCode)
-	e.store.AddRequest(path, duration, statusCode)
+	logging.Debugf("CustomExporter: Processed SERVER span: %s %s, Duration: %s, Status: %d", info.Method, info.Route, duration, info.StatusCode)
+	e.store.AddRequest(info.Route, duration, info.StatusCode)
 
 	if hasError {
 		e.store.AddError(inmemory.ErrorEvent{
 			Timestamp: span.EndTime(),
-			Method:    "",
-			Path:      path,
-			Error:     errorMsg,
+			Method:    info.Method,
+			Path:      info.Route,
+			Error:     info.Error,
 		})
 	}
 
+	if calls := e.calls.take(span); len(calls) > 0 {
+		e.store.AddDependencyEdges(info.Route, calls)
+	}
+
 	if e.profiler != nil {
-		e.profiler.ProfileEndpointIfSlow(path, duration)
+		e.profiler.ObserveRequest(info.Route, duration, hasError, span.SpanContext().TraceID().String())
 	}
 }
 
 func (e *CustomExporter) processClientSpan(span sdktrace.ReadOnlySpan) {
 	duration := span.EndTime().Sub(span.StartTime())
-	var hasError bool
-
-	if span.Status().Code == codes.Error {
-		hasError = true
-	}
+	hasError := span.Status().Code == codes.Error
 
-	for _, attr := range span.Attributes() {
-		if attr.Key == semconv.DBSystemKey {
-			log.Printf("CustomExporter: Processed CLIENT span (db): %s, Duration: %s", span.Name(), duration)
-			e.store.AddClientRequest(duration, 0)
-			break
+	var call inmemory.ClientCall
+	if dep, ok := databaseDependency(span); ok {
+		logging.Debugf("CustomExporter: Processed CLIENT span (db): %s, Duration: %s", span.Name(), duration)
+		call = inmemory.ClientCall{Dependency: dep, Duration: duration, Failed: hasError}
+	} else if info, ok := spanattr.Client(span); ok {
+		logging.Debugf("CustomExporter: Processed CLIENT span (http): %s %s%s, Duration: %s, Status: %d", info.Method, info.Host, info.Route, duration, info.StatusCode)
+		call = inmemory.ClientCall{
+			Dependency: inmemory.Dependency{Kind: inmemory.DependencyHTTP, Address: info.Host},
+			Route:      info.Route,
+			Duration:   duration,
+			StatusCode: info.StatusCode,
+			Failed:     hasError || info.StatusCode >= 500 || info.StatusCode == 0,
+		}
+	} else {
+		if hasError {
+			logging.Debugf("CustomExporter: Client span had an error: %s", span.Name())
 		}
+		return
 	}
 
-	if hasError {
-		log.Printf("CustomExporter: Client span had an error: %s", span.Name())
-	}
+	e.store.AddClientRequest(call)
+	e.calls.add(span, call)
 }
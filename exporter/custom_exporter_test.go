@@ -7,9 +7,11 @@ import (
 
 	"github.com/fllarpy/apm-probe/storage/inmemory"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
@@ -25,17 +27,23 @@ func (s *testStore) AddRequest(path string, duration time.Duration, statusCode i
 	s.requests++
 	s.Store.AddRequest(path, duration, statusCode)
 }
-func (s *testStore) AddClientRequest(duration time.Duration, statusCode int) {
+func (s *testStore) AddClientRequest(call inmemory.ClientCall) {
 	s.client++
-	s.Store.AddClientRequest(duration, statusCode)
+	s.Store.AddClientRequest(call)
 }
 func (s *testStore) AddError(event inmemory.ErrorEvent) { s.errors++; s.Store.AddError(event) }
 
 type mockProfiler struct {
-	calls int
+	calls  int
+	failed int
 }
 
-func (m *mockProfiler) ProfileEndpointIfSlow(path string, duration time.Duration) { m.calls++ }
+func (m *mockProfiler) ObserveRequest(path string, duration time.Duration, failed bool, traceID string) {
+	m.calls++
+	if failed {
+		m.failed++
+	}
+}
 
 type mockN1Detector struct {
 	calls int
@@ -51,19 +59,20 @@ func TestCustomExporter_ExportSpans(t *testing.T) {
 		store := &testStore{}
 		profiler := &mockProfiler{}
 		detector := &mockN1Detector{}
-		exporter, _ := NewCustomExporter(&store.Store, profiler, detector)
+		exporter, _ := NewCustomExporter(store, profiler, detector)
 
-		span := &sdktrace.SpanSnapshot{
+		span := tracetest.SpanStub{
 			SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: spanID}),
 			SpanKind:    oteltrace.SpanKindServer,
 			Name:        "/test",
 			StartTime:   time.Now(),
 			EndTime:     time.Now().Add(10 * time.Millisecond),
-		}
+		}.Snapshot()
 		_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
 
 		assert.Equal(t, 1, store.requests, "AddRequest should be called for server spans")
-		assert.Equal(t, 1, profiler.calls, "ProfileEndpointIfSlow should be called for server spans")
+		assert.Equal(t, 1, profiler.calls, "ObserveRequest should be called for server spans")
+		assert.Equal(t, 0, profiler.failed)
 		assert.Equal(t, 1, detector.calls, "N1Detector.ProcessSpan should be called")
 		assert.Equal(t, 0, store.client, "AddClientRequest should not be called")
 	})
@@ -72,38 +81,279 @@ func TestCustomExporter_ExportSpans(t *testing.T) {
 		store := &testStore{}
 		profiler := &mockProfiler{}
 		detector := &mockN1Detector{}
-		exporter, _ := NewCustomExporter(&store.Store, profiler, detector)
+		exporter, _ := NewCustomExporter(store, profiler, detector)
 
-		span := &sdktrace.SpanSnapshot{
+		span := tracetest.SpanStub{
 			SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: spanID}),
 			SpanKind:    oteltrace.SpanKindClient,
 			Attributes:  []attribute.KeyValue{semconv.DBSystemSqlite},
 			StartTime:   time.Now(),
 			EndTime:     time.Now().Add(5 * time.Millisecond),
-		}
+		}.Snapshot()
 		_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
 
 		assert.Equal(t, 1, store.client, "AddClientRequest should be called for client spans")
 		assert.Equal(t, 1, detector.calls, "N1Detector.ProcessSpan should be called")
 		assert.Equal(t, 0, store.requests, "AddRequest should not be called")
-		assert.Equal(t, 0, profiler.calls, "ProfileEndpointIfSlow should not be called")
+		assert.Equal(t, 0, profiler.calls, "ObserveRequest should not be called")
 	})
 
 	t.Run("processes error span correctly", func(t *testing.T) {
 		store := &testStore{}
 		profiler := &mockProfiler{}
 		detector := &mockN1Detector{}
-		exporter, _ := NewCustomExporter(&store.Store, profiler, detector)
+		exporter, _ := NewCustomExporter(store, profiler, detector)
 
-		span := &sdktrace.SpanSnapshot{
+		span := tracetest.SpanStub{
 			SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: spanID}),
 			SpanKind:    oteltrace.SpanKindServer,
 			Status:      sdktrace.Status{Code: codes.Error, Description: "something went wrong"},
 			StartTime:   time.Now(),
 			EndTime:     time.Now().Add(15 * time.Millisecond),
-		}
+		}.Snapshot()
 		_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
 
 		assert.Equal(t, 1, store.errors, "AddError should be called for spans with error status")
+		assert.Equal(t, 1, profiler.failed, "the profiler should see the request as failed")
 	})
 }
+
+func TestCustomExporter_ServerSpanRoute(t *testing.T) {
+	traceID := oteltrace.TraceID{0x01}
+	spanID := oteltrace.SpanID{0x01}
+
+	tests := []struct {
+		name       string
+		spanName   string
+		attrs      []attribute.KeyValue
+		wantRoute  string
+		wantMethod string
+		wantStatus string
+	}{
+		{
+			name:       "old semconv with http.route",
+			spanName:   "http-server",
+			attrs:      []attribute.KeyValue{attribute.String("http.route", "/users/{id}"), attribute.String("http.method", "GET"), attribute.Int("http.status_code", 503), attribute.String("http.target", "/users/42")},
+			wantRoute:  "/users/{id}",
+			wantMethod: "GET",
+			wantStatus: "5xx",
+		},
+		{
+			name:       "new semconv",
+			spanName:   "http-server",
+			attrs:      []attribute.KeyValue{attribute.String("http.route", "/orders"), attribute.String("http.request.method", "POST"), attribute.Int("http.response.status_code", 502)},
+			wantRoute:  "/orders",
+			wantMethod: "POST",
+			wantStatus: "5xx",
+		},
+		{
+			name:       "ServeMux pattern as span name",
+			spanName:   "DELETE /items/{id}",
+			attrs:      []attribute.KeyValue{attribute.Int("http.response.status_code", 500)},
+			wantRoute:  "/items/{id}",
+			wantMethod: "DELETE",
+			wantStatus: "5xx",
+		},
+		{
+			name:       "falls back to the templated request path without query",
+			spanName:   "http-server",
+			attrs:      []attribute.KeyValue{attribute.String("http.method", "GET"), attribute.String("http.target", "/users/42/orders?q=go"), attribute.Int("http.status_code", 500)},
+			wantRoute:  "/users/{id}/orders",
+			wantMethod: "GET",
+			wantStatus: "5xx",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &testStore{}
+			exporter, _ := NewCustomExporter(store, nil, nil)
+
+			span := tracetest.SpanStub{
+				SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: spanID}),
+				SpanKind:    oteltrace.SpanKindServer,
+				Name:        tt.spanName,
+				Attributes:  tt.attrs,
+				StartTime:   time.Now(),
+				EndTime:     time.Now().Add(10 * time.Millisecond),
+			}.Snapshot()
+			_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
+
+			report := store.Report(inmemory.Query{})
+			assert.Len(t, report.Routes, 1)
+			assert.Equal(t, tt.wantRoute, report.Routes[0].Route)
+			assert.Equal(t, 1, report.Routes[0].StatusClasses[tt.wantStatus])
+			if assert.Len(t, report.Errors, 1) {
+				assert.Equal(t, tt.wantMethod, report.Errors[0].Method)
+				assert.Equal(t, tt.wantRoute, report.Errors[0].Path)
+			}
+		})
+	}
+}
+
+func TestCustomExporter_HTTPClientSpan(t *testing.T) {
+	tests := []struct {
+		name       string
+		attrs      []attribute.KeyValue
+		wantHost   string
+		wantRoute  string
+		wantStatus string
+		wantErrors int
+	}{
+		{
+			name:       "old semconv",
+			attrs:      []attribute.KeyValue{attribute.String("http.method", "GET"), attribute.String("http.url", "http://api.example.com/users/42?full=1"), attribute.Int("http.status_code", 200)},
+			wantHost:   "api.example.com",
+			wantRoute:  "/users/{id}",
+			wantStatus: "2xx",
+		},
+		{
+			name:       "new semconv with explicit port",
+			attrs:      []attribute.KeyValue{attribute.String("http.request.method", "POST"), attribute.String("url.full", "http://10.0.0.1:8080/orders"), attribute.String("server.address", "10.0.0.1"), attribute.Int("server.port", 8080), attribute.Int("http.response.status_code", 503)},
+			wantHost:   "10.0.0.1:8080",
+			wantRoute:  "/orders",
+			wantStatus: "5xx",
+			wantErrors: 1,
+		},
+		{
+			name:       "transport error without response",
+			attrs:      []attribute.KeyValue{attribute.String("http.method", "GET"), attribute.String("http.url", "https://down.example.com/ping")},
+			wantHost:   "down.example.com",
+			wantRoute:  "/ping",
+			wantStatus: "unknown",
+			wantErrors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &testStore{}
+			exporter, _ := NewCustomExporter(store, nil, nil)
+
+			span := tracetest.SpanStub{
+				SpanKind:   oteltrace.SpanKindClient,
+				Name:       "HTTP call",
+				Attributes: tt.attrs,
+				StartTime:  time.Now(),
+				EndTime:    time.Now().Add(5 * time.Millisecond),
+			}.Snapshot()
+			_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span})
+
+			assert.Equal(t, 1, store.client)
+			assert.Zero(t, store.Report(inmemory.Query{}).Database.Count, "HTTP calls are not database calls")
+			report := store.Report(inmemory.Query{})
+			if assert.Len(t, report.HTTPClients, 1) {
+				c := report.HTTPClients[0]
+				assert.Equal(t, tt.wantHost, c.Host)
+				assert.Equal(t, tt.wantRoute, c.Route)
+				assert.Equal(t, 1, c.Count)
+				assert.Equal(t, tt.wantErrors, c.Errors)
+				assert.Equal(t, 1, c.StatusClasses[tt.wantStatus])
+			}
+		})
+	}
+}
+
+func TestCustomExporter_Dependencies(t *testing.T) {
+	store := &testStore{}
+	exporter, _ := NewCustomExporter(store, nil, nil)
+
+	traceID := oteltrace.TraceID{0x02}
+	sc := oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: oteltrace.SpanID{0x01}})
+	now := time.Now()
+	spans := []sdktrace.ReadOnlySpan{
+		tracetest.SpanStub{
+			SpanContext: spanContext(traceID, 0x02),
+			Parent:      sc,
+			SpanKind:    oteltrace.SpanKindClient,
+			Attributes:  []attribute.KeyValue{semconv.DBSystemPostgreSQL, attribute.String("db.name", "shop"), attribute.String("server.address", "db"), attribute.Int("server.port", 5432)},
+			StartTime:   now,
+			EndTime:     now.Add(3 * time.Millisecond),
+		}.Snapshot(),
+		tracetest.SpanStub{
+			SpanContext: spanContext(traceID, 0x03),
+			Parent:      sc,
+			SpanKind:    oteltrace.SpanKindClient,
+			Status:      sdktrace.Status{Code: codes.Error},
+			Attributes:  []attribute.KeyValue{semconv.DBSystemPostgreSQL, attribute.String("db.name", "shop"), attribute.String("server.address", "db"), attribute.Int("server.port", 5432)},
+			StartTime:   now,
+			EndTime:     now.Add(5 * time.Millisecond),
+		}.Snapshot(),
+	}
+	_ = exporter.ExportSpans(context.Background(), spans)
+
+	graph := store.DependencyGraph(inmemory.Query{})
+	require.Len(t, graph.Nodes, 1)
+	assert.Equal(t, "postgresql://db:5432/shop", graph.Nodes[0].Dependency.String())
+	assert.Equal(t, 2, graph.Nodes[0].Count)
+	assert.Equal(t, 1, graph.Nodes[0].Errors)
+	assert.Empty(t, graph.Edges, "edges wait for the server span")
+
+	server := tracetest.SpanStub{
+		SpanContext: sc,
+		SpanKind:    oteltrace.SpanKindServer,
+		Name:        "GET /orders",
+		StartTime:   now,
+		EndTime:     now.Add(10 * time.Millisecond),
+	}.Snapshot()
+	_ = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{server})
+
+	graph = store.DependencyGraph(inmemory.Query{})
+	require.Len(t, graph.Edges, 1)
+	assert.Equal(t, "/orders", graph.Edges[0].Route)
+	assert.Equal(t, 2, graph.Edges[0].Count)
+	assert.Equal(t, 1, graph.Edges[0].Errors)
+	assert.Len(t, store.DependencyGraph(inmemory.Query{Route: "/other"}).Nodes, 0)
+}
+
+func TestCustomExporter_NestedServerSpans(t *testing.T) {
+	store := &testStore{}
+	exporter, _ := NewCustomExporter(store, nil, nil)
+
+	// GET /orders calls GET /users of the same service over HTTP. Both
+	// handlers query their own database.
+	traceID := oteltrace.TraceID{0x03}
+	outer, handler, client, inner := spanContext(traceID, 0x01), spanContext(traceID, 0x02), spanContext(traceID, 0x03), spanContext(traceID, 0x04)
+	remote := oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: client.SpanID(), Remote: true})
+	now := time.Now()
+	dbCall := func(id byte, parent oteltrace.SpanContext, name string) sdktrace.ReadOnlySpan {
+		return tracetest.SpanStub{
+			SpanContext: spanContext(traceID, id),
+			Parent:      parent,
+			SpanKind:    oteltrace.SpanKindClient,
+			Attributes:  []attribute.KeyValue{semconv.DBSystemPostgreSQL, attribute.String("db.name", name)},
+			StartTime:   now,
+			EndTime:     now.Add(time.Millisecond),
+		}.Snapshot()
+	}
+	spans := []sdktrace.ReadOnlySpan{
+		dbCall(0x10, handler, "orders"),
+		dbCall(0x11, inner, "users"),
+		tracetest.SpanStub{SpanContext: inner, Parent: remote, SpanKind: oteltrace.SpanKindServer, Name: "GET /users"}.Snapshot(),
+		tracetest.SpanStub{
+			SpanContext: client,
+			Parent:      handler,
+			SpanKind:    oteltrace.SpanKindClient,
+			Attributes:  []attribute.KeyValue{attribute.String("http.method", "GET"), attribute.String("http.url", "http://localhost:8080/users"), attribute.Int("http.status_code", 200)},
+		}.Snapshot(),
+		tracetest.SpanStub{SpanContext: handler, Parent: outer, SpanKind: oteltrace.SpanKindInternal, Name: "handler"}.Snapshot(),
+		tracetest.SpanStub{SpanContext: outer, SpanKind: oteltrace.SpanKindServer, Name: "GET /orders"}.Snapshot(),
+	}
+	_ = exporter.ExportSpans(context.Background(), spans)
+
+	graph := store.DependencyGraph(inmemory.Query{Route: "/users"})
+	require.Len(t, graph.Edges, 1)
+	assert.Equal(t, "postgresql:///users", graph.Edges[0].Dependency.String())
+
+	graph = store.DependencyGraph(inmemory.Query{Route: "/orders"})
+	require.Len(t, graph.Edges, 2)
+	var deps []string
+	for _, edge := range graph.Edges {
+		deps = append(deps, edge.Dependency.String())
+	}
+	assert.ElementsMatch(t, []string{"postgresql:///orders", "http://localhost:8080"}, deps)
+}
+
+func spanContext(traceID oteltrace.TraceID, id byte) oteltrace.SpanContext {
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: oteltrace.SpanID{id}})
+}
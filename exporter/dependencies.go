@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/spanattr"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// databaseDependency identifies the database called by a client span from
+// db.system, db.name (or db.namespace) and the server address. ok is false
+// for spans without db.system.
+func databaseDependency(span sdktrace.ReadOnlySpan) (inmemory.Dependency, bool) {
+	db, ok := spanattr.DatabaseCall(span)
+	return inmemory.Dependency{
+		Kind:    inmemory.DependencyDatabase,
+		System:  db.System,
+		Name:    db.Name,
+		Address: db.Address,
+	}, ok
+}
+
+const (
+	// maxPendingTraces bounds the traces whose calls wait for their server
+	// span.
+	maxPendingTraces = 10000
+	// pendingTTL drops calls whose server span never arrives, e.g. calls
+	// made by background jobs.
+	pendingTTL = time.Minute
+)
+
+// callTracker holds the client calls of a trace until the server span they
+// were made under is exported, so that the calls can be attributed to its
+// route. Client spans end before their server span, so they are exported
+// first. A trace can hold several server spans, e.g. when a handler calls
+// its own service, and each takes only the calls made under it.
+type callTracker struct {
+	mu        sync.Mutex
+	pending   map[trace.TraceID]*pendingCalls
+	lastSweep time.Time
+}
+
+type pendingCalls struct {
+	added time.Time
+	calls []spanCall
+	// parents maps the spans that ended since the first call to their
+	// parent, for those whose parent is in this process.
+	parents map[trace.SpanID]trace.SpanID
+}
+
+// spanCall is a client call and the span it was made under.
+type spanCall struct {
+	parent trace.SpanID
+	call   inmemory.ClientCall
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{pending: make(map[trace.TraceID]*pendingCalls)}
+}
+
+// add records call, made by the client span span.
+func (t *callTracker) add(span sdktrace.ReadOnlySpan, call inmemory.ClientCall) {
+	traceID, parent := span.SpanContext().TraceID(), span.Parent()
+	if !traceID.IsValid() || !parent.IsValid() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+	p, ok := t.pending[traceID]
+	if !ok {
+		if len(t.pending) >= maxPendingTraces {
+			return
+		}
+		p = &pendingCalls{added: now, parents: make(map[trace.SpanID]trace.SpanID)}
+		t.pending[traceID] = p
+	}
+	p.calls = append(p.calls, spanCall{parent: parent.SpanID(), call: call})
+}
+
+// observe links span to its parent when calls of its trace are pending.
+// Spans end after their children, so the calls made under span, directly
+// or not, are recorded by then.
+func (t *callTracker) observe(span sdktrace.ReadOnlySpan) {
+	parent := span.Parent()
+	if !parent.IsValid() || parent.IsRemote() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[span.SpanContext().TraceID()]; ok {
+		p.parents[span.SpanContext().SpanID()] = parent.SpanID()
+	}
+}
+
+// take returns and forgets the calls made under the server span span.
+func (t *callTracker) take(span sdktrace.ReadOnlySpan) []inmemory.ClientCall {
+	traceID, root := span.SpanContext().TraceID(), span.SpanContext().SpanID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[traceID]
+	if !ok {
+		return nil
+	}
+	var taken []inmemory.ClientCall
+	kept := p.calls[:0]
+	for _, c := range p.calls {
+		if p.under(c.parent, root) {
+			taken = append(taken, c.call)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.calls = kept
+	for id := range p.parents {
+		if p.under(id, root) {
+			delete(p.parents, id)
+		}
+	}
+	if len(p.calls) == 0 {
+		delete(t.pending, traceID)
+	}
+	return taken
+}
+
+// under reports whether span is root or one of its descendants.
+func (p *pendingCalls) under(span, root trace.SpanID) bool {
+	// Bound the walk in case of a cycle in malformed parent links.
+	for range len(p.parents) + 1 {
+		if span == root {
+			return true
+		}
+		parent, ok := p.parents[span]
+		if !ok {
+			return false
+		}
+		span = parent
+	}
+	return false
+}
+
+// sweep drops expired traces at most once per pendingTTL. The caller must
+// hold t.mu.
+func (t *callTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < pendingTTL {
+		return
+	}
+	t.lastSweep = now
+	for id, p := range t.pending {
+		if now.Sub(p.added) > pendingTTL {
+			delete(t.pending, id)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// LoggingExporter writes a one-line summary of every finished span to the
+// log. It is meant for local debugging and is disabled by default.
+type LoggingExporter struct{}
+
+func NewLoggingExporter() *LoggingExporter {
+	return &LoggingExporter{}
+}
+
+func (e *LoggingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, span := range spans {
+		logging.Infof("LoggingExporter: span=%q kind=%s trace=%s duration=%s status=%s",
+			span.Name(),
+			span.SpanKind(),
+			span.SpanContext().TraceID(),
+			span.EndTime().Sub(span.StartTime()),
+			span.Status().Code,
+		)
+	}
+	return nil
+}
+
+func (e *LoggingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
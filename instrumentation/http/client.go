@@ -0,0 +1,48 @@
+package http
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// NewTransport wraps base so that every outgoing request is recorded as a
+// client span and carries the trace context of its request context in the
+// headers. A nil base means http.DefaultTransport.
+//
+// Of the options, WithFilter, WithFilteredPaths, WithTracerProvider and
+// WithPropagators apply to clients; the others are ignored.
+func NewTransport(base http.RoundTripper, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	otelOpts := []otelhttp.Option{}
+	for _, f := range cfg.filters {
+		otelOpts = append(otelOpts, otelhttp.WithFilter(f))
+	}
+	if cfg.tracerProvider != nil {
+		otelOpts = append(otelOpts, otelhttp.WithTracerProvider(cfg.tracerProvider))
+	}
+	if cfg.propagators != nil {
+		otelOpts = append(otelOpts, otelhttp.WithPropagators(cfg.propagators))
+	}
+	return otelhttp.NewTransport(base, otelOpts...)
+}
+
+// NewClient returns a copy of client whose transport is wrapped by
+// NewTransport. A nil client means http.DefaultClient. Requests must carry
+// the caller's context (http.NewRequestWithContext) for the client span to
+// join the current trace.
+func NewClient(client *http.Client, opts ...Option) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := *client
+	c.Transport = NewTransport(client.Transport, opts...)
+	return &c
+}
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fllarpy/apm-probe/exporter"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewClient(t *testing.T) {
+	var traceparents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client := NewClient(nil, WithTracerProvider(tp), WithPropagators(propagation.TraceContext{}))
+	require.NotSame(t, http.DefaultClient, client)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	for _, path := range []string{"/users/1", "/users/2", "/fail"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	parent.End()
+
+	t.Run("propagates the trace context", func(t *testing.T) {
+		require.Len(t, traceparents, 3)
+		for _, header := range traceparents {
+			assert.Contains(t, header, parent.SpanContext().TraceID().String())
+		}
+	})
+
+	t.Run("aggregates calls per host and route", func(t *testing.T) {
+		var clientSpans []sdktrace.ReadOnlySpan
+		for _, span := range recorder.Ended() {
+			if span.SpanKind() == trace.SpanKindClient {
+				clientSpans = append(clientSpans, span)
+			}
+		}
+		require.Len(t, clientSpans, 3)
+
+		store := inmemory.NewStore()
+		exp, err := exporter.NewCustomExporter(store, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, exp.ExportSpans(context.Background(), clientSpans))
+
+		u, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.HTTPClients, 2)
+
+		fail, users := report.HTTPClients[0], report.HTTPClients[1]
+		assert.Equal(t, u.Host, users.Host)
+		assert.Equal(t, "/users/{id}", users.Route)
+		assert.Equal(t, 2, users.Count)
+		assert.Equal(t, 2, users.StatusClasses["2xx"])
+		assert.Positive(t, users.Latency.Max)
+
+		assert.Equal(t, "/fail", fail.Route)
+		assert.Equal(t, 1, fail.Errors)
+		assert.Equal(t, 1, fail.StatusClasses["5xx"])
+	})
+
+	t.Run("keeps the settings of the given client", func(t *testing.T) {
+		base := &http.Client{Timeout: 42}
+		wrapped := NewClient(base)
+		assert.Equal(t, base.Timeout, wrapped.Timeout)
+		assert.Nil(t, base.Transport)
+		assert.NotNil(t, wrapped.Transport)
+	})
+}
@@ -1,11 +1,220 @@
 package http
 
 import (
+	"context"
 	"net/http"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/fllarpy/apm-probe/profiling"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func NewMiddleware(handler http.Handler, operation string) http.Handler {
-	return otelhttp.NewHandler(handler, operation)
-} 
+// SpanNameFormatter returns the span name for a request that matched the
+// given ServeMux pattern (e.g. "GET /users/{id}" or "/static/").
+type SpanNameFormatter func(pattern string, r *http.Request) string
+
+// Option configures NewMiddleware.
+type Option func(*config)
+
+type config struct {
+	filters          []func(*http.Request) bool
+	formatter        SpanNameFormatter
+	publicEndpoint   bool
+	publicEndpointFn func(*http.Request) bool
+	tracerProvider   trace.TracerProvider
+	propagators      propagation.TextMapPropagator
+	noLabels         bool
+}
+
+// WithFilteredPaths skips tracing for requests whose URL path equals one of
+// paths, e.g. health checks or the metrics endpoint itself. As with
+// ServeMux patterns, a path ending in a slash also skips the subtree below
+// it, e.g. "/debug/apm/profiles/" covers every capture it serves.
+func WithFilteredPaths(paths ...string) Option {
+	skip := make(map[string]bool, len(paths))
+	var prefixes []string
+	for _, p := range paths {
+		skip[p] = true
+		if strings.HasSuffix(p, "/") {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return WithFilter(func(r *http.Request) bool {
+		if skip[r.URL.Path] {
+			return false
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// WithFilter adds a filter; requests for which any filter returns false are
+// not traced.
+func WithFilter(f func(*http.Request) bool) Option {
+	return func(c *config) {
+		c.filters = append(c.filters, f)
+	}
+}
+
+// WithSpanNameFormatter replaces the default span naming, which uses the
+// matched pattern prefixed by the request method.
+func WithSpanNameFormatter(f SpanNameFormatter) Option {
+	return func(c *config) {
+		c.formatter = f
+	}
+}
+
+// WithPublicEndpoint treats every request as coming from outside the trust
+// boundary: an incoming trace context is linked to the server span instead
+// of becoming its parent.
+func WithPublicEndpoint() Option {
+	return func(c *config) {
+		c.publicEndpoint = true
+	}
+}
+
+// WithPublicEndpointFn is like WithPublicEndpoint but decides per request.
+func WithPublicEndpointFn(fn func(*http.Request) bool) Option {
+	return func(c *config) {
+		c.publicEndpointFn = fn
+	}
+}
+
+// WithTracerProvider uses tp instead of the global tracer provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithPropagators extracts the incoming trace context with p instead of the
+// global propagator.
+func WithPropagators(p propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagators = p
+	}
+}
+
+// WithoutProfilerLabels stops the middleware from setting pprof labels on
+// the goroutine serving each request.
+func WithoutProfilerLabels() Option {
+	return func(c *config) {
+		c.noLabels = true
+	}
+}
+
+// NewMiddleware traces every request handled by handler. When handler is an
+// *http.ServeMux, or routes with one further down, the matched pattern becomes
+// the span name and the http.route attribute. Requests that match no pattern
+// keep operation as their span name.
+//
+// Unless WithoutProfilerLabels is given, the request is served with the pprof
+// labels profiling.LabelRoute (when the pattern is known before dispatch),
+// profiling.LabelTraceID and profiling.LabelSpanID, so that profiles can be
+// narrowed down to the samples of a route or a trace.
+func NewMiddleware(handler http.Handler, operation string, opts ...Option) http.Handler {
+	cfg := &config{formatter: defaultSpanName}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	otelOpts := []otelhttp.Option{}
+	for _, f := range cfg.filters {
+		otelOpts = append(otelOpts, otelhttp.WithFilter(f))
+	}
+	if cfg.publicEndpoint {
+		otelOpts = append(otelOpts, otelhttp.WithPublicEndpoint())
+	}
+	if cfg.publicEndpointFn != nil {
+		otelOpts = append(otelOpts, otelhttp.WithPublicEndpointFn(cfg.publicEndpointFn))
+	}
+	if cfg.tracerProvider != nil {
+		otelOpts = append(otelOpts, otelhttp.WithTracerProvider(cfg.tracerProvider))
+	}
+	if cfg.propagators != nil {
+		otelOpts = append(otelOpts, otelhttp.WithPropagators(cfg.propagators))
+	}
+
+	tagger := &routeTagger{next: handler, formatter: cfg.formatter, labels: !cfg.noLabels}
+	return otelhttp.NewHandler(tagger, operation, otelOpts...)
+}
+
+// routeTagger resolves the ServeMux pattern of a request and records it on
+// the active server span and in the pprof labels.
+type routeTagger struct {
+	next      http.Handler
+	formatter SpanNameFormatter
+	labels    bool
+}
+
+func (t *routeTagger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var pattern string
+	if mux, ok := t.next.(*http.ServeMux); ok {
+		// Resolving up front makes the route known for the whole request.
+		_, pattern = mux.Handler(r)
+		if pattern != "" {
+			t.tag(r, pattern)
+		}
+	}
+
+	if t.labels {
+		pprof.Do(r.Context(), profilerLabels(r, pattern), func(ctx context.Context) {
+			r = r.WithContext(ctx)
+			t.next.ServeHTTP(w, r)
+		})
+	} else {
+		t.next.ServeHTTP(w, r)
+	}
+
+	// A mux further down the chain sets r.Pattern while dispatching.
+	if pattern == "" && r.Pattern != "" {
+		t.tag(r, r.Pattern)
+	}
+}
+
+func (t *routeTagger) tag(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(t.formatter(pattern, r))
+	span.SetAttributes(attribute.String("http.route", RouteFromPattern(pattern)))
+}
+
+// profilerLabels returns the pprof labels of a request.
+func profilerLabels(r *http.Request, pattern string) pprof.LabelSet {
+	var labels []string
+	if pattern != "" {
+		labels = append(labels, profiling.LabelRoute, RouteFromPattern(pattern))
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		labels = append(labels, profiling.LabelTraceID, sc.TraceID().String(), profiling.LabelSpanID, sc.SpanID().String())
+	}
+	return pprof.Labels(labels...)
+}
+
+func defaultSpanName(pattern string, r *http.Request) string {
+	if strings.HasPrefix(pattern, "/") {
+		return r.Method + " " + pattern
+	}
+	return pattern
+}
+
+// RouteFromPattern strips the method and host parts of a ServeMux pattern,
+// leaving the path template: "GET example.com/users/{id}" becomes
+// "/users/{id}".
+func RouteFromPattern(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i+1:], " \t")
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	return pattern
+}
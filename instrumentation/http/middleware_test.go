@@ -0,0 +1,162 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func routeAttr(span sdktrace.ReadOnlySpan) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == attribute.Key("http.route") {
+			return attr.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func newTestMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	return mux
+}
+
+func serve(h http.Handler, target string) {
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func TestNewMiddleware(t *testing.T) {
+	t.Run("names spans by ServeMux pattern", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		h := NewMiddleware(newTestMux(), "http-server", WithTracerProvider(tp))
+
+		serve(h, "/users/42")
+		serve(h, "/static/app.js")
+		serve(h, "/missing")
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 3)
+		assert.Equal(t, "GET /users/{id}", spans[0].Name())
+		assert.Equal(t, "/users/{id}", routeAttr(spans[0]))
+		assert.Equal(t, "GET /static/", spans[1].Name())
+		assert.Equal(t, "/static/", routeAttr(spans[1]))
+		assert.Equal(t, "http-server", spans[2].Name())
+		assert.Empty(t, routeAttr(spans[2]))
+	})
+
+	t.Run("resolves patterns of a nested mux", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		wrapped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			newTestMux().ServeHTTP(w, r)
+		})
+		h := NewMiddleware(wrapped, "http-server", WithTracerProvider(tp))
+
+		serve(h, "/users/7")
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "GET /users/{id}", spans[0].Name())
+	})
+
+	t.Run("skips filtered paths", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		h := NewMiddleware(newTestMux(), "http-server", WithTracerProvider(tp), WithFilteredPaths("/healthz", "/debug/apm", "/debug/apm/profiles/", "/users"))
+
+		serve(h, "/healthz")
+		serve(h, "/debug/apm")
+		serve(h, "/debug/apm/profiles/")
+		serve(h, "/debug/apm/profiles/20250101T000000Z_users/cpu")
+		serve(h, "/healthz/live")
+		serve(h, "/users/1")
+
+		var names []string
+		for _, span := range recorder.Ended() {
+			names = append(names, span.Name())
+		}
+		assert.Len(t, names, 2, "only paths ending in a slash cover their subtree")
+		assert.Contains(t, names, "GET /users/{id}")
+	})
+
+	t.Run("uses a custom span name formatter", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		h := NewMiddleware(newTestMux(), "http-server", WithTracerProvider(tp),
+			WithSpanNameFormatter(func(pattern string, r *http.Request) string {
+				return "route:" + RouteFromPattern(pattern)
+			}))
+
+		serve(h, "/users/1")
+
+		require.Len(t, recorder.Ended(), 1)
+		assert.Equal(t, "route:/users/{id}", recorder.Ended()[0].Name())
+	})
+
+	t.Run("links instead of parenting on public endpoints", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		prop := WithPropagators(propagation.TraceContext{})
+		internal := NewMiddleware(newTestMux(), "http-server", WithTracerProvider(tp), prop)
+		public := NewMiddleware(newTestMux(), "http-server", WithTracerProvider(tp), prop, WithPublicEndpoint())
+
+		for _, h := range []http.Handler{internal, public} {
+			req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 2)
+		assert.True(t, spans[0].Parent().IsValid())
+		assert.False(t, spans[1].Parent().IsValid())
+		require.Len(t, spans[1].Links(), 1)
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[1].Links()[0].SpanContext.TraceID().String())
+	})
+
+	t.Run("sets pprof labels for the request", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		labels := map[string]string{}
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+			pprof.ForLabels(r.Context(), func(key, value string) bool {
+				labels[key] = value
+				return true
+			})
+		})
+
+		serve(NewMiddleware(mux, "http-server", WithTracerProvider(tp)), "/users/42")
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, map[string]string{
+			profiling.LabelRoute:   "/users/{id}",
+			profiling.LabelTraceID: spans[0].SpanContext().TraceID().String(),
+			profiling.LabelSpanID:  spans[0].SpanContext().SpanID().String(),
+		}, labels)
+
+		clear(labels)
+		serve(NewMiddleware(mux, "http-server", WithTracerProvider(tp), WithoutProfilerLabels()), "/users/42")
+		assert.Empty(t, labels)
+	})
+}
+
+func TestRouteFromPattern(t *testing.T) {
+	assert.Equal(t, "/users/{id}", RouteFromPattern("GET /users/{id}"))
+	assert.Equal(t, "/users/{id}", RouteFromPattern("GET example.com/users/{id}"))
+	assert.Equal(t, "/static/", RouteFromPattern("/static/"))
+	assert.Equal(t, "/", RouteFromPattern("example.com/"))
+}
@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"runtime"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// maxCallerDepth bounds the stack walk. database/sql and otelsql rarely
+// take more than a dozen frames between the application and the getter.
+const maxCallerDepth = 32
+
+// internalPrefixes are the packages between the application and the
+// attributes getter. Their frames are skipped.
+var internalPrefixes = []string{
+	"database/sql.",
+	"github.com/XSAM/otelsql.",
+	"github.com/fllarpy/apm-probe/instrumentation/sql.",
+	"runtime.",
+}
+
+// callSiteAttributes is an otelsql.AttributesGetter. otelsql calls it
+// synchronously while starting the span, so the application frame is still
+// on the stack.
+func callSiteAttributes(ctx context.Context, method otelsql.Method, query string, args []driver.NamedValue) []attribute.KeyValue {
+	frame, ok := callSite()
+	if !ok {
+		return nil
+	}
+	return []attribute.KeyValue{
+		semconv.CodeFunction(frame.Function),
+		semconv.CodeFilepath(frame.File),
+		semconv.CodeLineNumber(frame.Line),
+	}
+}
+
+// callSite returns the first frame outside database/sql, otelsql and this
+// package.
+func callSite() (runtime.Frame, bool) {
+	var pcs [maxCallerDepth]uintptr
+	// Skip runtime.Callers and callSite itself.
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" && !isInternalFrame(frame.Function) {
+			return frame, true
+		}
+		if !more {
+			return runtime.Frame{}, false
+		}
+	}
+}
+
+func isInternalFrame(function string) bool {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
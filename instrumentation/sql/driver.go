@@ -4,10 +4,50 @@ import (
 	"database/sql"
 
 	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func Open(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := otelsql.Open(driverName, dataSourceName, otelsql.WithAttributes())
+// Option configures Open.
+type Option func(*config)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	callSite       bool
+}
+
+// WithTracerProvider uses tp instead of the global tracer provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithoutCallSite stops recording the application call site of each
+// statement, saving a stack walk per query.
+func WithoutCallSite() Option {
+	return func(c *config) {
+		c.callSite = false
+	}
+}
+
+// Open opens a database whose statements are traced as client spans. Unless
+// disabled with WithoutCallSite, every span carries the code.function,
+// code.filepath and code.lineno of the application code that issued it.
+func Open(driverName, dataSourceName string, opts ...Option) (*sql.DB, error) {
+	cfg := &config{callSite: true}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	otelOpts := []otelsql.Option{otelsql.WithAttributes()}
+	if cfg.tracerProvider != nil {
+		otelOpts = append(otelOpts, otelsql.WithTracerProvider(cfg.tracerProvider))
+	}
+	if cfg.callSite {
+		otelOpts = append(otelOpts, otelsql.WithAttributesGetter(callSiteAttributes))
+	}
+
+	db, err := otelsql.Open(driverName, dataSourceName, otelOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,101 @@
+package sql_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+
+	apmsql "github.com/fllarpy/apm-probe/instrumentation/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// fakeDriver accepts every statement and returns no rows.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error                                    { return nil }
+func (fakeStmt) NumInput() int                                   { return -1 }
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error)  { return fakeRows{}, nil }
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("apm-fake", fakeDriver{})
+}
+
+func loadUsers(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "UPDATE users SET seen = 1")
+	return err
+}
+
+func attr(span sdktrace.ReadOnlySpan, key string) (string, bool) {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+func TestOpen(t *testing.T) {
+	t.Run("records the application call site", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		db, err := apmsql.Open("apm-fake", "", apmsql.WithTracerProvider(tp))
+		require.NoError(t, err)
+		defer db.Close()
+
+		require.NoError(t, loadUsers(context.Background(), db))
+
+		var found bool
+		for _, span := range recorder.Ended() {
+			function, ok := attr(span, string(semconv.CodeFunctionKey))
+			if !ok || !strings.HasSuffix(function, ".loadUsers") {
+				continue
+			}
+			found = true
+			file, _ := attr(span, string(semconv.CodeFilepathKey))
+			assert.True(t, strings.HasSuffix(file, "driver_test.go"), file)
+			line, _ := attr(span, string(semconv.CodeLineNumberKey))
+			assert.NotEqual(t, "0", line)
+		}
+		assert.True(t, found, "a span should point at loadUsers")
+	})
+
+	t.Run("can skip the call site", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		db, err := apmsql.Open("apm-fake", "", apmsql.WithTracerProvider(tp), apmsql.WithoutCallSite())
+		require.NoError(t, err)
+		defer db.Close()
+
+		require.NoError(t, loadUsers(context.Background(), db))
+
+		require.NotEmpty(t, recorder.Ended())
+		for _, span := range recorder.Ended() {
+			_, ok := attr(span, string(semconv.CodeFunctionKey))
+			assert.False(t, ok)
+		}
+	})
+}
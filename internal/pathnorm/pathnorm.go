@@ -0,0 +1,95 @@
+// Package pathnorm turns concrete URL paths into low-cardinality templates
+// by replacing identifier-like segments with a placeholder.
+package pathnorm
+
+import (
+	"strings"
+)
+
+// Placeholder replaces every identifier segment.
+const Placeholder = "{id}"
+
+// Normalize returns path with identifier-like segments replaced by
+// Placeholder: "/users/42/orders/9f1c…" becomes "/users/{id}/orders/{id}".
+// The query string, if any, is dropped.
+func Normalize(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if IsIdentifier(seg) {
+			segments[i] = Placeholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// IsIdentifier reports whether a path segment looks like an ID: a number, a
+// UUID, or a long hexadecimal or mixed alphanumeric token.
+func IsIdentifier(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	if isDigits(seg) || isUUID(seg) {
+		return true
+	}
+	if len(seg) >= 16 && isHex(seg) {
+		return true
+	}
+	// Opaque tokens such as base62 IDs: long and mixing letters and digits.
+	return len(seg) >= 20 && hasDigit(seg) && isAlnum(seg)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i : i+1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasDigit(s string) bool {
+	return strings.ContainsAny(s, "0123456789")
+}
+
+func isAlnum(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package pathnorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"":                       "/",
+		"/":                      "/",
+		"/users":                 "/users",
+		"/users/42":              "/users/{id}",
+		"/users/42/orders/7?x=1": "/users/{id}/orders/{id}",
+		"/items/123e4567-e89b-12d3-a456-426614174000": "/items/{id}",
+		"/blobs/deadbeefdeadbeef":                     "/blobs/{id}",
+		"/v1/api/health":                              "/v1/api/health",
+		"/tokens/AbC123xyZ987qwe456rty":               "/tokens/{id}",
+		"/docs/getting-started":                       "/docs/getting-started",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, Normalize(in), in)
+	}
+}
@@ -0,0 +1,5 @@
+package pathnorm
+
+import "testing"
+
+func TestPlaceholder(t *testing.T) {}
@@ -0,0 +1,120 @@
+package http_reporter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+)
+
+type dependencyGraphResponse struct {
+	Nodes []dependencyNodeResponse `json:"nodes"`
+	Edges []dependencyEdgeResponse `json:"edges"`
+}
+
+type dependencyNodeResponse struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"`
+	System  string          `json:"system,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Address string          `json:"address,omitempty"`
+	Calls   int             `json:"calls"`
+	Errors  int             `json:"errors"`
+	Latency latencyResponse `json:"latency"`
+}
+
+type dependencyEdgeResponse struct {
+	Route      string          `json:"route"`
+	Dependency string          `json:"dependency"`
+	Calls      int             `json:"calls"`
+	Errors     int             `json:"errors"`
+	Latency    latencyResponse `json:"latency"`
+}
+
+func newDependencyGraphResponse(graph inmemory.DependencyGraph) dependencyGraphResponse {
+	resp := dependencyGraphResponse{
+		Nodes: make([]dependencyNodeResponse, 0, len(graph.Nodes)),
+		Edges: make([]dependencyEdgeResponse, 0, len(graph.Edges)),
+	}
+	for _, n := range graph.Nodes {
+		resp.Nodes = append(resp.Nodes, dependencyNodeResponse{
+			ID:      n.Dependency.String(),
+			Kind:    n.Dependency.Kind,
+			System:  n.Dependency.System,
+			Name:    n.Dependency.Name,
+			Address: n.Dependency.Address,
+			Calls:   n.Count,
+			Errors:  n.Errors,
+			Latency: newLatencyResponse(n.Latency),
+		})
+	}
+	for _, e := range graph.Edges {
+		resp.Edges = append(resp.Edges, dependencyEdgeResponse{
+			Route:      e.Route,
+			Dependency: e.Dependency.String(),
+			Calls:      e.Count,
+			Errors:     e.Errors,
+			Latency:    newLatencyResponse(e.Latency),
+		})
+	}
+	return resp
+}
+
+// writeDOT renders the dependency graph in Graphviz DOT: routes on the left,
+// dependencies on the right, edges labelled with call count, p99 latency
+// and errors. Dependencies that no route could be attributed to are still
+// listed as nodes.
+func writeDOT(w http.ResponseWriter, graph inmemory.DependencyGraph) {
+	w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := renderDOT(w, graph); err != nil {
+		logging.Errorf("Reporter: Error writing dependency graph: %v", err)
+	}
+}
+
+func renderDOT(w io.Writer, graph inmemory.DependencyGraph) error {
+	var b strings.Builder
+	b.WriteString("digraph dependencies {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\"];\n")
+
+	routes := make(map[string]bool)
+	for _, e := range graph.Edges {
+		if !routes[e.Route] {
+			routes[e.Route] = true
+			fmt.Fprintf(&b, "  %s [shape=box, label=%s];\n", dotID("route:"+e.Route), strconv.Quote(e.Route))
+		}
+	}
+	for _, n := range graph.Nodes {
+		label := fmt.Sprintf("%s\n%d calls, p99 %.1fms", n.Dependency, n.Count, milliseconds(n.Latency.P99))
+		shape := "ellipse"
+		if n.Dependency.Kind == inmemory.DependencyDatabase {
+			shape = "cylinder"
+		}
+		fmt.Fprintf(&b, "  %s [shape=%s, label=%s];\n", dotID("dep:"+n.Dependency.String()), shape, strconv.Quote(label))
+	}
+	for _, e := range graph.Edges {
+		label := fmt.Sprintf("%d calls, p99 %.1fms", e.Count, milliseconds(e.Latency.P99))
+		attrs := ""
+		if e.Errors > 0 {
+			label += fmt.Sprintf(", %d errors", e.Errors)
+			attrs = ", color=red"
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s%s];\n",
+			dotID("route:"+e.Route), dotID("dep:"+e.Dependency.String()), strconv.Quote(label), attrs)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotID quotes s as a DOT identifier. Routes and dependencies get distinct
+// prefixes so that they never share a node.
+func dotID(s string) string {
+	return strconv.Quote(s)
+}
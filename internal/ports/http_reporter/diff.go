@@ -0,0 +1,157 @@
+package http_reporter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fllarpy/apm-probe/profiling"
+)
+
+// diffPath is the path of the diffs of a capture, /{id}/diff. No profile
+// type has this name.
+const diffPath = "diff"
+
+type diffResponse struct {
+	Route             string                  `json:"route"`
+	Type              string                  `json:"type"`
+	Baseline          string                  `json:"baseline"`
+	BaselineStartedAt time.Time               `json:"baseline_started_at"`
+	SampleType        string                  `json:"sample_type"`
+	Unit              string                  `json:"unit"`
+	Total             int64                   `json:"total"`
+	BaselineTotal     int64                   `json:"baseline_total"`
+	TotalDelta        int64                   `json:"total_delta"`
+	Functions         []functionDeltaResponse `json:"functions"`
+}
+
+type functionDeltaResponse struct {
+	Function     string `json:"function"`
+	Flat         int64  `json:"flat"`
+	FlatDelta    int64  `json:"flat_delta"`
+	Cum          int64  `json:"cum"`
+	CumDelta     int64  `json:"cum_delta"`
+	BaselineFlat int64  `json:"baseline_flat"`
+	BaselineCum  int64  `json:"baseline_cum"`
+}
+
+// serveDiff serves the diffs of entry, optionally only those of one route,
+// as JSON or, with format=text, as a table per diff.
+func (h *ProfilesHandler) serveDiff(w http.ResponseWriter, r *http.Request, entry profiling.IndexEntry) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != formatJSON && format != formatText {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q: expected json or text", format))
+		return
+	}
+	route := query.Get("route")
+	var diffs []profiling.Diff
+	for _, d := range entry.Diffs {
+		if route == "" || d.Route == route {
+			diffs = append(diffs, d)
+		}
+	}
+	if len(diffs) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("profile %q has no diff: its routes had no baseline", entry.ID))
+		return
+	}
+
+	if format == formatText {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for i, d := range diffs {
+			if i > 0 {
+				io.WriteString(w, "\n")
+			}
+			writeDiffText(w, d)
+		}
+		return
+	}
+	resp := make([]diffResponse, 0, len(diffs))
+	for _, d := range diffs {
+		resp = append(resp, newDiffResponse(d))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func newDiffResponse(d profiling.Diff) diffResponse {
+	resp := diffResponse{
+		Route:             d.Route,
+		Type:              string(d.Type),
+		Baseline:          d.Baseline,
+		BaselineStartedAt: d.BaselineStartedAt,
+		SampleType:        d.SampleType,
+		Unit:              d.Unit,
+		Total:             d.Total,
+		BaselineTotal:     d.BaselineTotal,
+		TotalDelta:        d.Total - d.BaselineTotal,
+		Functions:         make([]functionDeltaResponse, 0, len(d.Functions)),
+	}
+	for _, f := range d.Functions {
+		resp.Functions = append(resp.Functions, functionDeltaResponse{
+			Function:     f.Function,
+			Flat:         f.Flat,
+			FlatDelta:    f.FlatDelta(),
+			Cum:          f.Cum,
+			CumDelta:     f.CumDelta(),
+			BaselineFlat: f.BaselineFlat,
+			BaselineCum:  f.BaselineCum,
+		})
+	}
+	return resp
+}
+
+// writeDiffText writes d as a table in the style of pprof -top:
+//
+//	/users/{id} cpu (cpu) vs baseline 20240101T120000.000000000Z_users_id_
+//	total 1.2s, baseline 400ms, +800ms
+//	      flat     flat Δ        cum      cum Δ  function
+//	     600ms     +500ms      900ms     +700ms  main.query
+func writeDiffText(w io.Writer, d profiling.Diff) {
+	fmt.Fprintf(w, "%s %s (%s) vs baseline %s\n", d.Route, d.Type, d.SampleType, d.Baseline)
+	fmt.Fprintf(w, "total %s, baseline %s, %s\n", formatValue(d.Total, d.Unit), formatValue(d.BaselineTotal, d.Unit), formatDelta(d.Total-d.BaselineTotal, d.Unit))
+	fmt.Fprintf(w, "%10s %10s %10s %10s  %s\n", "flat", "flat Δ", "cum", "cum Δ", "function")
+	for _, f := range d.Functions {
+		fmt.Fprintf(w, "%10s %10s %10s %10s  %s\n",
+			formatValue(f.Flat, d.Unit), formatDelta(f.FlatDelta(), d.Unit),
+			formatValue(f.Cum, d.Unit), formatDelta(f.CumDelta(), d.Unit),
+			f.Function)
+	}
+}
+
+// formatValue formats a sample value: durations for nanoseconds, sizes for
+// bytes and plain numbers otherwise.
+func formatValue(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		return time.Duration(v).Round(10 * time.Microsecond).String()
+	case "bytes":
+		return formatBytes(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func formatDelta(v int64, unit string) string {
+	if v > 0 {
+		return "+" + formatValue(v, unit)
+	}
+	return formatValue(v, unit)
+}
+
+func formatBytes(v int64) string {
+	n, sign := v, ""
+	if n < 0 {
+		n, sign = -n, "-"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%s%dB", sign, n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%s%.1f%cB", sign, value, "kMGT"[exp])
+}
@@ -0,0 +1,396 @@
+// Package http_reporter exposes the data collected in an inmemory.Store as a
+// JSON document over HTTP.
+package http_reporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/internal/sqlfingerprint"
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+)
+
+// defaultMaxErrors is the number of recent errors returned when the request
+// does not set the "errors" query parameter.
+const defaultMaxErrors = 50
+
+// Handler serves the metrics report. Supported query parameters:
+//
+//	window  only include events from the last window (Go duration, e.g. 5m)
+//	route   only include the given route
+//	errors  maximum number of recent errors (default 50, 0 for all)
+//	format  json (default) for the full report, or dot for the dependency
+//	        graph in Graphviz DOT
+type Handler struct {
+	store    *inmemory.Store
+	profiler ProfilerStats
+}
+
+// ProfilerStats reports the profiler's self-metrics. It is implemented by
+// profiling.Profiler.
+type ProfilerStats interface {
+	Stats() profiling.Stats
+}
+
+// NewHandler serves the report of store. profiler may be nil, in which case
+// the report has no profiler section.
+func NewHandler(store *inmemory.Store, profiler ProfilerStats) *Handler {
+	return &Handler{store: store, profiler: profiler}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query, err := parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format, err := parseFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format == formatDOT {
+		writeDOT(w, h.store.DependencyGraph(query))
+		return
+	}
+
+	report := h.store.Report(query)
+	resp := newReportResponse(report, query)
+	if h.profiler != nil {
+		resp.Profiler = newProfilerStatsResponse(h.profiler.Stats())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(body); err != nil {
+		logging.Errorf("Reporter: Error encoding response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type reportResponse struct {
+	GeneratedAt  time.Time               `json:"generated_at"`
+	Window       string                  `json:"window,omitempty"`
+	Route        string                  `json:"route,omitempty"`
+	Routes       []routeResponse         `json:"routes"`
+	Database     clientResponse          `json:"database"`
+	HTTPClients  []httpClientResponse    `json:"http_clients"`
+	Dependencies dependencyGraphResponse `json:"dependencies"`
+	Errors       []errorEvent            `json:"errors"`
+	NPlusOne     []nPlusOneResponse      `json:"n_plus_one"`
+	Runtime      runtimeResponse         `json:"runtime"`
+	Retention    retentionResponse       `json:"retention"`
+	Profiler     *profilerStatsResponse  `json:"profiler,omitempty"`
+}
+
+type profilerStatsResponse struct {
+	Captures       int64   `json:"captures"`
+	Windows        int64   `json:"windows"`
+	Baselines      int64   `json:"baselines"`
+	SkippedWindows int64   `json:"skipped_windows"`
+	Failures       int64   `json:"failures"`
+	ProfilingMs    float64 `json:"profiling_ms"`
+	OverheadMs     float64 `json:"overhead_ms"`
+	Bytes          int64   `json:"bytes"`
+	WindowBytes    int64   `json:"window_bytes"`
+}
+
+func newProfilerStatsResponse(s profiling.Stats) *profilerStatsResponse {
+	return &profilerStatsResponse{
+		Captures:       s.Captures,
+		Windows:        s.Windows,
+		Baselines:      s.Baselines,
+		SkippedWindows: s.SkippedWindows,
+		Failures:       s.Failures,
+		ProfilingMs:    milliseconds(s.Profiling),
+		OverheadMs:     milliseconds(s.Overhead),
+		Bytes:          s.Bytes,
+		WindowBytes:    s.WindowBytes,
+	}
+}
+
+type retentionResponse struct {
+	Events   int                     `json:"events"`
+	Bytes    int64                   `json:"bytes"`
+	MaxBytes int64                   `json:"max_bytes,omitempty"`
+	Dropped  map[string]droppedCount `json:"dropped"`
+}
+
+type droppedCount struct {
+	Capacity uint64 `json:"capacity"`
+	Expired  uint64 `json:"expired"`
+	Budget   uint64 `json:"budget"`
+}
+
+type latencyResponse struct {
+	P50Ms float64 `json:"p50_ms"`
+	P90Ms float64 `json:"p90_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+type routeResponse struct {
+	Route         string           `json:"route"`
+	Requests      int              `json:"requests"`
+	Errors        int              `json:"errors"`
+	StatusClasses map[string]int   `json:"status_classes"`
+	Latency       latencyResponse  `json:"latency"`
+	Windows       []windowResponse `json:"windows"`
+}
+
+type windowResponse struct {
+	Window         string          `json:"window"`
+	Requests       int             `json:"requests"`
+	Errors         int             `json:"errors"`
+	RequestsPerSec float64         `json:"requests_per_sec"`
+	ErrorRate      float64         `json:"error_rate"`
+	Latency        latencyResponse `json:"latency"`
+}
+
+type clientResponse struct {
+	Calls   int             `json:"calls"`
+	Errors  int             `json:"errors"`
+	Latency latencyResponse `json:"latency"`
+}
+
+type httpClientResponse struct {
+	Host          string          `json:"host"`
+	Route         string          `json:"route"`
+	Calls         int             `json:"calls"`
+	Errors        int             `json:"errors"`
+	StatusClasses map[string]int  `json:"status_classes"`
+	Latency       latencyResponse `json:"latency"`
+}
+
+type errorEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type nPlusOneResponse struct {
+	Route         string                    `json:"route"`
+	Kind          string                    `json:"kind"`
+	Fingerprint   string                    `json:"fingerprint"`
+	FingerprintID string                    `json:"fingerprint_id"`
+	Statement     string                    `json:"statement"`
+	Occurrences   int                       `json:"occurrences"`
+	FirstSeen     time.Time                 `json:"first_seen"`
+	LastSeen      time.Time                 `json:"last_seen"`
+	MinCount      int                       `json:"min_count"`
+	AvgCount      float64                   `json:"avg_count"`
+	MaxCount      int                       `json:"max_count"`
+	WastedMs      float64                   `json:"wasted_ms"`
+	Exemplars     []nPlusOneFindingResponse `json:"exemplars"`
+}
+
+type nPlusOneFindingResponse struct {
+	TraceID      string            `json:"trace_id"`
+	ParentSpan   string            `json:"parent_span,omitempty"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Count        int               `json:"count"`
+	TotalMs      float64           `json:"total_ms"`
+	AvgMs        float64           `json:"avg_ms"`
+	WastedMs     float64           `json:"wasted_ms"`
+	FirstSeen    time.Time         `json:"first_seen"`
+	LastSeen     time.Time         `json:"last_seen"`
+	CallSite     *callSiteResponse `json:"call_site,omitempty"`
+}
+
+type callSiteResponse struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+type runtimeResponse struct {
+	Latest *runtimeSample  `json:"latest"`
+	Series []runtimeSample `json:"series"`
+}
+
+type runtimeSample struct {
+	Timestamp    time.Time       `json:"timestamp"`
+	Goroutines   uint64          `json:"goroutines"`
+	Threads      uint64          `json:"threads"`
+	Alloc        uint64          `json:"alloc_bytes"`
+	TotalAlloc   uint64          `json:"total_alloc_bytes"`
+	HeapAlloc    uint64          `json:"heap_alloc_bytes"`
+	HeapSys      uint64          `json:"heap_sys_bytes"`
+	HeapGoal     uint64          `json:"heap_goal_bytes"`
+	Mallocs      uint64          `json:"mallocs"`
+	NumGC        uint64          `json:"num_gc"`
+	CgoCalls     uint64          `json:"cgo_calls"`
+	GCPauseCount uint64          `json:"gc_pause_count"`
+	GCPauses     latencyResponse `json:"gc_pauses"`
+	SchedLatency latencyResponse `json:"sched_latency"`
+}
+
+func newReportResponse(report *inmemory.Report, query inmemory.Query) reportResponse {
+	resp := reportResponse{
+		GeneratedAt: report.GeneratedAt,
+		Route:       query.Route,
+		Routes:      make([]routeResponse, 0, len(report.Routes)),
+		Database: clientResponse{
+			Calls:   report.Database.Count,
+			Errors:  report.Database.Errors,
+			Latency: newLatencyResponse(report.Database.Latency),
+		},
+		HTTPClients:  make([]httpClientResponse, 0, len(report.HTTPClients)),
+		Dependencies: newDependencyGraphResponse(report.Dependencies),
+		Errors:       make([]errorEvent, 0, len(report.Errors)),
+		NPlusOne:     make([]nPlusOneResponse, 0, len(report.NPlusOne)),
+		Runtime:      newRuntimeResponse(report.Runtime),
+		Retention: retentionResponse{
+			Events:   report.Retention.Events,
+			Bytes:    report.Retention.Bytes,
+			MaxBytes: report.Retention.MaxBytes,
+			Dropped:  make(map[string]droppedCount, len(report.Retention.Dropped)),
+		},
+	}
+	for name, d := range report.Retention.Dropped {
+		resp.Retention.Dropped[name] = droppedCount(d)
+	}
+	if query.Window > 0 {
+		resp.Window = query.Window.String()
+	}
+	for _, r := range report.Routes {
+		route := routeResponse{
+			Route:         r.Route,
+			Requests:      r.Count,
+			Errors:        r.Errors,
+			StatusClasses: r.StatusClasses,
+			Latency:       newLatencyResponse(r.Latency),
+			Windows:       make([]windowResponse, 0, len(r.Windows)),
+		}
+		for _, w := range r.Windows {
+			route.Windows = append(route.Windows, windowResponse{
+				Window:         w.Window.String(),
+				Requests:       w.Count,
+				Errors:         w.Errors,
+				RequestsPerSec: w.RequestRate,
+				ErrorRate:      w.ErrorRate,
+				Latency:        newLatencyResponse(w.Latency),
+			})
+		}
+		resp.Routes = append(resp.Routes, route)
+	}
+	for _, c := range report.HTTPClients {
+		resp.HTTPClients = append(resp.HTTPClients, httpClientResponse{
+			Host:          c.Host,
+			Route:         c.Route,
+			Calls:         c.Count,
+			Errors:        c.Errors,
+			StatusClasses: c.StatusClasses,
+			Latency:       newLatencyResponse(c.Latency),
+		})
+	}
+	for _, e := range report.Errors {
+		resp.Errors = append(resp.Errors, errorEvent(e))
+	}
+	for _, n := range report.NPlusOne {
+		group := nPlusOneResponse{
+			Route:         n.Path,
+			Kind:          n.Kind,
+			Fingerprint:   n.Fingerprint,
+			FingerprintID: sqlfingerprint.ID(n.Fingerprint),
+			Statement:     n.Statement,
+			Occurrences:   n.Occurrences,
+			FirstSeen:     n.FirstSeen,
+			LastSeen:      n.LastSeen,
+			MinCount:      n.MinCount,
+			AvgCount:      n.AvgCount,
+			MaxCount:      n.MaxCount,
+			WastedMs:      milliseconds(n.WastedDuration),
+			Exemplars:     make([]nPlusOneFindingResponse, 0, len(n.Exemplars)),
+		}
+		for _, f := range n.Exemplars {
+			group.Exemplars = append(group.Exemplars, newNPlusOneFindingResponse(f))
+		}
+		resp.NPlusOne = append(resp.NPlusOne, group)
+	}
+	return resp
+}
+
+func newNPlusOneFindingResponse(f inmemory.NPlusOneFinding) nPlusOneFindingResponse {
+	resp := nPlusOneFindingResponse{
+		TraceID:      f.TraceID,
+		ParentSpan:   f.ParentName,
+		ParentSpanID: f.ParentSpanID,
+		Count:        f.Count,
+		TotalMs:      milliseconds(f.TotalDuration),
+		AvgMs:        milliseconds(f.AvgDuration),
+		WastedMs:     milliseconds(f.WastedDuration),
+		FirstSeen:    f.FirstSeen,
+		LastSeen:     f.LastSeen,
+	}
+	if f.CallSite.Function != "" {
+		resp.CallSite = &callSiteResponse{
+			Function: f.CallSite.Function,
+			File:     f.CallSite.File,
+			Line:     f.CallSite.Line,
+		}
+	}
+	return resp
+}
+
+func newLatencyResponse(l inmemory.LatencySummary) latencyResponse {
+	return latencyResponse{
+		P50Ms: milliseconds(l.P50),
+		P90Ms: milliseconds(l.P90),
+		P99Ms: milliseconds(l.P99),
+		MaxMs: milliseconds(l.Max),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func newRuntimeResponse(series []inmemory.RuntimeSample) runtimeResponse {
+	resp := runtimeResponse{Series: make([]runtimeSample, 0, len(series))}
+	for _, r := range series {
+		resp.Series = append(resp.Series, runtimeSample{
+			Timestamp:    r.Timestamp,
+			Goroutines:   r.Goroutines,
+			Threads:      r.Threads,
+			Alloc:        r.HeapAlloc,
+			TotalAlloc:   r.TotalAlloc,
+			HeapAlloc:    r.HeapAlloc,
+			HeapSys:      r.HeapSys,
+			HeapGoal:     r.HeapGoal,
+			Mallocs:      r.Mallocs,
+			NumGC:        r.GCCycles,
+			CgoCalls:     r.CgoCalls,
+			GCPauseCount: r.GCPauseCount,
+			GCPauses:     newLatencyResponse(r.GCPauses),
+			SchedLatency: newLatencyResponse(r.SchedLatency),
+		})
+	}
+	if len(resp.Series) > 0 {
+		resp.Latest = &resp.Series[len(resp.Series)-1]
+	}
+	return resp
+}
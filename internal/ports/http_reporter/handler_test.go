@@ -0,0 +1,181 @@
+package http_reporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, h http.Handler, target string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec, body
+}
+
+func TestHandler(t *testing.T) {
+	store := inmemory.NewStore()
+	for i := 1; i <= 10; i++ {
+		store.AddRequest("/users", time.Duration(i)*time.Millisecond, 200)
+	}
+	store.AddRequest("/orders", 30*time.Millisecond, 500)
+	store.AddError(inmemory.ErrorEvent{Timestamp: time.Now(), Method: "GET", Path: "/orders", Error: "boom"})
+	store.AddClientRequest(inmemory.ClientCall{Dependency: inmemory.Dependency{Kind: inmemory.DependencyDatabase, System: "sqlite", Name: "main"}, Duration: 2 * time.Millisecond})
+	store.RecordNPlusOne(inmemory.NPlusOneFinding{Path: "/users", Fingerprint: "select name from users where id = ?", Statement: "SELECT name FROM users WHERE id = 1", Count: 5})
+	store.RecordNPlusOne(inmemory.NPlusOneFinding{Path: "/users", Fingerprint: "select name from users where id = ?", Statement: "SELECT name FROM users WHERE id = 7", Count: 8, ParentName: "loadUsers", ParentSpanID: "0102030405060708",
+		TotalDuration: 8 * time.Millisecond, AvgDuration: time.Millisecond, WastedDuration: 7 * time.Millisecond,
+		CallSite: inmemory.CallSite{Function: "main.loadUsers", File: "/app/main.go", Line: 42}})
+	store.UpdateRuntime(inmemory.RuntimeSample{Goroutines: 7, HeapAlloc: 1024})
+
+	h := NewHandler(store, nil)
+
+	t.Run("serves the full report", func(t *testing.T) {
+		rec, body := get(t, h, "/debug/apm")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		routes := body["routes"].([]any)
+		require.Len(t, routes, 2)
+		users := routes[1].(map[string]any)
+		assert.Equal(t, "/users", users["route"])
+		assert.EqualValues(t, 10, users["requests"])
+		assert.EqualValues(t, 10, users["status_classes"].(map[string]any)["2xx"])
+		assert.InEpsilon(t, 5, users["latency"].(map[string]any)["p50_ms"], 0.01)
+		assert.EqualValues(t, 10, users["latency"].(map[string]any)["max_ms"])
+		windows := users["windows"].([]any)
+		require.Len(t, windows, 3)
+		assert.Equal(t, "1m0s", windows[0].(map[string]any)["window"])
+		assert.EqualValues(t, 10, windows[0].(map[string]any)["requests"])
+
+		assert.EqualValues(t, 1, body["database"].(map[string]any)["calls"])
+		assert.Len(t, body["errors"], 1)
+		nPlusOne := body["n_plus_one"].([]any)
+		require.Len(t, nPlusOne, 1)
+		group := nPlusOne[0].(map[string]any)
+		assert.Equal(t, "select name from users where id = ?", group["fingerprint"])
+		assert.Equal(t, "SELECT name FROM users WHERE id = 1", group["statement"])
+		assert.EqualValues(t, 2, group["occurrences"])
+		assert.EqualValues(t, 5, group["min_count"])
+		assert.EqualValues(t, 6.5, group["avg_count"])
+		assert.EqualValues(t, 8, group["max_count"])
+		assert.Len(t, group["fingerprint_id"], 16)
+		exemplars := group["exemplars"].([]any)
+		require.Len(t, exemplars, 2)
+		finding := exemplars[0].(map[string]any)
+		assert.Equal(t, "loadUsers", finding["parent_span"])
+		assert.Equal(t, "0102030405060708", finding["parent_span_id"])
+		assert.EqualValues(t, 7, finding["wasted_ms"])
+		assert.Equal(t, "main.loadUsers", finding["call_site"].(map[string]any)["function"])
+		latest := body["runtime"].(map[string]any)["latest"].(map[string]any)
+		assert.EqualValues(t, 7, latest["goroutines"])
+		assert.EqualValues(t, 1024, latest["alloc_bytes"])
+	})
+
+	t.Run("filters by route", func(t *testing.T) {
+		_, body := get(t, h, "/debug/apm?route=/orders")
+		routes := body["routes"].([]any)
+		require.Len(t, routes, 1)
+		assert.Equal(t, "/orders", routes[0].(map[string]any)["route"])
+		assert.Len(t, body["n_plus_one"], 0)
+	})
+
+	t.Run("filters by window", func(t *testing.T) {
+		time.Sleep(20 * time.Millisecond)
+		store.AddError(inmemory.ErrorEvent{Timestamp: time.Now(), Method: "GET", Path: "/fresh", Error: "late"})
+
+		_, body := get(t, h, "/debug/apm?window=10ms")
+		errs := body["errors"].([]any)
+		require.Len(t, errs, 1)
+		assert.Equal(t, "/fresh", errs[0].(map[string]any)["path"])
+		assert.Equal(t, "10ms", body["window"])
+	})
+
+	t.Run("rejects invalid window", func(t *testing.T) {
+		rec, body := get(t, h, "/debug/apm?window=soon")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, body["error"], "window")
+	})
+
+	t.Run("rejects non-GET methods", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/apm", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+
+	t.Run("reports profiler stats", func(t *testing.T) {
+		_, body := get(t, h, "/debug/apm")
+		assert.NotContains(t, body, "profiler", "no profiler, no section")
+
+		stats := fakeStats{Captures: 2, Windows: 30, Baselines: 3, SkippedWindows: 1, Profiling: 5 * time.Minute, Overhead: 1500 * time.Millisecond, Bytes: 4096, WindowBytes: 2048}
+		_, body = get(t, NewHandler(store, stats), "/debug/apm")
+		profiler := body["profiler"].(map[string]any)
+		assert.EqualValues(t, 2, profiler["captures"])
+		assert.EqualValues(t, 30, profiler["windows"])
+		assert.EqualValues(t, 3, profiler["baselines"])
+		assert.EqualValues(t, 1, profiler["skipped_windows"])
+		assert.EqualValues(t, 300000, profiler["profiling_ms"])
+		assert.EqualValues(t, 1500, profiler["overhead_ms"])
+		assert.EqualValues(t, 4096, profiler["bytes"])
+		assert.EqualValues(t, 2048, profiler["window_bytes"])
+	})
+}
+
+type fakeStats profiling.Stats
+
+func (s fakeStats) Stats() profiling.Stats { return profiling.Stats(s) }
+
+func TestHandler_Dependencies(t *testing.T) {
+	store := inmemory.NewStore()
+	db := inmemory.Dependency{Kind: inmemory.DependencyDatabase, System: "postgresql", Name: "shop", Address: "db:5432"}
+	api := inmemory.Dependency{Kind: inmemory.DependencyHTTP, Address: "api.example.com"}
+	calls := []inmemory.ClientCall{
+		{Dependency: db, Duration: 4 * time.Millisecond},
+		{Dependency: api, Route: "/prices/{id}", Duration: 20 * time.Millisecond, StatusCode: 503, Failed: true},
+	}
+	for _, c := range calls {
+		store.AddClientRequest(c)
+	}
+	store.AddDependencyEdges("/checkout", calls)
+
+	h := NewHandler(store, nil)
+
+	t.Run("serves the graph as JSON", func(t *testing.T) {
+		_, body := get(t, h, "/debug/apm")
+		graph := body["dependencies"].(map[string]any)
+		nodes := graph["nodes"].([]any)
+		require.Len(t, nodes, 2)
+		assert.Equal(t, "http://api.example.com", nodes[0].(map[string]any)["id"])
+		assert.Equal(t, "postgresql://db:5432/shop", nodes[1].(map[string]any)["id"])
+		edges := graph["edges"].([]any)
+		require.Len(t, edges, 2)
+		assert.Equal(t, "/checkout", edges[0].(map[string]any)["route"])
+		assert.EqualValues(t, 1, edges[0].(map[string]any)["errors"])
+	})
+
+	t.Run("serves the graph as DOT", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/apm?format=dot", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/vnd.graphviz; charset=utf-8", rec.Header().Get("Content-Type"))
+		dot := rec.Body.String()
+		assert.Contains(t, dot, "digraph dependencies {")
+		assert.Contains(t, dot, `"route:/checkout" [shape=box, label="/checkout"];`)
+		assert.Contains(t, dot, `"route:/checkout" -> "dep:postgresql://db:5432/shop"`)
+		assert.Contains(t, dot, "1 errors\", color=red]")
+	})
+
+	t.Run("rejects unknown formats", func(t *testing.T) {
+		rec, body := get(t, h, "/debug/apm?format=xml")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, body["error"], "format")
+	})
+}
@@ -0,0 +1,5 @@
+package http_reporter
+
+import "testing"
+
+func TestPlaceholder(t *testing.T) {}
@@ -0,0 +1,259 @@
+package http_reporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/google/pprof/profile"
+)
+
+// ProfileStore lists, serves and deletes captured profiles. It is
+// implemented by profiling.Store.
+type ProfileStore interface {
+	List() []profiling.IndexEntry
+	Get(id string) (profiling.IndexEntry, bool)
+	Open(id string, t profiling.ProfileType) (io.ReadCloser, error)
+	Delete(id string) error
+}
+
+// ContinuousProfiles lists and merges the windows of continuous profiling.
+// It is implemented by profiling.Profiler.
+type ContinuousProfiles interface {
+	Windows() []profiling.IndexEntry
+	Merge(t profiling.ProfileType, since time.Time) (*profile.Profile, int, error)
+}
+
+// ProfilesHandler serves the profiles captured for slow endpoints. It
+// expects the mount prefix to be stripped from the request path:
+//
+//	GET /                    JSON list of captures, newest first
+//	GET /{id}/{type}         one profile of a capture, e.g. /{id}/cpu
+//	GET /{id}/diff           the capture compared to the baselines of its routes
+//	DELETE /{id}             deletes a capture
+//	GET /continuous          JSON list of continuous windows, newest first
+//	GET /continuous/{type}   the windows merged into one profile
+//
+// A CPU profile can be narrowed down to the samples of one route with the
+// route query parameter, e.g. /{id}/cpu?route=/users/{id}. Merged profiles
+// cover the windows of the last window query parameter, e.g.
+// /continuous/cpu?window=1h, or every window kept when it is missing.
+// Diffs are JSON, or a table per diff with format=text, and can be narrowed
+// down to one route with the route query parameter.
+type ProfilesHandler struct {
+	store      ProfileStore
+	continuous ContinuousProfiles
+}
+
+// NewProfilesHandler serves the captures of store. continuous may be nil,
+// in which case the /continuous paths are not found.
+func NewProfilesHandler(store ProfileStore, continuous ContinuousProfiles) *ProfilesHandler {
+	return &ProfilesHandler{store: store, continuous: continuous}
+}
+
+func (h *ProfilesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodDelete:
+		h.delete(w, path)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if path == "" {
+		writeJSON(w, http.StatusOK, newProfileResponses(h.store.List()))
+		return
+	}
+	if path == continuousPath || strings.HasPrefix(path, continuousPath+"/") {
+		h.serveContinuous(w, r, strings.TrimPrefix(strings.TrimPrefix(path, continuousPath), "/"))
+		return
+	}
+
+	id, typ, ok := strings.Cut(path, "/")
+	if !ok {
+		writeError(w, http.StatusNotFound, "expected /{id}/{type}")
+		return
+	}
+	entry, ok := h.store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown profile %q", id))
+		return
+	}
+	if typ == diffPath {
+		h.serveDiff(w, r, entry)
+		return
+	}
+	route := r.URL.Query().Get("route")
+	if route != "" && profiling.ProfileType(typ) != profiling.ProfileCPU {
+		writeError(w, http.StatusBadRequest, "route filtering is only supported for cpu profiles")
+		return
+	}
+	f, err := h.store.Open(id, profiling.ProfileType(typ))
+	if errors.Is(err, profiling.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("profile %q has no %s profile", id, typ))
+		return
+	}
+	if err != nil {
+		logging.Errorf("Reporter: Error opening %s profile %s: %v", typ, id, err)
+		writeError(w, http.StatusInternalServerError, "profile unavailable")
+		return
+	}
+	defer f.Close()
+
+	if route == "" {
+		setAttachment(w, id, typ)
+		if rs, ok := f.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", entry.StartedAt, rs)
+			return
+		}
+		io.Copy(w, f)
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := profiling.FilterByLabel(f, &buf, profiling.LabelRoute, route); err != nil {
+		logging.Errorf("Reporter: Error filtering profile %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "profile unavailable")
+		return
+	}
+	setAttachment(w, id, typ)
+	w.Write(buf.Bytes())
+}
+
+func setAttachment(w http.ResponseWriter, id, typ string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"_"+typ+fileExt(typ)))
+}
+
+// continuousPath prefixes the continuous profiling paths. Capture IDs start
+// with a timestamp, so none is equal to it.
+const continuousPath = "continuous"
+
+func (h *ProfilesHandler) serveContinuous(w http.ResponseWriter, r *http.Request, typ string) {
+	if h.continuous == nil {
+		writeError(w, http.StatusNotFound, "continuous profiling is not available")
+		return
+	}
+	if typ == "" {
+		writeJSON(w, http.StatusOK, newProfileResponses(h.continuous.Windows()))
+		return
+	}
+
+	var since time.Time
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		window, err := time.ParseDuration(raw)
+		if err != nil || window <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid window %q: must be a positive duration", raw))
+			return
+		}
+		since = time.Now().Add(-window)
+	}
+	merged, n, err := h.continuous.Merge(profiling.ProfileType(typ), since)
+	if errors.Is(err, profiling.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no continuous %s profile in the window", typ))
+		return
+	}
+	if err != nil {
+		logging.Errorf("Reporter: Error merging continuous %s profiles: %v", typ, err)
+		writeError(w, http.StatusInternalServerError, "profile unavailable")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := merged.Write(&buf); err != nil {
+		logging.Errorf("Reporter: Error writing merged %s profile: %v", typ, err)
+		writeError(w, http.StatusInternalServerError, "profile unavailable")
+		return
+	}
+	setAttachment(w, continuousPath, typ)
+	w.Header().Set("X-Profile-Windows", strconv.Itoa(n))
+	w.Write(buf.Bytes())
+}
+
+func (h *ProfilesHandler) delete(w http.ResponseWriter, id string) {
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "expected /{id}")
+		return
+	}
+	err := h.store.Delete(id)
+	if errors.Is(err, profiling.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown profile %q", id))
+		return
+	}
+	if err != nil {
+		logging.Errorf("Reporter: Error deleting profile %s: %v", id, err)
+		writeError(w, http.StatusInternalServerError, "profile could not be deleted")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func fileExt(typ string) string {
+	if profiling.ProfileType(typ) == profiling.ProfileTrace {
+		return ".out"
+	}
+	return ".pprof"
+}
+
+type profileResponse struct {
+	ID         string            `json:"id"`
+	StartedAt  time.Time         `json:"started_at"`
+	DurationMs float64           `json:"duration_ms"`
+	Types      []string          `json:"types"`
+	Bytes      int64             `json:"bytes"`
+	Triggers   []triggerResponse `json:"triggers"`
+	// Diffs is the number of diffs served at /{id}/diff.
+	Diffs int `json:"diffs,omitempty"`
+}
+
+type triggerResponse struct {
+	Route     string  `json:"route,omitempty"`
+	TraceID   string  `json:"trace_id,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Policy    string  `json:"policy"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+func newProfileResponses(entries []profiling.IndexEntry) []profileResponse {
+	resp := make([]profileResponse, 0, len(entries))
+	for _, e := range entries {
+		resp = append(resp, newProfileResponse(e))
+	}
+	return resp
+}
+
+func newProfileResponse(e profiling.IndexEntry) profileResponse {
+	resp := profileResponse{
+		ID:         e.ID,
+		StartedAt:  e.StartedAt,
+		DurationMs: milliseconds(e.Duration),
+		Types:      make([]string, 0, len(e.Types)),
+		Bytes:      e.Bytes,
+		Triggers:   make([]triggerResponse, 0, len(e.Triggers)),
+		Diffs:      len(e.Diffs),
+	}
+	for _, t := range e.Types {
+		resp.Types = append(resp.Types, string(t))
+	}
+	for _, t := range e.Triggers {
+		resp.Triggers = append(resp.Triggers, triggerResponse{
+			Route:     t.Route,
+			TraceID:   t.TraceID,
+			LatencyMs: milliseconds(t.Latency),
+			Policy:    t.Policy,
+			Reason:    t.Reason,
+		})
+	}
+	return resp
+}
@@ -0,0 +1,253 @@
+package http_reporter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCPUProfile writes a CPU profile with one sample per route.
+func writeCPUProfile(t *testing.T, w io.Writer, routes ...string) {
+	t.Helper()
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+	for i, route := range routes {
+		fn := &profile.Function{ID: uint64(i + 1), Name: "handler" + route}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1},
+			Label:    map[string][]string{profiling.LabelRoute: {route}},
+		})
+	}
+	require.NoError(t, p.Write(w))
+}
+
+func TestProfilesHandler(t *testing.T) {
+	store, err := profiling.NewLocalStore(profiling.LocalStoreConfig{Root: t.TempDir()})
+	require.NoError(t, err)
+	startedAt := time.Unix(1700000000, 0).UTC()
+	id, err := store.Begin("/users/{id}", startedAt)
+	require.NoError(t, err)
+	cpu, err := store.Create(id, profiling.ProfileCPU)
+	require.NoError(t, err)
+	writeCPUProfile(t, cpu, "/users/{id}", "/orders")
+	require.NoError(t, cpu.Close())
+	require.NoError(t, store.Commit(profiling.IndexEntry{
+		ID:        id,
+		StartedAt: startedAt,
+		Duration:  10 * time.Second,
+		Types:     []profiling.ProfileType{profiling.ProfileCPU},
+		Triggers:  []profiling.Trigger{{Route: "/users/{id}", TraceID: "0af7651916cd43dd8448eb211c80319c", Latency: 750 * time.Millisecond, Policy: profiling.PolicyThreshold, Reason: "latency 750ms exceeds 500ms"}},
+		Diffs: []profiling.Diff{{
+			Route:         "/users/{id}",
+			Type:          profiling.ProfileCPU,
+			Baseline:      "20231114T220000.000000000Z_users_id_",
+			SampleType:    "cpu",
+			Unit:          "nanoseconds",
+			Total:         int64(1200 * time.Millisecond),
+			BaselineTotal: int64(400 * time.Millisecond),
+			Functions: []profiling.FunctionDelta{
+				{Function: "main.query", Flat: int64(600 * time.Millisecond), Cum: int64(900 * time.Millisecond), BaselineFlat: int64(100 * time.Millisecond), BaselineCum: int64(200 * time.Millisecond)},
+			},
+		}},
+	}))
+	h := NewProfilesHandler(store, nil)
+
+	t.Run("lists captures", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body []map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Len(t, body, 1)
+		assert.Equal(t, id, body[0]["id"])
+		assert.Equal(t, []any{"cpu"}, body[0]["types"])
+		assert.EqualValues(t, 10000, body[0]["duration_ms"])
+		assert.Positive(t, body[0]["bytes"])
+		trigger := body[0]["triggers"].([]any)[0].(map[string]any)
+		assert.Equal(t, "/users/{id}", trigger["route"])
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", trigger["trace_id"])
+		assert.EqualValues(t, 750, trigger["latency_ms"])
+		assert.Equal(t, "threshold", trigger["policy"])
+		assert.Equal(t, "latency 750ms exceeds 500ms", trigger["reason"])
+		assert.EqualValues(t, 1, body[0]["diffs"])
+	})
+
+	t.Run("serves diffs as JSON", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+id+"/diff", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body []map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Len(t, body, 1)
+		assert.Equal(t, "/users/{id}", body[0]["route"])
+		assert.Equal(t, "cpu", body[0]["type"])
+		assert.EqualValues(t, 800*time.Millisecond, body[0]["total_delta"])
+		fn := body[0]["functions"].([]any)[0].(map[string]any)
+		assert.Equal(t, "main.query", fn["function"])
+		assert.EqualValues(t, 500*time.Millisecond, fn["flat_delta"])
+		assert.EqualValues(t, 700*time.Millisecond, fn["cum_delta"])
+	})
+
+	t.Run("serves diffs as text", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+id+"/diff?format=text", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Equal(t, `/users/{id} cpu (cpu) vs baseline 20231114T220000.000000000Z_users_id_
+total 1.2s, baseline 400ms, +800ms
+      flat     flat Δ        cum      cum Δ  function
+     600ms     +500ms      900ms     +700ms  main.query
+`, rec.Body.String())
+	})
+
+	t.Run("rejects unknown diffs", func(t *testing.T) {
+		for target, code := range map[string]int{
+			"/" + id + "/diff?route=/orders": http.StatusNotFound,
+			"/" + id + "/diff?format=dot":    http.StatusBadRequest,
+			"/missing/diff":                  http.StatusNotFound,
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, code, rec.Code, target)
+		}
+	})
+
+	t.Run("downloads a profile", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+id+"/cpu", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		p, err := profile.Parse(rec.Body)
+		require.NoError(t, err)
+		assert.Len(t, p.Sample, 2)
+	})
+
+	t.Run("filters a CPU profile by route", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+id+"/cpu?route=/orders", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		p, err := profile.Parse(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, p.Sample, 1)
+		assert.Equal(t, []string{"/orders"}, p.Sample[0].Label[profiling.LabelRoute])
+	})
+
+	t.Run("rejects unknown profiles", func(t *testing.T) {
+		for _, target := range []string{"/missing/cpu", "/" + id + "/heap", "/" + id} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		}
+	})
+
+	t.Run("deletes a capture", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/"+id, nil))
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Empty(t, store.List())
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/"+id, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, "a capture is deleted once")
+	})
+
+	t.Run("has no continuous profiles without a profiler", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/continuous", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("rejects other methods", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, "GET, HEAD, DELETE", rec.Header().Get("Allow"))
+	})
+}
+
+func TestProfilesHandler_Continuous(t *testing.T) {
+	windows, err := profiling.NewLocalStore(profiling.LocalStoreConfig{Root: t.TempDir()})
+	require.NoError(t, err)
+	now := time.Now()
+	for _, startedAt := range []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute), now.Add(-time.Minute)} {
+		id, err := windows.Begin("", startedAt)
+		require.NoError(t, err)
+		cpu, err := windows.Create(id, profiling.ProfileCPU)
+		require.NoError(t, err)
+		writeCPUProfile(t, cpu, "/users/{id}")
+		require.NoError(t, cpu.Close())
+		require.NoError(t, windows.Commit(profiling.IndexEntry{
+			ID:        id,
+			StartedAt: startedAt,
+			Duration:  10 * time.Second,
+			Types:     []profiling.ProfileType{profiling.ProfileCPU},
+			Triggers:  []profiling.Trigger{{Policy: profiling.PolicyContinuous}},
+		}))
+	}
+	h := NewProfilesHandler(windows, fakeContinuous{windows})
+
+	t.Run("lists windows", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/continuous", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body []map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Len(t, body, 3)
+	})
+
+	t.Run("merges the windows", func(t *testing.T) {
+		for target, n := range map[string]int{"/continuous/cpu": 3, "/continuous/cpu?window=1h": 2} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			require.Equal(t, http.StatusOK, rec.Code, target)
+			assert.Equal(t, strconv.Itoa(n), rec.Header().Get("X-Profile-Windows"), target)
+
+			p, err := profile.Parse(rec.Body)
+			require.NoError(t, err)
+			require.Len(t, p.Sample, 1, "samples of the same stack are merged")
+			assert.EqualValues(t, n, p.Sample[0].Value[0], target)
+		}
+	})
+
+	t.Run("rejects bad requests", func(t *testing.T) {
+		for target, code := range map[string]int{
+			"/continuous/heap":           http.StatusNotFound,
+			"/continuous/cpu?window=10s": http.StatusNotFound,
+			"/continuous/cpu?window=-1h": http.StatusBadRequest,
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, code, rec.Code, target)
+		}
+	})
+}
+
+type fakeContinuous struct {
+	store profiling.Store
+}
+
+func (c fakeContinuous) Windows() []profiling.IndexEntry { return c.store.List() }
+
+func (c fakeContinuous) Merge(t profiling.ProfileType, since time.Time) (*profile.Profile, int, error) {
+	return profiling.MergeWindows(c.store, t, since)
+}
@@ -0,0 +1,54 @@
+package http_reporter
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+)
+
+func parseQuery(r *http.Request) (inmemory.Query, error) {
+	values := r.URL.Query()
+	query := inmemory.Query{
+		Route:     values.Get("route"),
+		MaxErrors: defaultMaxErrors,
+	}
+
+	if raw := values.Get("window"); raw != "" {
+		window, err := time.ParseDuration(raw)
+		if err != nil || window <= 0 {
+			return query, fmt.Errorf("invalid window %q: expected a positive duration such as 5m", raw)
+		}
+		query.Window = window
+	}
+
+	if raw := values.Get("errors"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("invalid errors %q: expected a non-negative integer", raw)
+		}
+		query.MaxErrors = n
+	}
+
+	return query, nil
+}
+
+// Output formats of the reporter.
+const (
+	formatJSON = "json"
+	formatDOT  = "dot"
+	formatText = "text"
+)
+
+func parseFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", formatJSON:
+		return formatJSON, nil
+	case formatDOT:
+		return formatDOT, nil
+	default:
+		return "", fmt.Errorf("invalid format %q: expected json or dot", format)
+	}
+}
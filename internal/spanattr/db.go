@@ -0,0 +1,61 @@
+package spanattr
+
+import (
+	"net"
+	"strconv"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	attrDBSystem    = "db.system"
+	attrDBName      = "db.name"
+	attrDBNamespace = "db.namespace"
+	attrDBStatement = "db.statement"
+	attrDBQueryText = "db.query.text"
+)
+
+// Database describes a database client span.
+type Database struct {
+	System    string // db.system, e.g. "postgresql"
+	Name      string // database name
+	Address   string // server address, host[:port]
+	Statement string
+}
+
+// DatabaseCall extracts the system, database name, server address and
+// statement of a database span. ok is false for spans without db.system.
+func DatabaseCall(span sdktrace.ReadOnlySpan) (db Database, ok bool) {
+	var port string
+	for _, attr := range span.Attributes() {
+		switch string(attr.Key) {
+		case attrDBSystem:
+			db.System = attr.Value.AsString()
+			ok = true
+		case attrDBNamespace:
+			db.Name = attr.Value.AsString()
+		case attrDBName:
+			if db.Name == "" {
+				db.Name = attr.Value.AsString()
+			}
+		case attrDBQueryText:
+			db.Statement = attr.Value.AsString()
+		case attrDBStatement:
+			if db.Statement == "" {
+				db.Statement = attr.Value.AsString()
+			}
+		case attrServerAddress:
+			db.Address = attr.Value.AsString()
+		case attrNetPeerName:
+			if db.Address == "" {
+				db.Address = attr.Value.AsString()
+			}
+		case attrServerPort, attrNetPeerPort:
+			port = strconv.FormatInt(attr.Value.AsInt64(), 10)
+		}
+	}
+	if db.Address != "" && port != "" {
+		db.Address = net.JoinHostPort(db.Address, port)
+	}
+	return db, ok
+}
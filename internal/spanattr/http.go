@@ -0,0 +1,211 @@
+// Package spanattr reads the attributes of HTTP and database spans,
+// accepting both the pre-1.21 and the stable semantic conventions.
+package spanattr
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fllarpy/apm-probe/internal/pathnorm"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Attribute keys from both the pre-1.21 and the stable semantic
+// conventions. Instrumentation in the wild emits either set.
+const (
+	attrHTTPRoute          = "http.route"
+	attrHTTPMethod         = "http.method"
+	attrHTTPRequestMethod  = "http.request.method"
+	attrHTTPStatusCode     = "http.status_code"
+	attrHTTPResponseStatus = "http.response.status_code"
+	attrHTTPTarget         = "http.target"
+	attrURLPath            = "url.path"
+	attrHTTPURL            = "http.url"
+	attrURLFull            = "url.full"
+	attrNetPeerName        = "net.peer.name"
+	attrNetPeerPort        = "net.peer.port"
+	attrServerAddress      = "server.address"
+	attrServerPort         = "server.port"
+	attrExceptionMessage   = "exception.message"
+)
+
+// HTTP describes an HTTP span.
+type HTTP struct {
+	Host       string // peer host of client spans
+	Method     string
+	Route      string
+	Path       string // request path without the query
+	StatusCode int
+	Error      string
+}
+
+// Server extracts the method, route template, status code and error
+// message of a server span. The route is taken from http.route, then from a
+// ServeMux-style span name ("GET /users/{id}"), then from the request path
+// with identifier segments replaced by "{id}", so that routers without
+// route templates do not report one route per ID, and finally falls back
+// to the span name.
+func Server(span sdktrace.ReadOnlySpan) HTTP {
+	var info HTTP
+	var path string
+
+	for _, attr := range span.Attributes() {
+		switch string(attr.Key) {
+		case attrHTTPRoute:
+			info.Route = attr.Value.AsString()
+		case attrHTTPRequestMethod:
+			info.Method = attr.Value.AsString()
+		case attrHTTPMethod:
+			if info.Method == "" {
+				info.Method = attr.Value.AsString()
+			}
+		case attrHTTPResponseStatus:
+			info.StatusCode = int(attr.Value.AsInt64())
+		case attrHTTPStatusCode:
+			if info.StatusCode == 0 {
+				info.StatusCode = int(attr.Value.AsInt64())
+			}
+		case attrURLPath:
+			path = attr.Value.AsString()
+		case attrHTTPTarget:
+			if path == "" {
+				path = attr.Value.AsString()
+			}
+		case attrExceptionMessage:
+			info.Error = attr.Value.AsString()
+		}
+	}
+
+	if info.Route == "" {
+		if method, route, ok := parseMuxPattern(span.Name()); ok {
+			info.Route = route
+			if info.Method == "" {
+				info.Method = method
+			}
+		}
+	}
+	info.Path, _, _ = strings.Cut(path, "?")
+	if info.Route == "" && info.Path != "" {
+		info.Route = pathnorm.Normalize(info.Path)
+	}
+	if info.Route == "" {
+		info.Route = span.Name()
+	}
+
+	if info.Error == "" {
+		info.Error = ExceptionMessage(span)
+	}
+	if info.Error == "" {
+		info.Error = span.Status().Description
+	}
+	return info
+}
+
+// Client extracts the peer host, route, method and status code of an
+// HTTP client span. ok is false for client spans that are not HTTP calls.
+// The host comes from server.address (or net.peer.name) and the URL, the
+// route from http.route if the caller set one, otherwise from the URL path
+// with identifier segments replaced by "{id}".
+func Client(span sdktrace.ReadOnlySpan) (info HTTP, ok bool) {
+	var rawURL, port string
+
+	for _, attr := range span.Attributes() {
+		switch string(attr.Key) {
+		case attrHTTPRoute:
+			info.Route = attr.Value.AsString()
+		case attrHTTPRequestMethod:
+			info.Method = attr.Value.AsString()
+		case attrHTTPMethod:
+			if info.Method == "" {
+				info.Method = attr.Value.AsString()
+			}
+		case attrHTTPResponseStatus:
+			info.StatusCode = int(attr.Value.AsInt64())
+		case attrHTTPStatusCode:
+			if info.StatusCode == 0 {
+				info.StatusCode = int(attr.Value.AsInt64())
+			}
+		case attrURLFull:
+			rawURL = attr.Value.AsString()
+		case attrHTTPURL:
+			if rawURL == "" {
+				rawURL = attr.Value.AsString()
+			}
+		case attrServerAddress:
+			info.Host = attr.Value.AsString()
+		case attrNetPeerName:
+			if info.Host == "" {
+				info.Host = attr.Value.AsString()
+			}
+		case attrServerPort, attrNetPeerPort:
+			port = strconv.FormatInt(attr.Value.AsInt64(), 10)
+		}
+	}
+	if info.Method == "" && rawURL == "" {
+		return info, false
+	}
+
+	if u, err := url.Parse(rawURL); err == nil {
+		info.Path = u.Path
+		if info.Host == "" {
+			info.Host = u.Host
+			port = ""
+		}
+	}
+	if port != "" && port != "80" && port != "443" {
+		info.Host = net.JoinHostPort(info.Host, port)
+	}
+	if info.Host == "" {
+		info.Host = "unknown"
+	}
+	if info.Route == "" {
+		info.Route = pathnorm.Normalize(info.Path)
+	}
+
+	info.Error = ExceptionMessage(span)
+	if info.Error == "" {
+		info.Error = span.Status().Description
+	}
+	return info, true
+}
+
+// parseMuxPattern recognizes span names shaped like http.ServeMux patterns:
+// "/path" or "METHOD /path". Patterns with a host part are not recognized.
+func parseMuxPattern(name string) (method, route string, ok bool) {
+	if strings.HasPrefix(name, "/") {
+		return "", name, true
+	}
+	method, route, found := strings.Cut(name, " ")
+	if !found || !strings.HasPrefix(route, "/") || !isHTTPMethod(method) {
+		return "", "", false
+	}
+	return method, route, true
+}
+
+func isHTTPMethod(s string) bool {
+	switch s {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// ExceptionMessage returns the message of the last recorded exception event.
+func ExceptionMessage(span sdktrace.ReadOnlySpan) string {
+	var msg string
+	for _, event := range span.Events() {
+		if event.Name != "exception" {
+			continue
+		}
+		for _, attr := range event.Attributes {
+			if string(attr.Key) == attrExceptionMessage {
+				msg = attr.Value.AsString()
+			}
+		}
+	}
+	return msg
+}
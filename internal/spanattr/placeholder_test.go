@@ -0,0 +1,5 @@
+package spanattr
+
+import "testing"
+
+func TestPlaceholder(t *testing.T) {}
@@ -0,0 +1,361 @@
+// Package sqlfingerprint reduces SQL statements to a normalized form so that
+// statements differing only in literal values group together.
+//
+// It understands the lexical conventions of SQLite, PostgreSQL and MySQL:
+// '?', '$1', ':name' and '@name' placeholders, single-quoted strings with
+// doubled-quote and backslash escapes, PostgreSQL dollar-quoted strings,
+// and double-quoted or backquoted identifiers. Double-quoted text is always
+// treated as an identifier, even though MySQL may use it for strings.
+package sqlfingerprint
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Fingerprint normalizes query: comments are removed, literals and
+// placeholders become '?', IN lists collapse to a single '?', unquoted
+// words are lowercased, whitespace is collapsed and a trailing semicolon is
+// dropped.
+//
+//	SELECT * FROM users WHERE id IN (1, 2, 3) AND name = 'bob'
+//	select * from users where id in (?) and name = ?
+func Fingerprint(query string) string {
+	tokens := collapseInLists(tokenize(query))
+
+	var b strings.Builder
+	b.Grow(len(query))
+	for i, tok := range tokens {
+		if i > 0 && needsSpace(tokens[i-1], tok) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(tok.text)
+	}
+	return b.String()
+}
+
+// ID returns a short, stable identifier of a fingerprint, suitable for
+// URLs and configuration.
+func ID(fingerprint string) string {
+	h := fnv.New64a()
+	h.Write([]byte(fingerprint))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenValue
+	tokenQuoted
+	tokenPunct
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var valueToken = token{tokenValue, "?"}
+
+func tokenize(q string) []token {
+	var tokens []token
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case isSpace(c):
+			i++
+
+		case c == '-' && strings.HasPrefix(q[i:], "--"), c == '#':
+			// Line comment; MySQL also accepts '#'.
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 1
+
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+
+		case c == '\'':
+			i = skipString(q, i)
+			tokens = append(tokens, valueToken)
+
+		case c == '"' || c == '`':
+			end := skipQuoted(q, i, c)
+			tokens = append(tokens, token{tokenQuoted, q[i:end]})
+			i = end
+
+		case c == '$':
+			if end, ok := dollarQuote(q, i); ok {
+				tokens = append(tokens, valueToken)
+				i = end
+			} else {
+				// $1 placeholder or a stray dollar.
+				i++
+				for i < len(q) && isDigit(q[i]) {
+					i++
+				}
+				tokens = append(tokens, valueToken)
+			}
+
+		case c == '?':
+			i++
+			tokens = append(tokens, valueToken)
+
+		case (c == ':' || c == '@') && i+1 < len(q) && isWordStart(q[i+1]) && !(c == ':' && i > 0 && q[i-1] == ':'):
+			// Named placeholder (:name, @name), but not a '::' cast.
+			i++
+			for i < len(q) && isWordPart(q[i]) {
+				i++
+			}
+			tokens = append(tokens, valueToken)
+
+		case isDigit(c), c == '.' && i+1 < len(q) && isDigit(q[i+1]) && !afterWord(tokens):
+			i = skipNumber(q, i)
+			tokens = append(tokens, valueToken)
+
+		case (c == '-' || c == '+') && i+1 < len(q) && (isDigit(q[i+1]) || q[i+1] == '.') && expectsOperand(tokens):
+			// Signed number literal.
+			i = skipNumber(q, i+1)
+			tokens = append(tokens, valueToken)
+
+		case isWordStart(c):
+			start := i
+			for i < len(q) && isWordPart(q[i]) {
+				i++
+			}
+			word := q[start:i]
+			if i < len(q) && q[i] == '\'' && isStringPrefix(word) {
+				// E'…', N'…', X'…', B'…' literals.
+				i = skipString(q, i)
+				tokens = append(tokens, valueToken)
+				continue
+			}
+			lower := strings.ToLower(word)
+			if lower == "true" || lower == "false" {
+				tokens = append(tokens, valueToken)
+				continue
+			}
+			tokens = append(tokens, token{tokenWord, lower})
+
+		case c == '(' || c == ')' || c == ',' || c == '.' || c == ';':
+			i++
+			tokens = append(tokens, token{tokenPunct, string(c)})
+
+		default:
+			op := operatorAt(q[i:])
+			i += len(op)
+			tokens = append(tokens, token{tokenOperator, op})
+		}
+	}
+
+	// A trailing semicolon does not change the statement.
+	for len(tokens) > 0 && tokens[len(tokens)-1].text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// collapseInLists rewrites "in (?, ?, …)" to "in (?)".
+func collapseInLists(tokens []token) []token {
+	out := tokens[:0]
+	for i := 0; i < len(tokens); i++ {
+		out = append(out, tokens[i])
+		if tokens[i].kind != tokenWord || tokens[i].text != "in" || i+1 >= len(tokens) || tokens[i+1].text != "(" {
+			continue
+		}
+		j := i + 2
+		for j < len(tokens) && (tokens[j].kind == tokenValue || tokens[j].text == ",") {
+			j++
+		}
+		if j > i+2 && j < len(tokens) && tokens[j].text == ")" {
+			out = append(out, tokens[i+1], valueToken, tokens[j])
+			i = j
+		}
+	}
+	return out
+}
+
+func needsSpace(prev, next token) bool {
+	switch {
+	case prev.text == "(" || prev.text == ".":
+		return false
+	case next.text == ")" || next.text == "," || next.text == "." || next.text == ";":
+		return false
+	case next.text == "(" && prev.kind == tokenWord && !isKeywordBeforeParen(prev.text):
+		// Function calls: count(*), lower(name).
+		return false
+	}
+	return true
+}
+
+// isKeywordBeforeParen lists keywords that are followed by a parenthesized
+// expression rather than being a function name.
+func isKeywordBeforeParen(word string) bool {
+	switch word {
+	case "in", "values", "from", "join", "exists", "as", "on", "and", "or", "not", "where", "select", "into", "using", "when", "then", "else", "over", "all", "any", "some", "lateral":
+		return true
+	}
+	return false
+}
+
+func skipString(q string, i int) int {
+	i++ // opening quote
+	for i < len(q) {
+		switch q[i] {
+		case '\\':
+			i += 2
+			continue
+		case '\'':
+			if i+1 < len(q) && q[i+1] == '\'' {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(q)
+}
+
+func skipQuoted(q string, i int, quote byte) int {
+	i++
+	for i < len(q) {
+		if q[i] == quote {
+			if i+1 < len(q) && q[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(q)
+}
+
+// dollarQuote recognizes a PostgreSQL dollar-quoted string ($$…$$ or
+// $tag$…$tag$) starting at i and returns the index after it.
+func dollarQuote(q string, i int) (int, bool) {
+	if i+1 < len(q) && isDigit(q[i+1]) {
+		return 0, false
+	}
+	j := i + 1
+	for j < len(q) && q[j] != '$' {
+		if !isWordPart(q[j]) {
+			return 0, false
+		}
+		j++
+	}
+	if j >= len(q) {
+		return 0, false
+	}
+	tag := q[i : j+1]
+	end := strings.Index(q[j+1:], tag)
+	if end < 0 {
+		return len(q), true
+	}
+	return j + 1 + end + len(tag), true
+}
+
+func skipNumber(q string, i int) int {
+	if strings.HasPrefix(q[i:], "0x") || strings.HasPrefix(q[i:], "0X") {
+		i += 2
+		for i < len(q) && isHexDigit(q[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(q) && (isDigit(q[i]) || q[i] == '.') {
+		i++
+	}
+	if i < len(q) && (q[i] == 'e' || q[i] == 'E') {
+		j := i + 1
+		if j < len(q) && (q[j] == '+' || q[j] == '-') {
+			j++
+		}
+		if j < len(q) && isDigit(q[j]) {
+			i = j
+			for i < len(q) && isDigit(q[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// expectsOperand reports whether a sign at this position starts a number
+// rather than being a binary operator.
+func expectsOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1]
+	switch last.kind {
+	case tokenOperator:
+		return true
+	case tokenPunct:
+		return last.text != ")"
+	case tokenWord:
+		return isKeywordBeforeParen(last.text) || last.text == "by" || last.text == "limit" || last.text == "offset" ||
+			last.text == "between" || last.text == "like" || last.text == "is" || last.text == "set" || last.text == "return"
+	}
+	return false
+}
+
+func afterWord(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	kind := tokens[len(tokens)-1].kind
+	return kind == tokenWord || kind == tokenQuoted
+}
+
+func isStringPrefix(word string) bool {
+	switch strings.ToLower(word) {
+	case "e", "n", "x", "b":
+		return true
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isWordStart accepts any non-ASCII byte so that identifiers in other
+// scripts stay whole.
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= utf8.RuneSelf
+}
+
+func isWordPart(c byte) bool {
+	return isWordStart(c) || isDigit(c) || c == '$'
+}
+
+// operators lists the multi-character operators, longest first.
+var operators = []string{"->>", "<=>", "<>", "<=", ">=", "!=", "==", "||", "&&", "::", ":=", "->", "<<", ">>", "~*", "!~", "@>", "<@"}
+
+// operatorAt returns the operator at the start of s, or its first byte.
+func operatorAt(s string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return s[:1]
+}
@@ -0,0 +1,45 @@
+package sqlfingerprint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"sqlite placeholder", "SELECT * FROM users WHERE id = ?", "select * from users where id = ?"},
+		{"postgres placeholders", "SELECT name FROM users WHERE id = $1 AND org = $2", "select name from users where id = ? and org = ?"},
+		{"named placeholders", "UPDATE t SET a = :a WHERE b = @b", "update t set a = ? where b = ?"},
+		{"inlined numbers", "select * from users where id=42", "select * from users where id = ?"},
+		{"negative and decimal numbers", "SELECT 1 WHERE x > -1.5e3 AND y < .5", "select ? where x > ? and y < ?"},
+		{"strings with escapes", `SELECT * FROM t WHERE a = 'it''s' AND b = 'x\'y' AND c = E'\n'`, "select * from t where a = ? and b = ? and c = ?"},
+		{"dollar quoted", "SELECT $$some text$$, $tag$more$tag$", "select ?, ?"},
+		{"booleans", "SELECT * FROM t WHERE active = TRUE", "select * from t where active = ?"},
+		{"in lists of any length", "SELECT * FROM t WHERE id IN (1, 2, 3) OR id in (?)", "select * from t where id in (?) or id in (?)"},
+		{"in subquery kept", "SELECT * FROM t WHERE id IN (SELECT id FROM u WHERE x = 1)", "select * from t where id in (select id from u where x = ?)"},
+		{"comments and whitespace", "SELECT /* hint */ a,\n\t b -- trailing\nFROM   t;", "select a, b from t"},
+		{"quoted identifiers keep case", "SELECT \"UserName\" FROM `Users`", "select \"UserName\" from `Users`"},
+		{"function calls", "SELECT COUNT(*), lower( name ) FROM t", "select count(*), lower(name) from t"},
+		{"casts and qualified names", "SELECT u.id::text FROM public.users u", "select u.id :: text from public.users u"},
+		{"identifiers with digits", "SELECT col1 FROM t2 WHERE x=1-2", "select col1 from t2 where x = ? - ?"},
+		{"insert values", "INSERT INTO t (a, b) VALUES (1, 'x')", "insert into t(a, b) values (?, ?)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Fingerprint(tt.query))
+		})
+	}
+
+	t.Run("groups equivalent statements", func(t *testing.T) {
+		a := Fingerprint("SELECT * FROM orders WHERE user_id = 1")
+		b := Fingerprint("select *\nfrom orders\nwhere user_id = 2;")
+		assert.Equal(t, a, b)
+		assert.Equal(t, ID(a), ID(b))
+		assert.Len(t, ID(a), 16)
+	})
+}
@@ -0,0 +1,5 @@
+package sqlfingerprint
+
+import "testing"
+
+func TestPlaceholder(t *testing.T) {}
@@ -0,0 +1,54 @@
+package nplusone
+
+import (
+	"strings"
+
+	"github.com/fllarpy/apm-probe/internal/sqlfingerprint"
+)
+
+// AllowMarker silences the N+1 detector for a statement that contains it,
+// typically in a comment: SELECT … /* apm:allow-nplusone */.
+const AllowMarker = "apm:allow-nplusone"
+
+// Allowlist names intentional loops that must not be reported.
+type Allowlist struct {
+	// Routes are matched exactly against the route of the finding.
+	Routes []string
+	// Fingerprints are SQL statements, in any form that normalizes to the
+	// fingerprint of the finding, or fingerprint IDs as shown by the
+	// reporter.
+	Fingerprints []string
+}
+
+// allowSet is the compiled form of an Allowlist.
+type allowSet struct {
+	routes       map[string]bool
+	fingerprints map[string]bool
+}
+
+func newAllowSet(a Allowlist) allowSet {
+	set := allowSet{
+		routes:       make(map[string]bool, len(a.Routes)),
+		fingerprints: make(map[string]bool, 2*len(a.Fingerprints)),
+	}
+	for _, r := range a.Routes {
+		set.routes[r] = true
+	}
+	for _, f := range a.Fingerprints {
+		set.fingerprints[f] = true
+		set.fingerprints[sqlfingerprint.Fingerprint(f)] = true
+	}
+	return set
+}
+
+func (s allowSet) allowsRoute(route string) bool {
+	return s.routes[route]
+}
+
+func (s allowSet) allowsFingerprint(fingerprint string) bool {
+	return s.fingerprints[fingerprint] || s.fingerprints[sqlfingerprint.ID(fingerprint)]
+}
+
+func hasAllowMarker(statement string) bool {
+	return strings.Contains(statement, AllowMarker)
+}
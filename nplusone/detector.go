@@ -1,10 +1,14 @@
 package nplusone
 
 import (
-	"log"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/fllarpy/apm-probe/internal/logging"
 	"github.com/fllarpy/apm-probe/storage/inmemory"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
@@ -12,113 +16,509 @@ import (
 )
 
 type Config struct {
-	Enabled   bool
+	Enabled bool
+	// Threshold is the number of calls with the same key under one parent
+	// span that count as N+1.
 	Threshold int
+	// Thresholds overrides Threshold per extractor name.
+	Thresholds map[string]int
+	// Extractors map client spans to keys. Nil means DefaultExtractors.
+	Extractors []KeyExtractor
+	// Sequential only counts repeats that run back to back under the
+	// parent: another call in between starts the count afresh.
+	Sequential bool
+	// MaxGap, when Sequential is set, also starts the count afresh when a
+	// call begins more than MaxGap after the previous one ended. Zero
+	// means no limit.
+	MaxGap time.Duration
+	// Allow suppresses findings for intentional loops. Statements that
+	// contain AllowMarker are always ignored.
+	Allow Allowlist
+	// TraceTTL is how long a trace is kept after its latest span when its
+	// local root never arrives. Zero means DefaultTraceTTL.
+	TraceTTL time.Duration
+	// SweepInterval is how often such traces are looked for. Zero means
+	// DefaultSweepInterval.
+	SweepInterval time.Duration
+	// MaxTraces caps the traces tracked at once; the least recently updated
+	// one is flushed to make room. Zero means unlimited.
+	MaxTraces int
 }
 
+const (
+	DefaultTraceTTL      = 2 * time.Minute
+	DefaultSweepInterval = 1 * time.Minute
+)
+
+// DefaultConfig returns the detector settings used when none are supplied.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:       true,
+		Threshold:     5,
+		TraceTTL:      DefaultTraceTTL,
+		SweepInterval: DefaultSweepInterval,
+		MaxTraces:     10000,
+	}
+}
+
+// Validate reports whether the configuration can be used to build a detector.
+// A disabled configuration is always valid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Threshold < 2 {
+		return errors.New("threshold must be at least 2")
+	}
+	for name, threshold := range c.Thresholds {
+		if threshold < 2 {
+			return fmt.Errorf("threshold for %s must be at least 2", name)
+		}
+	}
+	if c.MaxGap < 0 {
+		return errors.New("max gap must not be negative")
+	}
+	if c.TraceTTL < 0 {
+		return errors.New("trace TTL must not be negative")
+	}
+	if c.SweepInterval < 0 {
+		return errors.New("sweep interval must not be negative")
+	}
+	if c.MaxTraces < 0 {
+		return errors.New("max traces must not be negative")
+	}
+	return nil
+}
+
+func (c Config) traceTTL() time.Duration {
+	if c.TraceTTL == 0 {
+		return DefaultTraceTTL
+	}
+	return c.TraceTTL
+}
+
+func (c Config) sweepInterval() time.Duration {
+	if c.SweepInterval == 0 {
+		return DefaultSweepInterval
+	}
+	return c.SweepInterval
+}
+
+// queryInfo counts the calls with one key under one parent span.
 type queryInfo struct {
+	extractor string
+	allowed   bool // a sample carried AllowMarker
 	count     int
-	reported  bool
-	statement string
+	run       int // current run of back-to-back executions
+	maxRun    int
+	detected  bool
+	statement string // first raw sample seen
+	callSite  inmemory.CallSite
+
+	total     time.Duration
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// parentScope holds the calls made directly under one span.
+type parentScope struct {
+	name            string                // known once the parent span itself ends
+	queries         map[string]*queryInfo // by extractor and fingerprint
+	lastFingerprint string
+	lastEnd         time.Time
 }
 
 type traceData struct {
-	queries  map[string]*queryInfo
-	rootPath string
-	lastSeen time.Time
+	id      trace.TraceID
+	parents map[trace.SpanID]*parentScope
+	// localParents maps the spans that ended to their parent, for those
+	// whose parent is in this process, so that each scope can be traced
+	// back to its local root.
+	localParents map[trace.SpanID]trace.SpanID
+	lastSeen     time.Time
+}
+
+// detach removes and returns the scopes of root and of the spans under it.
+// The scopes of other local roots of the trace, e.g. of an outer server
+// span when root handles a request the process made to itself, are kept.
+func (td *traceData) detach(root trace.SpanID) map[trace.SpanID]*parentScope {
+	scopes := make(map[trace.SpanID]*parentScope)
+	for id, scope := range td.parents {
+		if td.under(id, root) {
+			scopes[id] = scope
+			delete(td.parents, id)
+		}
+	}
+	for id := range td.localParents {
+		if td.under(id, root) {
+			delete(td.localParents, id)
+		}
+	}
+	return scopes
+}
+
+// under reports whether span is root or one of its descendants.
+func (td *traceData) under(span, root trace.SpanID) bool {
+	// Bound the walk in case of a cycle in malformed parent links.
+	for range len(td.localParents) + 1 {
+		if span == root {
+			return true
+		}
+		parent, ok := td.localParents[span]
+		if !ok {
+			return false
+		}
+		span = parent
+	}
+	return false
 }
 
 type Detector struct {
 	config     Config
+	allow      allowSet
 	store      *inmemory.Store
-	traces     map[string]*traceData
+	traces     map[trace.TraceID]*list.Element
+	order      *list.List // of *traceData, least recently updated first
+	ticker     *time.Ticker
 	tracesLock sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// NewDetector starts a detector. Call Close to stop its cleanup goroutine.
 func NewDetector(config Config, store *inmemory.Store) *Detector {
+	return NewDetectorContext(context.Background(), config, store)
+}
+
+// NewDetectorContext starts a detector whose cleanup goroutine also stops
+// when ctx is done.
+func NewDetectorContext(ctx context.Context, config Config, store *inmemory.Store) *Detector {
 	if !config.Enabled {
 		return nil
 	}
-	log.Println("Initializing N+1 query detector.")
+	logging.Infof("Initializing N+1 query detector.")
 	d := &Detector{
 		config: config,
+		allow:  newAllowSet(config.Allow),
 		store:  store,
-		traces: make(map[string]*traceData),
+		traces: make(map[trace.TraceID]*list.Element),
+		order:  list.New(),
+		ticker: time.NewTicker(config.sweepInterval()),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
 	}
-	go d.startCleanupRoutine()
+	go d.run(ctx)
 	return d
 }
 
+// Close stops the cleanup goroutine, waits for it to exit and records the
+// findings of the traces still pending. It is safe to call Close more than
+// once.
+func (d *Detector) Close() {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+
+	d.tracesLock.Lock()
+	defer d.tracesLock.Unlock()
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		d.remove(el)
+	}
+}
+
+// UpdateConfig replaces the detector settings. Setting Enabled to false
+// pauses detection without discarding the traces collected so far.
+func (d *Detector) UpdateConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	allow := newAllowSet(config.Allow)
+	d.tracesLock.Lock()
+	defer d.tracesLock.Unlock()
+	if config.sweepInterval() != d.config.sweepInterval() {
+		d.ticker.Reset(config.sweepInterval())
+	}
+	d.config = config
+	d.allow = allow
+	d.evictOverflow()
+	return nil
+}
+
+// Config returns the settings currently in effect.
+func (d *Detector) Config() Config {
+	d.tracesLock.Lock()
+	defer d.tracesLock.Unlock()
+	return d.config
+}
+
+// ProcessSpan counts the client calls of each parent span by key. Spans end
+// before their parent, so findings are held until the local root span they
+// fall under ends; they are then recorded with the name of their parent span
+// and the route of that root. A trace can have several local roots, e.g.
+// when the process calls itself, and each flushes only its own findings.
 func (d *Detector) ProcessSpan(span sdktrace.ReadOnlySpan) {
-	traceID := span.SpanContext().TraceID().String()
+	traceID := span.SpanContext().TraceID()
 
 	d.tracesLock.Lock()
 	defer d.tracesLock.Unlock()
 
-	if _, ok := d.traces[traceID]; !ok {
-		d.traces[traceID] = &traceData{
-			queries:  make(map[string]*queryInfo),
-			lastSeen: time.Now(),
+	if !d.config.Enabled {
+		return
+	}
+
+	var td *traceData
+	if el, ok := d.traces[traceID]; ok {
+		td = el.Value.(*traceData)
+		d.order.MoveToBack(el)
+	} else {
+		td = &traceData{
+			id:           traceID,
+			parents:      make(map[trace.SpanID]*parentScope),
+			localParents: make(map[trace.SpanID]trace.SpanID),
 		}
+		d.traces[traceID] = d.order.PushBack(td)
+		d.evictOverflow()
 	}
-	td := d.traces[traceID]
 	td.lastSeen = time.Now()
 
-	if span.SpanKind() == trace.SpanKindServer {
-		td.rootPath = span.Name()
+	spanID := span.SpanContext().SpanID()
+	if scope, ok := td.parents[spanID]; ok {
+		scope.name = span.Name()
+	}
+	if !isLocalRoot(span) {
+		td.localParents[spanID] = span.Parent().SpanID()
+	}
+
+	extractor, key, isCall := d.extract(span)
+	if isCall && span.Parent().IsValid() {
+		d.countCall(td, span, extractor, key)
+	}
+
+	// A call whose parent is remote leaves nothing local to wait for; its
+	// trace is flushed by the cleanup routine.
+	if isLocalRoot(span) && !isCall {
+		d.flush(traceID, td.detach(spanID), routeOf(span))
+		if len(td.parents) == 0 && len(td.localParents) == 0 {
+			d.order.Remove(d.traces[traceID])
+			delete(d.traces, traceID)
+		}
+	}
+}
+
+// remove records the findings of a trace whose local root never arrived,
+// without a route, and forgets it. The caller must hold tracesLock.
+func (d *Detector) remove(el *list.Element) {
+	td := d.order.Remove(el).(*traceData)
+	delete(d.traces, td.id)
+	d.flush(td.id, td.parents, "")
+}
+
+// evictOverflow removes the least recently updated traces beyond MaxTraces.
+// The caller must hold tracesLock.
+func (d *Detector) evictOverflow() {
+	if d.config.MaxTraces <= 0 {
 		return
 	}
+	evicted := 0
+	for d.order.Len() > d.config.MaxTraces {
+		d.remove(d.order.Front())
+		evicted++
+	}
+	if evicted > 0 {
+		logging.Debugf("N+1 Detector: Evicted %d traces over the limit of %d.", evicted, d.config.MaxTraces)
+	}
+}
 
-	var isDbCall bool
-	var statement string
-	for _, attr := range span.Attributes() {
-		if attr.Key == semconv.DBSystemKey {
-			isDbCall = true
+// extract returns the first extractor that accepts a client span, and the
+// key it produced.
+func (d *Detector) extract(span sdktrace.ReadOnlySpan) (string, Key, bool) {
+	if span.SpanKind() != trace.SpanKindClient {
+		return "", Key{}, false
+	}
+	extractors := d.config.Extractors
+	if extractors == nil {
+		extractors = DefaultExtractors()
+	}
+	for _, e := range extractors {
+		if key, ok := e.Extract(span); ok {
+			return e.Name(), key, true
 		}
-		if string(attr.Key) == "db.statement" {
-			statement = attr.Value.AsString()
+	}
+	return "", Key{}, false
+}
+
+// threshold returns the threshold of an extractor. The caller must hold
+// tracesLock.
+func (d *Detector) threshold(extractor string) int {
+	if t, ok := d.config.Thresholds[extractor]; ok {
+		return t
+	}
+	return d.config.Threshold
+}
+
+func (d *Detector) countCall(td *traceData, span sdktrace.ReadOnlySpan, extractor string, key Key) {
+	parentID := span.Parent().SpanID()
+	scope, ok := td.parents[parentID]
+	if !ok {
+		scope = &parentScope{queries: make(map[string]*queryInfo)}
+		td.parents[parentID] = scope
+	}
+
+	fingerprint := key.Fingerprint
+	id := extractor + "\x00" + fingerprint
+	q, ok := scope.queries[id]
+	if !ok {
+		q = &queryInfo{
+			extractor: extractor,
+			statement: key.Sample,
+			callSite:  callSiteOf(span),
+			firstSeen: span.StartTime(),
 		}
+		scope.queries[id] = q
+	}
+	q.count++
+	q.allowed = q.allowed || hasAllowMarker(key.Sample)
+	q.total += span.EndTime().Sub(span.StartTime())
+	if span.StartTime().Before(q.firstSeen) {
+		q.firstSeen = span.StartTime()
+	}
+	if span.EndTime().After(q.lastSeen) {
+		q.lastSeen = span.EndTime()
+	}
+
+	consecutive := scope.lastFingerprint == id
+	if consecutive && d.config.MaxGap > 0 && span.StartTime().Sub(scope.lastEnd) > d.config.MaxGap {
+		consecutive = false
+	}
+	if consecutive {
+		q.run++
+	} else {
+		q.run = 1
 	}
+	q.maxRun = max(q.maxRun, q.run)
+	scope.lastFingerprint = id
+	scope.lastEnd = span.EndTime()
 
-	if !isDbCall || statement == "" {
+	repeats := q.count
+	if d.config.Sequential {
+		repeats = q.maxRun
+	}
+	if repeats >= d.threshold(extractor) && !q.detected {
+		q.detected = true
+		logging.Debugf("N+1 Detector: Call repeated %d times under span %s: %s", repeats, parentID, fingerprint)
+	}
+}
+
+// flush records the findings of scopes of a trace. The caller must hold
+// tracesLock.
+func (d *Detector) flush(traceID trace.TraceID, scopes map[trace.SpanID]*parentScope, route string) {
+	if d.allow.allowsRoute(route) {
 		return
 	}
+	for parentID, scope := range scopes {
+		for id, q := range scope.queries {
+			fingerprint := id[len(q.extractor)+1:]
+			if !q.detected || q.allowed || d.allow.allowsFingerprint(fingerprint) {
+				continue
+			}
+			count := q.count
+			if d.config.Sequential {
+				count = q.maxRun
+			}
+			avg := q.total / time.Duration(q.count)
+			logging.Warnf("N+1 Detector: Detected problem in trace %s under span %q (%s): %s", traceID, scope.name, parentID, fingerprint)
+			d.store.RecordNPlusOne(inmemory.NPlusOneFinding{
+				Path:           route,
+				Kind:           q.extractor,
+				Fingerprint:    fingerprint,
+				Statement:      q.statement,
+				Count:          count,
+				TraceID:        traceID.String(),
+				ParentName:     scope.name,
+				ParentSpanID:   parentID.String(),
+				TotalDuration:  q.total,
+				AvgDuration:    avg,
+				WastedDuration: q.total - avg,
+				FirstSeen:      q.firstSeen,
+				LastSeen:       q.lastSeen,
+				CallSite:       q.callSite,
+			})
+		}
+	}
+}
 
-	if _, ok := td.queries[statement]; !ok {
-		td.queries[statement] = &queryInfo{statement: statement}
+// callSiteOf reads the code.* attributes recorded by the SQL
+// instrumentation.
+func callSiteOf(span sdktrace.ReadOnlySpan) inmemory.CallSite {
+	var site inmemory.CallSite
+	for _, attr := range span.Attributes() {
+		switch attr.Key {
+		case semconv.CodeFunctionKey:
+			site.Function = attr.Value.AsString()
+		case semconv.CodeFilepathKey:
+			site.File = attr.Value.AsString()
+		case semconv.CodeLineNumberKey:
+			site.Line = int(attr.Value.AsInt64())
+		}
 	}
-	q := td.queries[statement]
-	q.count++
+	return site
+}
 
-	if q.count >= d.config.Threshold && !q.reported {
-		log.Printf("N+1 Detector: Detected problem in trace %s for query: %s", traceID, statement)
-		d.store.RecordNPlusOne(td.rootPath, statement, q.count)
-		q.reported = true
+// isLocalRoot reports whether span is the first span of its trace in this
+// process.
+func isLocalRoot(span sdktrace.ReadOnlySpan) bool {
+	parent := span.Parent()
+	return !parent.IsValid() || parent.IsRemote()
+}
+
+// routeOf returns the http.route of a server span, falling back to the span
+// name.
+func routeOf(span sdktrace.ReadOnlySpan) string {
+	if span.SpanKind() == trace.SpanKindServer {
+		for _, attr := range span.Attributes() {
+			if string(attr.Key) == "http.route" {
+				return attr.Value.AsString()
+			}
+		}
 	}
+	return span.Name()
 }
 
-func (d *Detector) startCleanupRoutine() {
-	ticker := time.NewTicker(1 * time.Minute)
+func (d *Detector) run(ctx context.Context) {
+	defer close(d.done)
+	defer d.ticker.Stop()
+
 	for {
-		<-ticker.C
-		d.cleanupOldTraces()
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.stop:
+			return
+		case now := <-d.ticker.C:
+			d.cleanupOldTraces(now)
+		}
 	}
 }
 
-func (d *Detector) cleanupOldTraces() {
+// cleanupOldTraces forgets traces whose local root never arrived, e.g.
+// because it was not sampled, recording their findings without a route.
+func (d *Detector) cleanupOldTraces(now time.Time) {
 	d.tracesLock.Lock()
 	defer d.tracesLock.Unlock()
 
-	timeout := 2 * time.Minute
-	now := time.Now()
+	ttl := d.config.traceTTL()
 	cleaned := 0
-	for traceID, data := range d.traces {
-		if now.Sub(data.lastSeen) > timeout {
-			delete(d.traces, traceID)
-			cleaned++
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		if now.Sub(el.Value.(*traceData).lastSeen) <= ttl {
+			break
 		}
+		d.remove(el)
+		cleaned++
 	}
 	if cleaned > 0 {
-		log.Printf("N+1 Detector: Cleaned up %d stale traces.", cleaned)
+		logging.Debugf("N+1 Detector: Cleaned up %d stale traces.", cleaned)
 	}
 }
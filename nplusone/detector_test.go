@@ -1,106 +1,540 @@
-//go:build skip
-// +build skip
-
 package nplusone
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/fllarpy/apm-probe/internal/sqlfingerprint"
 	"github.com/fllarpy/apm-probe/storage/inmemory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/attribute"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.uber.org/goleak"
 )
 
 // We reuse the real in-memory store for testing purposes.
 
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+var (
+	traceID  = oteltrace.TraceID{0x01}
+	rootID   = oteltrace.SpanID{0xff}
+	handlerA = oteltrace.SpanID{0xa0}
+	handlerB = oteltrace.SpanID{0xb0}
+)
+
 func TestDetector_ProcessSpan(t *testing.T) {
 	cfg := Config{
 		Enabled:   true,
 		Threshold: 3,
 	}
-	traceID := oteltrace.TraceID{0x01}
-	spanID := oteltrace.SpanID{0x01}
-
 	sqlQuery := "SELECT * FROM users WHERE id = ?"
 
 	t.Run("should not detect with queries below threshold", func(t *testing.T) {
 		store := inmemory.NewStore()
-		detector := NewDetector(cfg, store)
+		detector := newDetector(t, cfg, store)
 		require.NotNil(t, detector)
 
 		for i := 0; i < 2; i++ {
-			span := createDbSpan(traceID, oteltrace.SpanID{byte(i + 1)}, sqlQuery)
-			detector.ProcessSpan(span)
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, sqlQuery, time.Time{}))
 		}
+		detector.ProcessSpan(createServerSpan(rootID, "/users", "/users"))
 
 		assert.Equal(t, 0, store.NPlusOneLen(), "RecordNPlusOne should not be called")
 	})
 
 	t.Run("should detect when query count reaches threshold", func(t *testing.T) {
 		store := inmemory.NewStore()
-		detector := NewDetector(cfg, store)
+		detector := newDetector(t, cfg, store)
 		require.NotNil(t, detector)
 
-		detector.ProcessSpan(createServerSpan(traceID, spanID, "/users"))
-
 		for i := 0; i < 3; i++ {
-			span := createDbSpan(traceID, oteltrace.SpanID{byte(i + 2)}, sqlQuery)
-			detector.ProcessSpan(span)
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, sqlQuery, time.Time{}))
 		}
+		assert.Equal(t, 0, store.NPlusOneLen(), "findings wait for the local root span")
+
+		detector.ProcessSpan(createServerSpan(rootID, "GET /users", "/users"))
 
-		assert.Equal(t, 1, store.NPlusOneLen(), "RecordNPlusOne should be called once")
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, "/users", report.NPlusOne[0].Path)
+		assert.Equal(t, "GET /users", report.NPlusOne[0].Exemplars[0].ParentName)
+		assert.Equal(t, rootID.String(), report.NPlusOne[0].Exemplars[0].ParentSpanID)
 	})
 
-	t.Run("should report only once per trace", func(t *testing.T) {
+	t.Run("should report only once per trace with the final count", func(t *testing.T) {
 		store := inmemory.NewStore()
-		detector := NewDetector(cfg, store)
+		detector := newDetector(t, cfg, store)
 		require.NotNil(t, detector)
 
 		for i := 0; i < 5; i++ {
-			span := createDbSpan(traceID, oteltrace.SpanID{byte(i + 1)}, sqlQuery)
-			detector.ProcessSpan(span)
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, sqlQuery, time.Time{}))
 		}
+		detector.ProcessSpan(createServerSpan(rootID, "/users", "/users"))
 
 		assert.Equal(t, 1, store.NPlusOneLen(), "RecordNPlusOne should only be called once, even if more queries arrive")
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, 1, report.NPlusOne[0].Occurrences, "the trace is reported once")
+		assert.Equal(t, 5, report.NPlusOne[0].MaxCount)
 	})
 
 	t.Run("should handle different queries in the same trace", func(t *testing.T) {
 		store := inmemory.NewStore()
-		detector := NewDetector(cfg, store)
+		detector := newDetector(t, cfg, store)
 		require.NotNil(t, detector)
 
-		detector.ProcessSpan(createDbSpan(traceID, oteltrace.SpanID{0x01}, sqlQuery))
-		detector.ProcessSpan(createDbSpan(traceID, oteltrace.SpanID{0x02}, sqlQuery))
-
-		detector.ProcessSpan(createDbSpan(traceID, oteltrace.SpanID{0x03}, "SELECT * FROM products"))
-		detector.ProcessSpan(createDbSpan(traceID, oteltrace.SpanID{0x04}, "SELECT * FROM products"))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x01}, rootID, sqlQuery, time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x02}, rootID, sqlQuery, time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x03}, rootID, "SELECT * FROM products", time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x04}, rootID, "SELECT * FROM products", time.Time{}))
+		detector.ProcessSpan(createServerSpan(rootID, "/users", "/users"))
 
 		assert.Equal(t, 0, store.NPlusOneLen(), "RecordNPlusOne should not be called as no query reached the threshold")
 	})
+
+	t.Run("should group inlined literals by fingerprint", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		require.NotNil(t, detector)
+
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x01}, rootID, "SELECT * FROM orders WHERE user_id = 1", time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x02}, rootID, "select * from orders where user_id = 2", time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x03}, rootID, "SELECT * FROM orders WHERE user_id IN (3, 4)", time.Time{}))
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x04}, rootID, "SELECT * FROM orders WHERE user_id = 5", time.Time{}))
+		detector.ProcessSpan(createServerSpan(rootID, "/orders", "/orders"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1, "an IN list is a different statement")
+		assert.Equal(t, "select * from orders where user_id = ?", report.NPlusOne[0].Fingerprint)
+		assert.Equal(t, "SELECT * FROM orders WHERE user_id = 1", report.NPlusOne[0].Statement)
+		assert.Equal(t, 3, report.NPlusOne[0].MaxCount)
+	})
+
+	t.Run("should scope counts to the parent span", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		require.NotNil(t, detector)
+
+		// Two handlers of one trace run the statement twice each.
+		for i, parent := range []oteltrace.SpanID{handlerA, handlerB, handlerA, handlerB} {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, parent, sqlQuery, time.Time{}))
+		}
+		detector.ProcessSpan(createChildSpan(handlerA, rootID, "handlerA"))
+		detector.ProcessSpan(createChildSpan(handlerB, rootID, "handlerB"))
+		detector.ProcessSpan(createServerSpan(rootID, "/users", "/users"))
+		assert.Equal(t, 0, store.NPlusOneLen())
+
+		// A third run under handlerA crosses the threshold for it alone.
+		for i := 0; i < 3; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, handlerA, sqlQuery, time.Time{}))
+		}
+		detector.ProcessSpan(createDbSpan(oteltrace.SpanID{0x09}, handlerB, sqlQuery, time.Time{}))
+		detector.ProcessSpan(createChildSpan(handlerA, rootID, "handlerA"))
+		detector.ProcessSpan(createServerSpan(rootID, "/users", "/users"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, "handlerA", report.NPlusOne[0].Exemplars[0].ParentName)
+		assert.Equal(t, handlerA.String(), report.NPlusOne[0].Exemplars[0].ParentSpanID)
+	})
+
+	t.Run("should flush only the findings of the local root that ends", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		require.NotNil(t, detector)
+
+		// The handler of /orders calls /users of the same process, whose
+		// server span has the remote client span as its parent.
+		client, nested := oteltrace.SpanID{0xc0}, oteltrace.SpanID{0xd0}
+		for i := 0; i < 3; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, handlerA, "SELECT * FROM orders WHERE id = ?", time.Time{}))
+		}
+		for i := 0; i < 3; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 0x11)}, nested, sqlQuery, time.Time{}))
+		}
+		server := tracetest.SpanStubFromReadOnlySpan(createServerSpan(nested, "GET /users", "/users"))
+		server.Parent = oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: client, Remote: true})
+		detector.ProcessSpan(server.Snapshot())
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1, "the findings of /orders wait for its server span")
+		assert.Equal(t, "/users", report.NPlusOne[0].Path)
+		assert.Equal(t, nested.String(), report.NPlusOne[0].Exemplars[0].ParentSpanID)
+
+		detector.ProcessSpan(createHTTPClientSpan(client, handlerA, "http://localhost/users"))
+		detector.ProcessSpan(createChildSpan(handlerA, rootID, "handlerA"))
+		detector.ProcessSpan(createServerSpan(rootID, "GET /orders", "/orders"))
+
+		report = store.Report(inmemory.Query{Route: "/orders"})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, handlerA.String(), report.NPlusOne[0].Exemplars[0].ParentSpanID)
+		assert.Equal(t, 2, store.NPlusOneLen())
+	})
+}
+
+func TestDetector_Sequential(t *testing.T) {
+	cfg := Config{Enabled: true, Threshold: 3, Sequential: true, MaxGap: 10 * time.Millisecond}
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	t.Run("detects back-to-back repeats", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		for i := 0; i < 4; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT 1", at(i*5)))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "/seq", "/seq"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, 4, report.NPlusOne[0].MaxCount)
+	})
+
+	t.Run("restarts the count after another statement", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		queries := []string{"SELECT 1", "SELECT 1", "SELECT * FROM t", "SELECT 1", "SELECT 1"}
+		for i, q := range queries {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, q, at(i*5)))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "/seq", "/seq"))
+
+		assert.Equal(t, 0, store.NPlusOneLen())
+	})
+
+	t.Run("restarts the count after a long pause", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, cfg, store)
+		for i, ms := range []int{0, 5, 100, 105} {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT 1", at(ms)))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "/seq", "/seq"))
+
+		assert.Equal(t, 0, store.NPlusOneLen())
+	})
+}
+
+func TestDetector_FindingDetails(t *testing.T) {
+	store := inmemory.NewStore()
+	detector := newDetector(t, Config{Enabled: true, Threshold: 3}, store)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		span := tracetest.SpanStub{
+			SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: oteltrace.SpanID{byte(i + 1)}}),
+			Parent:      oteltrace.NewSpanContext(oteltrace.SpanContextConfig{TraceID: traceID, SpanID: rootID}),
+			SpanKind:    oteltrace.SpanKindClient,
+			Attributes: []attribute.KeyValue{
+				semconv.DBSystemSqlite,
+				attribute.String("db.statement", "SELECT * FROM items WHERE id = ?"),
+				semconv.CodeFunction("main.listItems"),
+				semconv.CodeFilepath("/app/items.go"),
+				semconv.CodeLineNumber(27),
+			},
+			StartTime: start.Add(time.Duration(i) * 10 * time.Millisecond),
+			EndTime:   start.Add(time.Duration(i)*10*time.Millisecond + 2*time.Millisecond),
+		}.Snapshot()
+		detector.ProcessSpan(span)
+	}
+	detector.ProcessSpan(createServerSpan(rootID, "GET /items", "/items"))
+
+	report := store.Report(inmemory.Query{})
+	require.Len(t, report.NPlusOne, 1)
+	f := report.NPlusOne[0].Exemplars[0]
+	assert.Equal(t, traceID.String(), f.TraceID)
+	assert.Equal(t, 4, f.Count)
+	assert.Equal(t, 8*time.Millisecond, f.TotalDuration)
+	assert.Equal(t, 2*time.Millisecond, f.AvgDuration)
+	assert.Equal(t, 6*time.Millisecond, f.WastedDuration)
+	assert.True(t, f.FirstSeen.Equal(start))
+	assert.True(t, f.LastSeen.Equal(start.Add(32*time.Millisecond)))
+	assert.Equal(t, inmemory.CallSite{Function: "main.listItems", File: "/app/items.go", Line: 27}, f.CallSite)
+}
+
+func TestDetector_Allowlist(t *testing.T) {
+	loop := func(detector *Detector, statement, route string) {
+		for i := 0; i < 3; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, statement, time.Time{}))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, route, route))
+	}
+	statement := "SELECT * FROM tags WHERE id = 1"
+
+	t.Run("by route", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, Config{Enabled: true, Threshold: 3, Allow: Allowlist{Routes: []string{"/batch"}}}, store)
+		loop(detector, statement, "/batch")
+		assert.Equal(t, 0, store.NPlusOneLen())
+		loop(detector, statement, "/tags")
+		assert.Equal(t, 1, store.NPlusOneLen())
+	})
+
+	t.Run("by statement or fingerprint ID", func(t *testing.T) {
+		for _, entry := range []string{"select * from tags where id = $1", sqlfingerprint.ID("select * from tags where id = ?")} {
+			store := inmemory.NewStore()
+			detector := newDetector(t, Config{Enabled: true, Threshold: 3, Allow: Allowlist{Fingerprints: []string{entry}}}, store)
+			loop(detector, statement, "/tags")
+			assert.Equal(t, 0, store.NPlusOneLen(), entry)
+		}
+	})
+
+	t.Run("by comment marker", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, Config{Enabled: true, Threshold: 3}, store)
+		loop(detector, statement+" /* "+AllowMarker+" */", "/tags")
+		assert.Equal(t, 0, store.NPlusOneLen())
+	})
+}
+
+func TestDetector_AggregatesAcrossTraces(t *testing.T) {
+	store := inmemory.NewStore()
+	detector := newDetector(t, Config{Enabled: true, Threshold: 2}, store)
+
+	for n, repeats := range []int{2, 4, 3} {
+		tid := oteltrace.TraceID{byte(n + 1)}
+		for i := 0; i < repeats; i++ {
+			span := createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t WHERE id = ?", time.Time{})
+			detector.ProcessSpan(withTraceID(span, tid))
+		}
+		detector.ProcessSpan(withTraceID(createServerSpan(rootID, "/t", "/t"), tid))
+	}
+
+	report := store.Report(inmemory.Query{})
+	require.Len(t, report.NPlusOne, 1)
+	group := report.NPlusOne[0]
+	assert.Equal(t, 3, group.Occurrences)
+	assert.Equal(t, 2, group.MinCount)
+	assert.Equal(t, 3.0, group.AvgCount)
+	assert.Equal(t, 4, group.MaxCount)
+	require.Len(t, group.Exemplars, 3)
+	assert.Equal(t, oteltrace.TraceID{3}.String(), group.Exemplars[0].TraceID, "newest exemplar first")
 }
 
-func createDbSpan(traceID oteltrace.TraceID, spanID oteltrace.SpanID, query string) sdktrace.ReadOnlySpan {
-	return &sdktrace.SpanSnapshot{
+func TestDetector_ClientCalls(t *testing.T) {
+	t.Run("should detect repeated HTTP calls by URL template", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, Config{Enabled: true, Threshold: 3}, store)
+
+		for i := 0; i < 3; i++ {
+			url := fmt.Sprintf("http://users.internal/users/%d?expand=1", i+1)
+			detector.ProcessSpan(createHTTPClientSpan(oteltrace.SpanID{byte(i + 1)}, rootID, url))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "GET /orders", "/orders"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, ExtractorHTTP, report.NPlusOne[0].Kind)
+		assert.Equal(t, "GET users.internal/users/{id}", report.NPlusOne[0].Fingerprint)
+		assert.Equal(t, "GET users.internal/users/1", report.NPlusOne[0].Statement)
+	})
+
+	t.Run("should apply the threshold of each extractor", func(t *testing.T) {
+		store := inmemory.NewStore()
+		cfg := Config{Enabled: true, Threshold: 5, Thresholds: map[string]int{ExtractorHTTP: 2}}
+		detector := newDetector(t, cfg, store)
+
+		for i := 0; i < 3; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t", time.Time{}))
+			detector.ProcessSpan(createHTTPClientSpan(oteltrace.SpanID{byte(i + 0x10)}, rootID, "http://users.internal/users/42"))
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "GET /orders", "/orders"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1, "three statements stay below the SQL threshold")
+		assert.Equal(t, ExtractorHTTP, report.NPlusOne[0].Kind)
+	})
+
+	t.Run("should only consult the configured extractors", func(t *testing.T) {
+		store := inmemory.NewStore()
+		cfg := Config{Enabled: true, Threshold: 2, Extractors: []KeyExtractor{rpcExtractor{}}}
+		detector := newDetector(t, cfg, store)
+
+		for i := 0; i < 2; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t", time.Time{}))
+			detector.ProcessSpan(createChildSpan(oteltrace.SpanID{byte(i + 0x10)}, rootID, "users.Get"))
+			rpc := tracetest.SpanStubFromReadOnlySpan(createChildSpan(oteltrace.SpanID{byte(i + 0x20)}, rootID, "users.Get"))
+			rpc.SpanKind = oteltrace.SpanKindClient
+			rpc.Attributes = []attribute.KeyValue{semconv.RPCSystemGRPC}
+			detector.ProcessSpan(rpc.Snapshot())
+		}
+		detector.ProcessSpan(createServerSpan(rootID, "GET /orders", "/orders"))
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1, "only client spans the extractor accepts are counted")
+		assert.Equal(t, "rpc", report.NPlusOne[0].Kind)
+		assert.Equal(t, "users.Get", report.NPlusOne[0].Fingerprint)
+	})
+}
+
+// rpcExtractor keys RPC client spans by their name.
+type rpcExtractor struct{}
+
+func (rpcExtractor) Name() string { return "rpc" }
+
+func (rpcExtractor) Extract(span sdktrace.ReadOnlySpan) (Key, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == semconv.RPCSystemKey {
+			return Key{Fingerprint: span.Name(), Sample: span.Name()}, true
+		}
+	}
+	return Key{}, false
+}
+
+func TestDetector_Lifecycle(t *testing.T) {
+	t.Run("should stop the cleanup goroutine on Close", func(t *testing.T) {
+		detector := NewDetector(Config{Enabled: true, Threshold: 2}, inmemory.NewStore())
+		detector.Close()
+		detector.Close()
+		goleak.VerifyNone(t)
+	})
+
+	t.Run("should stop the cleanup goroutine when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		detector := NewDetectorContext(ctx, Config{Enabled: true, Threshold: 2}, inmemory.NewStore())
+		cancel()
+		<-detector.done
+		goleak.VerifyNone(t)
+	})
+
+	t.Run("should record pending traces on Close", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := NewDetector(Config{Enabled: true, Threshold: 2}, store)
+		for i := 0; i < 2; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t", time.Time{}))
+		}
+		detector.Close()
+
+		report := store.Report(inmemory.Query{})
+		require.Len(t, report.NPlusOne, 1)
+		assert.Equal(t, "", report.NPlusOne[0].Path)
+	})
+}
+
+func TestDetector_TraceRetention(t *testing.T) {
+	t.Run("should flush traces idle for longer than the TTL", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, Config{Enabled: true, Threshold: 2, TraceTTL: time.Minute}, store)
+		for i := 0; i < 2; i++ {
+			detector.ProcessSpan(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t", time.Time{}))
+		}
+
+		detector.cleanupOldTraces(time.Now().Add(30 * time.Second))
+		assert.Equal(t, 0, store.NPlusOneLen(), "the trace is still within its TTL")
+
+		detector.cleanupOldTraces(time.Now().Add(2 * time.Minute))
+		assert.Equal(t, 1, store.NPlusOneLen())
+		assert.Empty(t, detector.traces)
+	})
+
+	t.Run("should evict the least recently updated trace over MaxTraces", func(t *testing.T) {
+		store := inmemory.NewStore()
+		detector := newDetector(t, Config{Enabled: true, Threshold: 2, MaxTraces: 2}, store)
+		first, second, third := oteltrace.TraceID{1}, oteltrace.TraceID{2}, oteltrace.TraceID{3}
+
+		for i := 0; i < 2; i++ {
+			detector.ProcessSpan(withTraceID(createDbSpan(oteltrace.SpanID{byte(i + 1)}, rootID, "SELECT * FROM t", time.Time{}), first))
+		}
+		detector.ProcessSpan(withTraceID(createDbSpan(oteltrace.SpanID{0x10}, rootID, "SELECT * FROM t", time.Time{}), second))
+		detector.ProcessSpan(withTraceID(createDbSpan(oteltrace.SpanID{0x03}, rootID, "SELECT * FROM t", time.Time{}), first))
+		detector.ProcessSpan(withTraceID(createDbSpan(oteltrace.SpanID{0x20}, rootID, "SELECT * FROM t", time.Time{}), third))
+
+		assert.Len(t, detector.traces, 2)
+		assert.NotContains(t, detector.traces, second, "the second trace was updated least recently")
+		assert.Equal(t, 0, store.NPlusOneLen())
+
+		require.NoError(t, detector.UpdateConfig(Config{Enabled: true, Threshold: 2, MaxTraces: 1}))
+		assert.Len(t, detector.traces, 1)
+		assert.Contains(t, detector.traces, third)
+		assert.Equal(t, 1, store.NPlusOneLen(), "the evicted first trace is recorded")
+	})
+}
+
+// newDetector starts a detector that is closed when the test ends.
+func newDetector(t *testing.T, cfg Config, store *inmemory.Store) *Detector {
+	t.Helper()
+	d := NewDetector(cfg, store)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func withTraceID(span sdktrace.ReadOnlySpan, tid oteltrace.TraceID) sdktrace.ReadOnlySpan {
+	stub := tracetest.SpanStubFromReadOnlySpan(span)
+	stub.SpanContext = stub.SpanContext.WithTraceID(tid)
+	if stub.Parent.IsValid() {
+		stub.Parent = stub.Parent.WithTraceID(tid)
+	}
+	return stub.Snapshot()
+}
+
+func createDbSpan(spanID, parentID oteltrace.SpanID, query string, start time.Time) sdktrace.ReadOnlySpan {
+	return tracetest.SpanStub{
 		SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
 			TraceID: traceID,
 			SpanID:  spanID,
 		}),
+		Parent: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  parentID,
+		}),
 		SpanKind:   oteltrace.SpanKindClient,
 		Attributes: []attribute.KeyValue{semconv.DBSystemSqlite, attribute.String("db.statement", query)},
-	}
+		StartTime:  start,
+		EndTime:    start.Add(time.Millisecond),
+	}.Snapshot()
 }
 
-func createServerSpan(traceID oteltrace.TraceID, spanID oteltrace.SpanID, path string) sdktrace.ReadOnlySpan {
-	return &sdktrace.SpanSnapshot{
+func createHTTPClientSpan(spanID, parentID oteltrace.SpanID, url string) sdktrace.ReadOnlySpan {
+	return tracetest.SpanStub{
 		SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
 			TraceID: traceID,
 			SpanID:  spanID,
 		}),
-		Name:     path,
-		SpanKind: oteltrace.SpanKindServer,
-	}
+		Parent: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  parentID,
+		}),
+		Name:     "HTTP GET",
+		SpanKind: oteltrace.SpanKindClient,
+		Attributes: []attribute.KeyValue{
+			attribute.String("http.method", "GET"),
+			attribute.String("http.url", url),
+			attribute.Int("http.status_code", 200),
+		},
+	}.Snapshot()
+}
+
+func createChildSpan(spanID, parentID oteltrace.SpanID, name string) sdktrace.ReadOnlySpan {
+	return tracetest.SpanStub{
+		SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  spanID,
+		}),
+		Parent: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  parentID,
+		}),
+		Name:     name,
+		SpanKind: oteltrace.SpanKindInternal,
+	}.Snapshot()
+}
+
+func createServerSpan(spanID oteltrace.SpanID, name, route string) sdktrace.ReadOnlySpan {
+	return tracetest.SpanStub{
+		SpanContext: oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  spanID,
+		}),
+		Name:       name,
+		SpanKind:   oteltrace.SpanKindServer,
+		Attributes: []attribute.KeyValue{attribute.String("http.route", route)},
+	}.Snapshot()
 }
@@ -0,0 +1,84 @@
+package nplusone
+
+import (
+	"github.com/fllarpy/apm-probe/internal/spanattr"
+	"github.com/fllarpy/apm-probe/internal/sqlfingerprint"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Names of the built-in extractors.
+const (
+	ExtractorSQL  = "sql"
+	ExtractorHTTP = "http"
+)
+
+// Key identifies the calls that count as repeats of one another.
+type Key struct {
+	// Fingerprint groups the calls, e.g. a normalized SQL statement.
+	Fingerprint string
+	// Sample is a raw example of the call, e.g. the SQL statement.
+	Sample string
+}
+
+// KeyExtractor maps client spans to the key they are counted under. The
+// detector asks its extractors in order and uses the first that accepts a
+// span.
+type KeyExtractor interface {
+	// Name identifies the extractor in Config.Thresholds and in findings.
+	Name() string
+	// Extract returns the key of span, or false if the span is not a call
+	// the extractor understands.
+	Extract(span sdktrace.ReadOnlySpan) (Key, bool)
+}
+
+// DefaultExtractors returns the built-in extractors: SQL statements, then
+// HTTP calls.
+func DefaultExtractors() []KeyExtractor {
+	return []KeyExtractor{SQLExtractor(), HTTPExtractor()}
+}
+
+// BuiltinExtractor returns the built-in extractor with the given name.
+func BuiltinExtractor(name string) (KeyExtractor, bool) {
+	switch name {
+	case ExtractorSQL:
+		return SQLExtractor(), true
+	case ExtractorHTTP:
+		return HTTPExtractor(), true
+	}
+	return nil, false
+}
+
+type sqlExtractor struct{}
+
+// SQLExtractor keys database spans by the fingerprint of their statement.
+func SQLExtractor() KeyExtractor { return sqlExtractor{} }
+
+func (sqlExtractor) Name() string { return ExtractorSQL }
+
+func (sqlExtractor) Extract(span sdktrace.ReadOnlySpan) (Key, bool) {
+	db, ok := spanattr.DatabaseCall(span)
+	if !ok || db.Statement == "" {
+		return Key{}, false
+	}
+	return Key{Fingerprint: sqlfingerprint.Fingerprint(db.Statement), Sample: db.Statement}, true
+}
+
+type httpExtractor struct{}
+
+// HTTPExtractor keys HTTP client spans by method, peer host and URL
+// template, with identifier path segments replaced by "{id}":
+// "GET api.internal/users/{id}".
+func HTTPExtractor() KeyExtractor { return httpExtractor{} }
+
+func (httpExtractor) Name() string { return ExtractorHTTP }
+
+func (httpExtractor) Extract(span sdktrace.ReadOnlySpan) (Key, bool) {
+	info, ok := spanattr.Client(span)
+	if !ok {
+		return Key{}, false
+	}
+	return Key{
+		Fingerprint: info.Method + " " + info.Host + info.Route,
+		Sample:      info.Method + " " + info.Host + info.Path,
+	}, true
+}
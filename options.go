@@ -0,0 +1,204 @@
+package apm_probe
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/nplusone"
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/runtimestats"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Option customizes a Probe created by NewProbe. Options are applied in
+// order and may return an error when given invalid input, in which case
+// NewProbe fails before any component is started.
+type Option func(*options) error
+
+type options struct {
+	profilerConfig     profiling.Config
+	nPlusOneConfig     nplusone.Config
+	storeConfig        inmemory.Config
+	runtimeConfig      runtimestats.Config
+	serviceVersion     string
+	resourceAttributes []attribute.KeyValue
+	sampler            sdktrace.Sampler
+	store              *inmemory.Store
+	setGlobalProvider  bool
+	customExporter     bool
+	loggingExporter    bool
+	logLevel           *logging.Level
+	reporterEndpoint   string
+}
+
+func defaultOptions() *options {
+	return &options{
+		profilerConfig:    profiling.DefaultConfig(),
+		nPlusOneConfig:    nplusone.DefaultConfig(),
+		storeConfig:       inmemory.DefaultConfig(),
+		runtimeConfig:     runtimestats.DefaultConfig(),
+		serviceVersion:    "1.0.0",
+		setGlobalProvider: true,
+		customExporter:    true,
+		reporterEndpoint:  "/debug/apm",
+	}
+}
+
+// WithProfilerConfig overrides the on-demand profiler settings.
+func WithProfilerConfig(cfg profiling.Config) Option {
+	return func(o *options) error {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid profiler config: %w", err)
+		}
+		o.profilerConfig = cfg
+		return nil
+	}
+}
+
+// WithNPlusOneConfig overrides the N+1 query detector settings.
+func WithNPlusOneConfig(cfg nplusone.Config) Option {
+	return func(o *options) error {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid N+1 detector config: %w", err)
+		}
+		o.nPlusOneConfig = cfg
+		return nil
+	}
+}
+
+// WithRuntimeConfig overrides the Go runtime metrics collector settings.
+func WithRuntimeConfig(cfg runtimestats.Config) Option {
+	return func(o *options) error {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid runtime collector config: %w", err)
+		}
+		o.runtimeConfig = cfg
+		return nil
+	}
+}
+
+// WithStoreConfig sets the retention settings of the store created by
+// NewProbe. It has no effect when combined with WithStore.
+func WithStoreConfig(cfg inmemory.Config) Option {
+	return func(o *options) error {
+		if cfg.MaxEvents < 0 {
+			return errors.New("store max events must not be negative")
+		}
+		if cfg.MaxAge < 0 {
+			return errors.New("store max age must not be negative")
+		}
+		if cfg.MaxBytes < 0 {
+			return errors.New("store max bytes must not be negative")
+		}
+		if cfg.MaxRoutes < 0 {
+			return errors.New("store max routes must not be negative")
+		}
+		o.storeConfig = cfg
+		return nil
+	}
+}
+
+// WithServiceVersion sets the service.version resource attribute.
+func WithServiceVersion(version string) Option {
+	return func(o *options) error {
+		if version == "" {
+			return errors.New("service version must not be empty")
+		}
+		o.serviceVersion = version
+		return nil
+	}
+}
+
+// WithResourceAttributes adds extra attributes to the tracer resource.
+// It may be given several times; attributes accumulate.
+func WithResourceAttributes(attrs ...attribute.KeyValue) Option {
+	return func(o *options) error {
+		for _, attr := range attrs {
+			if !attr.Valid() {
+				return fmt.Errorf("invalid resource attribute %q", attr.Key)
+			}
+		}
+		o.resourceAttributes = append(o.resourceAttributes, attrs...)
+		return nil
+	}
+}
+
+// WithSampler sets the sampler used by the tracer provider. By default every
+// span is recorded (the SDK's parent-based always-on sampler).
+func WithSampler(sampler sdktrace.Sampler) Option {
+	return func(o *options) error {
+		if sampler == nil {
+			return errors.New("sampler must not be nil")
+		}
+		o.sampler = sampler
+		return nil
+	}
+}
+
+// WithStore makes the probe write into an existing store instead of
+// allocating a new one.
+func WithStore(store *inmemory.Store) Option {
+	return func(o *options) error {
+		if store == nil {
+			return errors.New("store must not be nil")
+		}
+		o.store = store
+		return nil
+	}
+}
+
+// WithoutGlobalProvider stops NewProbe from installing its tracer provider
+// with otel.SetTracerProvider. Use Probe.TracerProvider to wire it manually.
+func WithoutGlobalProvider() Option {
+	return func(o *options) error {
+		o.setGlobalProvider = false
+		return nil
+	}
+}
+
+// WithoutCustomExporter stops the probe from feeding spans into its store.
+// Profiling and N+1 detection are driven by that exporter and therefore stop
+// working as well.
+func WithoutCustomExporter() Option {
+	return func(o *options) error {
+		o.customExporter = false
+		return nil
+	}
+}
+
+// WithLoggingExporter additionally logs a summary line for every span.
+func WithLoggingExporter() Option {
+	return func(o *options) error {
+		o.loggingExporter = true
+		return nil
+	}
+}
+
+// WithLogLevel sets the probe's log level ("debug", "info", "warn" or
+// "error"). The level is process-wide.
+func WithLogLevel(level string) Option {
+	return func(o *options) error {
+		l, err := logging.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		o.logLevel = &l
+		return nil
+	}
+}
+
+// WithReporterEndpoint sets the path the metrics endpoint should be mounted
+// on. An empty path disables the reporter.
+func WithReporterEndpoint(path string) Option {
+	return func(o *options) error {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("reporter endpoint %q must start with '/'", path)
+		}
+		o.reporterEndpoint = path
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package apm_probe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/nplusone"
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestNewProbe_Options(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rejects empty service name", func(t *testing.T) {
+		_, _, err := NewProbe(ctx, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects invalid profiler config", func(t *testing.T) {
+		cfg := profiling.DefaultConfig()
+		cfg.Duration = 0
+		_, _, err := NewProbe(ctx, "svc", WithProfilerConfig(cfg))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "profile duration")
+	})
+
+	t.Run("rejects invalid N+1 config", func(t *testing.T) {
+		_, _, err := NewProbe(ctx, "svc", WithNPlusOneConfig(nplusone.Config{Enabled: true, Threshold: 1}))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "threshold")
+	})
+
+	t.Run("rejects invalid resource attribute", func(t *testing.T) {
+		_, _, err := NewProbe(ctx, "svc", WithResourceAttributes(attribute.KeyValue{}))
+		assert.Error(t, err)
+	})
+
+	t.Run("uses supplied store and leaves global provider alone", func(t *testing.T) {
+		global := otel.GetTracerProvider()
+		store := inmemory.NewStore()
+
+		probe, got, err := NewProbe(ctx, "svc",
+			WithStore(store),
+			WithServiceVersion("2.3.4"),
+			WithProfilerConfig(profiling.Config{Enabled: false}),
+			WithNPlusOneConfig(nplusone.Config{Enabled: false}),
+			WithoutGlobalProvider(),
+		)
+		require.NoError(t, err)
+		defer probe.Shutdown(ctx)
+
+		assert.Same(t, store, got)
+		assert.Equal(t, global, otel.GetTracerProvider())
+
+		_, span := probe.TracerProvider().Tracer("test").Start(ctx, "op")
+		span.End()
+		shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		require.NoError(t, probe.TracerProvider().ForceFlush(shutdownCtx))
+	})
+}
@@ -0,0 +1,221 @@
+package apm_probe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fllarpy/apm-probe/config"
+	"github.com/fllarpy/apm-probe/nplusone"
+	"github.com/fllarpy/apm-probe/profiling"
+	"github.com/fllarpy/apm-probe/runtimestats"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// NewProbeFromConfig loads the configuration found at path (see
+// config.NewLoader) and builds a probe from it. Additional options are applied
+// after the ones derived from the file, so they take precedence.
+//
+// When the configuration sets enabled to false the returned probe records
+// nothing: spans are never sampled, no exporter, profiler or detector runs,
+// the global tracer provider is left untouched and the reporter is disabled.
+//
+// Unless hot_reload is false, the probe watches the file and applies changes
+// to profiler thresholds, the N+1 threshold, sampling, log level and exporter
+// toggles at runtime. A file that fails validation is ignored and the last
+// good configuration stays active.
+func NewProbeFromConfig(ctx context.Context, path string, opts ...Option) (*Probe, *inmemory.Store, error) {
+	loader := config.NewLoader(path)
+	cfg, err := loader.Load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	probe, store, err := NewProbe(ctx, cfg.ServiceName, append(optionsFromConfig(cfg), opts...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Enabled && cfg.HotReload && loader.Path() != "" {
+		if err := probe.watchConfig(loader, cfg); err != nil {
+			probe.Shutdown(ctx)
+			return nil, nil, fmt.Errorf("failed to watch config: %w", err)
+		}
+	}
+	return probe, store, nil
+}
+
+func optionsFromConfig(cfg config.Config) []Option {
+	if !cfg.Enabled {
+		return []Option{
+			WithLogLevel(cfg.LogLevel),
+			WithProfilerConfig(profiling.Config{Enabled: false}),
+			WithNPlusOneConfig(nplusone.Config{Enabled: false}),
+			WithRuntimeConfig(runtimestats.Config{Enabled: false}),
+			WithSampler(sdktrace.NeverSample()),
+			WithoutCustomExporter(),
+			WithoutGlobalProvider(),
+			WithReporterEndpoint(""),
+		}
+	}
+
+	opts := []Option{
+		WithServiceVersion(cfg.ServiceVersion),
+		WithLogLevel(cfg.LogLevel),
+		WithProfilerConfig(profilerConfig(cfg.Profiler)),
+		WithNPlusOneConfig(nPlusOneConfig(cfg.NPlusOne)),
+		WithStoreConfig(storeConfig(cfg.Store)),
+		WithRuntimeConfig(runtimeConfig(cfg.Runtime)),
+		withSamplingConfig(cfg.Sampling),
+	}
+	if !cfg.Exporters.Custom.Enabled {
+		opts = append(opts, WithoutCustomExporter())
+	}
+	if cfg.Exporters.Logging.Enabled {
+		opts = append(opts, WithLoggingExporter())
+	}
+	if cfg.Reporter.Enabled {
+		opts = append(opts, WithReporterEndpoint(cfg.Reporter.Endpoint))
+	} else {
+		opts = append(opts, WithReporterEndpoint(""))
+	}
+	return opts
+}
+
+func profilerConfig(cfg config.ProfilerConfig) profiling.Config {
+	return profiling.Config{
+		Enabled:              cfg.Enabled,
+		LatencyThreshold:     cfg.LatencyThreshold,
+		Duration:             cfg.Duration,
+		Cooldown:             cfg.Cooldown,
+		Types:                profileTypes(cfg.Types),
+		Dir:                  cfg.Dir,
+		MutexProfileFraction: cfg.MutexProfileFraction,
+		BlockProfileRate:     cfg.BlockProfileRate,
+		MinInterval:          cfg.MinInterval,
+		MaxBytes:             cfg.MaxBytes,
+		MaxAge:               cfg.MaxAge,
+		Policies:             profilerPolicies(cfg),
+		Continuous: profiling.ContinuousConfig{
+			Enabled:   cfg.Continuous.Enabled,
+			Interval:  cfg.Continuous.Interval,
+			Duration:  cfg.Continuous.Duration,
+			Types:     profileTypes(cfg.Continuous.Types),
+			Retention: cfg.Continuous.Retention,
+		},
+		Baselines: profiling.BaselinesConfig{
+			Enabled:  cfg.Baselines.Enabled,
+			Refresh:  cfg.Baselines.Refresh,
+			Interval: cfg.Baselines.Interval,
+			Top:      cfg.Baselines.Top,
+		},
+	}
+}
+
+func profileTypes(names []string) []profiling.ProfileType {
+	types := make([]profiling.ProfileType, 0, len(names))
+	for _, name := range names {
+		types = append(types, profiling.ProfileType(name))
+	}
+	return types
+}
+
+// profilerPolicies builds the trigger policies: the latency threshold, with
+// its per-route overrides, and every trigger that is switched on.
+func profilerPolicies(cfg config.ProfilerConfig) []profiling.Policy {
+	t := cfg.Triggers
+	threshold := profiling.ThresholdPolicy{Default: cfg.LatencyThreshold}
+	if len(t.Routes) > 0 {
+		threshold.Routes = make(map[string]time.Duration, len(t.Routes))
+		for _, r := range t.Routes {
+			threshold.Routes[r.Route] = r.LatencyThreshold
+		}
+	}
+	policies := []profiling.Policy{threshold}
+	if t.Percentile.Threshold > 0 {
+		policies = append(policies, &profiling.PercentilePolicy{
+			Percentile: t.Percentile.Percentile,
+			Threshold:  t.Percentile.Threshold,
+			Window:     t.Percentile.Window,
+			MinSamples: t.Percentile.MinSamples,
+		})
+	}
+	if t.Baseline.Multiple > 0 {
+		policies = append(policies, &profiling.BaselinePolicy{Multiple: t.Baseline.Multiple, MinSamples: t.Baseline.MinSamples})
+	}
+	if t.ErrorRate.Rate > 0 {
+		policies = append(policies, &profiling.ErrorRatePolicy{Rate: t.ErrorRate.Rate, Window: t.ErrorRate.Window, MinSamples: t.ErrorRate.MinSamples})
+	}
+	if t.Goroutines > 0 {
+		policies = append(policies, profiling.GoroutinePolicy{Max: t.Goroutines})
+	}
+	if t.HeapGrowth.Ratio > 0 {
+		policies = append(policies, &profiling.HeapGrowthPolicy{Ratio: t.HeapGrowth.Ratio, Window: t.HeapGrowth.Window})
+	}
+	return policies
+}
+
+func runtimeConfig(cfg config.RuntimeConfig) runtimestats.Config {
+	return runtimestats.Config{
+		Enabled:  cfg.Enabled,
+		Interval: cfg.CollectionInterval,
+	}
+}
+
+func storeConfig(cfg config.StoreConfig) inmemory.Config {
+	return inmemory.Config{
+		MaxEvents: cfg.MaxEvents,
+		MaxAge:    cfg.MaxAge,
+		MaxBytes:  cfg.MaxBytes,
+		MaxRoutes: cfg.MaxRoutes,
+
+		MaxRuntimeSamples: cfg.MaxRuntimeSamples,
+	}
+}
+
+func nPlusOneConfig(cfg config.NPlusOneConfig) nplusone.Config {
+	var extractors []nplusone.KeyExtractor
+	for _, name := range cfg.Extractors {
+		if e, ok := nplusone.BuiltinExtractor(name); ok {
+			extractors = append(extractors, e)
+		}
+	}
+	if extractors == nil {
+		extractors = nplusone.DefaultExtractors()
+	}
+	return nplusone.Config{
+		Enabled:       cfg.Enabled,
+		Threshold:     cfg.Threshold,
+		Thresholds:    cfg.Thresholds,
+		Extractors:    extractors,
+		Sequential:    cfg.Sequential,
+		TraceTTL:      cfg.TraceTTL,
+		SweepInterval: cfg.SweepInterval,
+		MaxTraces:     cfg.MaxTraces,
+		MaxGap:        cfg.MaxGap,
+		Allow: nplusone.Allowlist{
+			Routes:       cfg.Allow.Routes,
+			Fingerprints: cfg.Allow.Fingerprints,
+		},
+	}
+}
+
+func withSamplingConfig(cfg config.SamplingConfig) Option {
+	return func(o *options) error {
+		sampler, err := samplerFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		return WithSampler(sampler)(o)
+	}
+}
+
+func samplerFromConfig(cfg config.SamplingConfig) (sdktrace.Sampler, error) {
+	if cfg.Ratio < 0 || cfg.Ratio > 1 {
+		return nil, fmt.Errorf("sampling ratio %v must be within [0, 1]", cfg.Ratio)
+	}
+	sampler := sdktrace.TraceIDRatioBased(cfg.Ratio)
+	if cfg.ParentBased {
+		sampler = sdktrace.ParentBased(sampler)
+	}
+	return sampler, nil
+}
@@ -0,0 +1,54 @@
+package apm_probe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProbeFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	yaml := `
+service_name: "orders"
+log_level: "warn"
+profiler:
+  latency_threshold: 750ms
+  dir: "` + filepath.Join(dir, "profiles") + `"
+  max_age: 2h
+nplusone:
+  threshold: 8
+reporter:
+  endpoint: "/internal/apm"
+sampling:
+  ratio: 0.5
+store:
+  max_bytes: 1048576
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0o600))
+	defer logging.SetLevel(logging.LevelInfo)
+
+	ctx := context.Background()
+	probe, store, err := NewProbeFromConfig(ctx, dir, WithoutGlobalProvider())
+	require.NoError(t, err)
+	defer probe.Shutdown(ctx)
+
+	assert.NotNil(t, store)
+	assert.Equal(t, "/internal/apm", probe.ReporterEndpoint())
+	assert.Equal(t, logging.LevelWarn, logging.GetLevel())
+	assert.Contains(t, probe.sampler.Description(), "TraceIDRatioBased{0.5}")
+	assert.EqualValues(t, 1<<20, store.Report(inmemory.Query{}).Retention.MaxBytes)
+
+	require.NotNil(t, probe.profiler)
+	assert.Equal(t, 750*time.Millisecond, probe.profiler.Config().LatencyThreshold)
+	assert.Equal(t, filepath.Join(dir, "profiles"), probe.profiler.Config().Dir)
+	assert.Equal(t, 2*time.Hour, probe.profiler.Config().MaxAge)
+	require.NotNil(t, probe.detector)
+	assert.Equal(t, 8, probe.detector.Config().Threshold)
+}
@@ -0,0 +1,333 @@
+package profiling
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+)
+
+// ProfileType names a kind of profile the profiler can capture.
+type ProfileType string
+
+const (
+	ProfileCPU       ProfileType = "cpu"
+	ProfileHeap      ProfileType = "heap"
+	ProfileAllocs    ProfileType = "allocs"
+	ProfileGoroutine ProfileType = "goroutine"
+	ProfileMutex     ProfileType = "mutex"
+	ProfileBlock     ProfileType = "block"
+	// ProfileTrace is a runtime/trace execution trace, read with
+	// `go tool trace`.
+	ProfileTrace ProfileType = "trace"
+)
+
+// pprof label keys set by the HTTP middleware on the goroutine serving a
+// request. CPU, goroutine and execution trace samples carry them.
+const (
+	LabelRoute   = "route"
+	LabelTraceID = "trace_id"
+	LabelSpanID  = "span_id"
+)
+
+// ProfileTypes lists every supported profile type.
+var ProfileTypes = []ProfileType{
+	ProfileCPU, ProfileHeap, ProfileAllocs, ProfileGoroutine, ProfileMutex, ProfileBlock, ProfileTrace,
+}
+
+// Valid reports whether t is one of ProfileTypes.
+func (t ProfileType) Valid() bool {
+	for _, known := range ProfileTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// fileName is the name of the profile inside a bundle directory.
+func (t ProfileType) fileName() string {
+	if t == ProfileTrace {
+		return "trace.out"
+	}
+	return string(t) + ".pprof"
+}
+
+// Bundle is the set of profiles captured for one trigger.
+type Bundle struct {
+	// ID identifies the capture in the Store.
+	ID string
+	// Triggers are the slow requests the capture is attributed to, one per
+	// endpoint, in the order they asked for it.
+	Triggers  []Trigger
+	StartedAt time.Time
+	Duration  time.Duration
+	// Types are the profiles written to the store. Types that failed are
+	// missing and their error is in Errors.
+	Types  []ProfileType
+	Errors map[ProfileType]error
+	// Continuous marks a window of continuous profiling, and Baseline a
+	// baseline profile.
+	Continuous bool
+	Baseline   bool
+	// Bytes is the size of the profiles written.
+	Bytes int64
+	// Overhead is the time spent stopping and writing out the profiles
+	// after the window ended.
+	Overhead time.Duration
+
+	// profiles holds the profiles kept in memory to compare them to
+	// baselines.
+	profiles map[ProfileType][]byte
+}
+
+// countingWriter counts the bytes written to a profile and copies them to
+// kept if set. CPU profiles and execution traces are written concurrently,
+// so each profile has its own.
+type countingWriter struct {
+	io.WriteCloser
+	n    int64
+	kept *bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n += int64(n)
+	if w.kept != nil {
+		w.kept.Write(p[:n])
+	}
+	return n, err
+}
+
+// newCountingWriter wraps the writer of a t profile of bundle, keeping a
+// copy if bundle keeps t.
+func newCountingWriter(bundle *Bundle, t ProfileType, w io.WriteCloser) *countingWriter {
+	cw := &countingWriter{WriteCloser: w}
+	if _, ok := bundle.profiles[t]; ok {
+		cw.kept = new(bytes.Buffer)
+	}
+	return cw
+}
+
+// keep records the copy of a t profile written successfully by w.
+func (w *countingWriter) keep(bundle *Bundle, t ProfileType) {
+	if w.kept != nil {
+		bundle.profiles[t] = w.kept.Bytes()
+	}
+}
+
+// profileRates turns on mutex and block profiling while at least one
+// capture needs them, and restores the previous settings after the last one.
+type profileRates struct {
+	mu            sync.Mutex
+	mutexUsers    int
+	blockUsers    int
+	previousMutex int
+}
+
+// rates is process-wide, like the runtime settings it guards.
+var rates profileRates
+
+func (r *profileRates) enableMutex(fraction int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mutexUsers == 0 {
+		r.previousMutex = runtime.SetMutexProfileFraction(fraction)
+	}
+	r.mutexUsers++
+}
+
+func (r *profileRates) disableMutex() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mutexUsers--
+	if r.mutexUsers == 0 {
+		runtime.SetMutexProfileFraction(r.previousMutex)
+	}
+}
+
+// enableBlock sets the block profile rate. The runtime does not report the
+// current rate, so disableBlock restores the default of 0 (off).
+func (r *profileRates) enableBlock(rate int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blockUsers == 0 {
+		runtime.SetBlockProfileRate(rate)
+	}
+	r.blockUsers++
+}
+
+func (r *profileRates) disableBlock() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blockUsers--
+	if r.blockUsers == 0 {
+		runtime.SetBlockProfileRate(0)
+	}
+}
+
+// Trigger is what asked for a capture: a request that made a policy fire,
+// or a runtime policy.
+type Trigger struct {
+	// Route, TraceID and Latency describe the request. They are empty for
+	// runtime policies.
+	Route   string        `json:"route,omitempty"`
+	TraceID string        `json:"trace_id,omitempty"`
+	Latency time.Duration `json:"latency,omitempty"`
+	// Policy is the name of the policy that fired and Reason explains why.
+	Policy string `json:"policy,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// name is the route of the trigger, or its policy for runtime policies.
+func (t Trigger) name() string {
+	if t.Route == "" {
+		return t.Policy
+	}
+	return t.Route
+}
+
+// capture records the configured profiles of trigger into a new capture of
+// store. CPU profiles, execution traces and the mutex and block rates span
+// the whole window; heap, allocs, goroutine, mutex and block profiles are
+// written when it ends. Closing stop ends the window early. The capture is
+// deleted from the store if no profile could be written. The profiles of
+// the types in keep are also kept in memory.
+func capture(config Config, store Store, trigger Trigger, keep []ProfileType, stop <-chan struct{}) (*Bundle, error) {
+	start := time.Now()
+	bundle := &Bundle{
+		Triggers:  []Trigger{trigger},
+		StartedAt: start,
+		Errors:    make(map[ProfileType]error),
+		profiles:  make(map[ProfileType][]byte),
+	}
+	for _, t := range keep {
+		bundle.profiles[t] = nil
+	}
+	id, err := store.Begin(trigger.name(), start)
+	if err != nil {
+		return bundle, err
+	}
+	bundle.ID = id
+
+	types := config.types()
+	var stops []func()
+	for _, t := range types {
+		switch t {
+		case ProfileCPU:
+			if stop, err := startProfile(store, bundle, t, pprof.StartCPUProfile, pprof.StopCPUProfile); err == nil {
+				stops = append(stops, stop)
+			}
+		case ProfileTrace:
+			if stop, err := startProfile(store, bundle, t, trace.Start, trace.Stop); err == nil {
+				stops = append(stops, stop)
+			}
+		case ProfileMutex:
+			rates.enableMutex(config.mutexProfileFraction())
+			defer rates.disableMutex()
+		case ProfileBlock:
+			rates.enableBlock(config.blockProfileRate())
+			defer rates.disableBlock()
+		}
+	}
+
+	window := time.NewTimer(config.Duration)
+	select {
+	case <-window.C:
+	case <-stop:
+		window.Stop()
+	}
+	windowEnd := time.Now()
+	bundle.Duration = windowEnd.Sub(start)
+	for _, stop := range stops {
+		stop()
+	}
+
+	for _, t := range types {
+		switch t {
+		case ProfileHeap, ProfileAllocs, ProfileGoroutine, ProfileMutex, ProfileBlock:
+			if err := writeLookup(store, bundle, t); err != nil {
+				bundle.Errors[t] = err
+			}
+		}
+	}
+
+	bundle.Overhead = time.Since(windowEnd)
+
+	// Report types in a stable order, whatever order they finished in.
+	var written []ProfileType
+	for _, t := range ProfileTypes {
+		if slices.Contains(bundle.Types, t) {
+			written = append(written, t)
+		}
+	}
+	bundle.Types = written
+
+	if len(bundle.Types) == 0 {
+		if err := store.Delete(bundle.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			logging.Warnf("Profiler: Error deleting empty capture %s: %v", bundle.ID, err)
+		}
+		return bundle, errors.New("no profile could be captured")
+	}
+	return bundle, nil
+}
+
+// startProfile creates a profile in the store and starts writing to it. On
+// success it returns the function that stops the profile and closes the
+// writer.
+func startProfile(store Store, bundle *Bundle, t ProfileType, start func(w io.Writer) error, stop func()) (func(), error) {
+	f, err := store.Create(bundle.ID, t)
+	if err != nil {
+		bundle.Errors[t] = err
+		return nil, err
+	}
+	w := newCountingWriter(bundle, t, f)
+	if err := start(w); err != nil {
+		w.Close()
+		bundle.Errors[t] = err
+		logging.Warnf("Profiler: Could not start %s profile of %s: %v", t, bundle.ID, err)
+		return nil, err
+	}
+	return func() {
+		stop()
+		bundle.Bytes += w.n
+		if err := w.Close(); err != nil {
+			bundle.Errors[t] = err
+			return
+		}
+		w.keep(bundle, t)
+		bundle.Types = append(bundle.Types, t)
+	}, nil
+}
+
+// writeLookup writes a snapshot of one of the runtime's named profiles.
+func writeLookup(store Store, bundle *Bundle, t ProfileType) error {
+	p := pprof.Lookup(string(t))
+	if p == nil {
+		return fmt.Errorf("unknown profile %s", t)
+	}
+	f, err := store.Create(bundle.ID, t)
+	if err != nil {
+		return err
+	}
+	w := newCountingWriter(bundle, t, f)
+	if err := p.WriteTo(w, 0); err != nil {
+		w.Close()
+		return err
+	}
+	bundle.Bytes += w.n
+	if err := w.Close(); err != nil {
+		return err
+	}
+	w.keep(bundle, t)
+	bundle.Types = append(bundle.Types, t)
+	return nil
+}
@@ -0,0 +1,83 @@
+package profiling
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *LocalStore {
+	t.Helper()
+	store, err := NewLocalStore(LocalStoreConfig{Root: t.TempDir()})
+	require.NoError(t, err)
+	return store
+}
+
+func TestCapture_Bundle(t *testing.T) {
+	cfg := Config{
+		Enabled:  true,
+		Duration: 50 * time.Millisecond,
+		Types:    ProfileTypes,
+	}
+	store := newTestStore(t)
+
+	bundle, err := capture(cfg, store, Trigger{Route: "/users/{id}"}, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, bundle.Errors)
+	assert.GreaterOrEqual(t, bundle.Duration, cfg.Duration)
+	assert.Equal(t, ProfileTypes, bundle.Types)
+
+	for _, typ := range ProfileTypes {
+		info, err := os.Stat(filepath.Join(store.dir(bundle.ID), typ.fileName()))
+		require.NoError(t, err, "missing %s profile", typ)
+		assert.NotZero(t, info.Size(), "%s profile is empty", typ)
+	}
+	assert.FileExists(t, filepath.Join(store.dir(bundle.ID), "trace.out"))
+}
+
+func TestCapture_RestoresRates(t *testing.T) {
+	previous := runtime.SetMutexProfileFraction(3)
+	defer runtime.SetMutexProfileFraction(previous)
+
+	cfg := Config{
+		Enabled:              true,
+		Duration:             10 * time.Millisecond,
+		Types:                []ProfileType{ProfileMutex, ProfileBlock},
+		MutexProfileFraction: 7,
+	}
+	rates.enableMutex(cfg.mutexProfileFraction())
+	assert.Equal(t, 7, runtime.SetMutexProfileFraction(-1), "the rate is raised while a capture runs")
+
+	_, err := capture(cfg, newTestStore(t), Trigger{Route: "/locks"}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 7, runtime.SetMutexProfileFraction(-1), "another capture still needs the rate")
+
+	rates.disableMutex()
+	assert.Equal(t, 3, runtime.SetMutexProfileFraction(-1), "the previous rate is restored after the last capture")
+}
+
+func TestCapture_CPUProfileInUse(t *testing.T) {
+	cfg := Config{
+		Enabled:  true,
+		Duration: 10 * time.Millisecond,
+		Types:    []ProfileType{ProfileCPU},
+	}
+	store := newTestStore(t)
+	first := make(chan error)
+	go func() {
+		_, err := capture(Config{Enabled: true, Duration: 200 * time.Millisecond}, store, Trigger{Route: "/first"}, nil, nil)
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	bundle, err := capture(cfg, store, Trigger{Route: "/second"}, nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, bundle.Errors, ProfileCPU)
+	assert.NoDirExists(t, store.dir(bundle.ID), "no empty capture is left behind")
+	require.NoError(t, <-first)
+}
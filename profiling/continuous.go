@@ -0,0 +1,183 @@
+package profiling
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// PolicyContinuous is the policy recorded on windows of continuous
+// profiling.
+const PolicyContinuous = "continuous"
+
+// ContinuousConfig schedules short profiles independent of any trigger,
+// e.g. a 10s window every minute, kept on disk for Retention.
+type ContinuousConfig struct {
+	Enabled bool
+	// Interval is the time between the starts of two windows. Zero means
+	// one minute.
+	Interval time.Duration
+	// Duration is the length of a window. Zero means 10 seconds.
+	Duration time.Duration
+	// Types are the profiles captured per window. Empty means CPU and heap;
+	// execution traces are not supported.
+	Types []ProfileType
+	// Retention is how long windows are kept. Zero means one hour.
+	Retention time.Duration
+}
+
+const (
+	defaultContinuousInterval  = time.Minute
+	defaultContinuousDuration  = 10 * time.Second
+	defaultContinuousRetention = time.Hour
+)
+
+// Validate reports whether the windows fit the schedule. A disabled
+// configuration is always valid.
+func (c ContinuousConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval < 0 || c.Duration < 0 || c.Retention < 0 {
+		return errors.New("continuous interval, duration and retention must not be negative")
+	}
+	if c.duration() >= c.interval() {
+		return errors.New("continuous duration must be shorter than the interval")
+	}
+	for _, t := range c.Types {
+		if !t.Valid() {
+			return fmt.Errorf("unknown continuous profile type %q", t)
+		}
+		if t == ProfileTrace {
+			return errors.New("execution traces cannot be merged, so they are not profiled continuously")
+		}
+	}
+	return nil
+}
+
+func (c ContinuousConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultContinuousInterval
+	}
+	return c.Interval
+}
+
+func (c ContinuousConfig) duration() time.Duration {
+	if c.Duration == 0 {
+		return defaultContinuousDuration
+	}
+	return c.Duration
+}
+
+func (c ContinuousConfig) types() []ProfileType {
+	if len(c.Types) == 0 {
+		return []ProfileType{ProfileCPU, ProfileHeap}
+	}
+	return c.Types
+}
+
+func (c ContinuousConfig) retention() time.Duration {
+	if c.Retention == 0 {
+		return defaultContinuousRetention
+	}
+	return c.Retention
+}
+
+// Stats are the profiler's self-metrics.
+type Stats struct {
+	// Captures counts the captures requested by policies, Windows the
+	// windows of continuous profiling and Baselines the baseline profiles.
+	// Failed ones are counted in Failures only.
+	Captures  int64
+	Windows   int64
+	Baselines int64
+	Failures  int64
+	// SkippedWindows counts the windows of continuous profiling skipped
+	// because a capture was running or waiting.
+	SkippedWindows int64
+	// Profiling is the total time profiles were recorded for.
+	Profiling time.Duration
+	// Overhead is the total time spent stopping and writing out profiles.
+	Overhead time.Duration
+	// Bytes is the total size of the profiles written.
+	Bytes int64
+	// WindowBytes is the size of the continuous windows currently kept.
+	WindowBytes int64
+}
+
+// runContinuous requests a window every interval while continuous
+// profiling is enabled. The interval is re-read after every window.
+func (p *Profiler) runContinuous() {
+	defer close(p.done)
+
+	timer := time.NewTimer(p.Config().Continuous.interval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-timer.C:
+		}
+		config := p.Config()
+		if config.Enabled && config.Continuous.Enabled && !p.coordinator.requestWindow() {
+			p.statsLock.Lock()
+			p.stats.SkippedWindows++
+			p.statsLock.Unlock()
+		}
+		timer.Reset(config.Continuous.interval())
+	}
+}
+
+// Windows returns the windows of continuous profiling still kept, newest
+// first.
+func (p *Profiler) Windows() []IndexEntry {
+	return p.windows.List()
+}
+
+// Merge aggregates the t profiles of the continuous windows that started at
+// or after since into one profile, e.g. the CPU profile of the last hour.
+// Sample values are summed, so a merged heap profile adds up the snapshots
+// of its windows. It returns the number of windows merged, and ErrNotFound
+// when there is none.
+func (p *Profiler) Merge(t ProfileType, since time.Time) (*profile.Profile, int, error) {
+	return MergeWindows(p.windows, t, since)
+}
+
+// MergeWindows merges the t profiles of the captures in store that started
+// at or after since. See Profiler.Merge.
+func MergeWindows(store Store, t ProfileType, since time.Time) (*profile.Profile, int, error) {
+	if t == ProfileTrace {
+		return nil, 0, errors.New("execution traces cannot be merged")
+	}
+	var profiles []*profile.Profile
+	for _, entry := range store.List() {
+		if entry.StartedAt.Before(since) || !slices.Contains(entry.Types, t) {
+			continue
+		}
+		r, err := store.Open(entry.ID, t)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since List, e.g. by retention.
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		p, err := profile.Parse(r)
+		r.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse %s profile of %s: %w", t, entry.ID, err)
+		}
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	merged, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to merge %s profiles: %w", t, err)
+	}
+	return merged, len(profiles), nil
+}
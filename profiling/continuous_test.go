@@ -0,0 +1,58 @@
+package profiling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiler_Continuous(t *testing.T) {
+	profiler := NewProfiler(Config{
+		Enabled:          true,
+		LatencyThreshold: time.Second,
+		Duration:         time.Second,
+		Dir:              t.TempDir(),
+		Continuous: ContinuousConfig{
+			Enabled:  true,
+			Interval: 50 * time.Millisecond,
+			Duration: 20 * time.Millisecond,
+		},
+	})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	require.Eventually(t, func() bool { return len(profiler.Windows()) >= 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, profiler.Profiles(), "windows are kept apart from captures")
+	window := profiler.Windows()[0]
+	assert.Equal(t, []ProfileType{ProfileCPU, ProfileHeap}, window.Types)
+	assert.Equal(t, PolicyContinuous, window.Triggers[0].Policy)
+
+	for _, typ := range []ProfileType{ProfileCPU, ProfileHeap} {
+		merged, n, err := profiler.Merge(typ, time.Time{})
+		require.NoError(t, err, typ)
+		assert.GreaterOrEqual(t, n, 2)
+		require.NoError(t, merged.CheckValid())
+	}
+	_, _, err := profiler.Merge(ProfileCPU, time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, err = profiler.Merge(ProfileTrace, time.Time{})
+	assert.Error(t, err)
+
+	stats := profiler.Stats()
+	assert.GreaterOrEqual(t, stats.Windows, int64(2))
+	assert.Zero(t, stats.Captures)
+	assert.GreaterOrEqual(t, stats.Profiling, 40*time.Millisecond)
+	assert.Positive(t, stats.Overhead)
+	assert.Positive(t, stats.Bytes)
+	assert.Positive(t, stats.WindowBytes)
+}
+
+func TestContinuousConfig_Validate(t *testing.T) {
+	assert.NoError(t, ContinuousConfig{}.Validate(), "disabled is always valid")
+	assert.NoError(t, ContinuousConfig{Enabled: true}.Validate(), "defaults fit")
+	assert.Error(t, ContinuousConfig{Enabled: true, Interval: time.Second, Duration: time.Second}.Validate())
+	assert.Error(t, ContinuousConfig{Enabled: true, Types: []ProfileType{"flame"}}.Validate())
+	assert.Error(t, ContinuousConfig{Enabled: true, Types: []ProfileType{ProfileTrace}}.Validate())
+}
@@ -0,0 +1,261 @@
+package profiling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+)
+
+// coordinator serializes captures. CPU profiles and execution traces are
+// process-wide, so only one capture runs at a time. A request that arrives
+// while at least half of the running capture's window remains joins that
+// capture; any other request waits for the next one, which all waiting
+// requests share. Captures start at most once per Config.MinInterval.
+//
+// Windows of continuous profiling and baseline profiles run between
+// captures: they are skipped while a capture runs or waits, and requests
+// arriving during one wait for it to end.
+//
+// Finished captures are handed to captured in their own goroutine, so that
+// parsing and comparing profiles never holds up the requests of span
+// exporters and the runtime collector.
+type coordinator struct {
+	config    func() Config
+	store     Store
+	windows   Store
+	baselines Store
+	captured  func(*Bundle, error)
+
+	requests  chan Trigger
+	window    chan windowRequest
+	finishing sync.WaitGroup
+	stop      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// windowRequest asks for a window of continuous profiling, or for a
+// baseline attributed to baseline when it is set.
+type windowRequest struct {
+	baseline *Trigger
+	reply    chan bool
+}
+
+// activeCapture is the capture currently running.
+type activeCapture struct {
+	ends     time.Time
+	triggers []Trigger
+	// window marks a window of continuous profiling or a baseline, which
+	// requests do not join.
+	window bool
+	done   chan captureResult
+}
+
+type captureResult struct {
+	bundle *Bundle
+	err    error
+}
+
+// newCoordinator starts a coordinator writing captures to store,
+// continuous windows to windows and baseline profiles to baselines.
+func newCoordinator(config func() Config, store, windows, baselines Store, captured func(*Bundle, error)) *coordinator {
+	c := &coordinator{
+		config:    config,
+		store:     store,
+		windows:   windows,
+		baselines: baselines,
+		captured:  captured,
+		requests:  make(chan Trigger),
+		window:    make(chan windowRequest),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// request asks for a capture attributed to trigger. It returns false once
+// the coordinator is stopped.
+func (c *coordinator) request(trigger Trigger) bool {
+	select {
+	case c.requests <- trigger:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+// requestWindow starts a window of continuous profiling unless a capture
+// is running or waiting. It reports whether the window started.
+func (c *coordinator) requestWindow() bool {
+	return c.requestWindowOf(nil)
+}
+
+// requestBaseline starts a baseline profile attributed to trigger unless a
+// capture is running or waiting. It reports whether the baseline started.
+func (c *coordinator) requestBaseline(trigger Trigger) bool {
+	return c.requestWindowOf(&trigger)
+}
+
+func (c *coordinator) requestWindowOf(baseline *Trigger) bool {
+	req := windowRequest{baseline: baseline, reply: make(chan bool, 1)}
+	select {
+	case c.window <- req:
+		return <-req.reply
+	case <-c.stop:
+		return false
+	}
+}
+
+// close interrupts the running capture, which still records what it has,
+// drops waiting requests and waits for the coordinator to exit and for
+// captured to return for every capture. It is safe to call close more than
+// once.
+func (c *coordinator) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+func (c *coordinator) run() {
+	defer close(c.done)
+	defer c.finishing.Wait()
+
+	var (
+		active    *activeCapture
+		pending   []Trigger
+		lastStart time.Time
+		timer     *time.Timer
+		timerC    <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		// Start the next capture as soon as the rate limit allows it.
+		if active == nil && len(pending) > 0 {
+			wait := time.Until(lastStart.Add(c.config().MinInterval))
+			if wait <= 0 {
+				active = c.start(pending)
+				lastStart = time.Now()
+				pending = nil
+				timerC = nil
+			} else if timerC == nil {
+				logging.Debugf("Profiler: Rate limit reached, %d endpoints wait %s for the next capture.", len(pending), wait)
+				if timer == nil {
+					timer = time.NewTimer(wait)
+				} else {
+					timer.Reset(wait)
+				}
+				timerC = timer.C
+			}
+		}
+
+		var activeDone chan captureResult
+		if active != nil {
+			activeDone = active.done
+		}
+
+		select {
+		case trigger := <-c.requests:
+			switch {
+			case active != nil && !active.window && time.Until(active.ends) >= c.config().Duration/2:
+				active.triggers = appendTrigger(active.triggers, trigger)
+				logging.Debugf("Profiler: '%s' joins the running capture.", trigger.name())
+			default:
+				pending = appendTrigger(pending, trigger)
+			}
+		case req := <-c.window:
+			if active != nil || len(pending) > 0 {
+				req.reply <- false
+				continue
+			}
+			active = c.startWindow(req.baseline)
+			req.reply <- true
+		case <-timerC:
+			timerC = nil
+		case result := <-activeDone:
+			c.finish(active, result)
+			active = nil
+		case <-c.stop:
+			if active != nil {
+				c.finish(active, <-active.done)
+			}
+			if len(pending) > 0 {
+				logging.Debugf("Profiler: Dropped %d pending profile requests on shutdown.", len(pending))
+			}
+			return
+		}
+	}
+}
+
+// finish hands the result of active to captured in a new goroutine.
+func (c *coordinator) finish(active *activeCapture, result captureResult) {
+	result.bundle.Triggers = active.triggers
+	c.finishing.Add(1)
+	go func() {
+		defer c.finishing.Done()
+		c.captured(result.bundle, result.err)
+	}()
+}
+
+// start launches a capture attributed to triggers.
+func (c *coordinator) start(triggers []Trigger) *activeCapture {
+	config := c.config()
+	active := &activeCapture{
+		ends:     time.Now().Add(config.Duration),
+		triggers: triggers,
+		done:     make(chan captureResult, 1),
+	}
+	var keep []ProfileType
+	if config.Baselines.Enabled {
+		keep = diffTypes(config.types())
+	}
+	go func() {
+		bundle, err := capture(config, c.store, triggers[0], keep, c.stop)
+		active.done <- captureResult{bundle, err}
+	}()
+	return active
+}
+
+// startWindow launches a window of continuous profiling, or a baseline
+// attributed to baseline when it is set.
+func (c *coordinator) startWindow(baseline *Trigger) *activeCapture {
+	config := c.config()
+	store, trigger := c.windows, Trigger{Policy: PolicyContinuous}
+	if baseline == nil {
+		config.Duration = config.Continuous.duration()
+		config.Types = config.Continuous.types()
+	} else {
+		config.Types = diffTypes(config.types())
+		store, trigger = c.baselines, *baseline
+	}
+	active := &activeCapture{
+		ends:     time.Now().Add(config.Duration),
+		triggers: []Trigger{trigger},
+		window:   true,
+		done:     make(chan captureResult, 1),
+	}
+	go func() {
+		bundle, err := capture(config, store, trigger, nil, c.stop)
+		bundle.Continuous, bundle.Baseline = baseline == nil, baseline != nil
+		active.done <- captureResult{bundle, err}
+	}()
+	return active
+}
+
+// appendTrigger adds trigger unless its route or runtime policy already
+// asked.
+func appendTrigger(triggers []Trigger, trigger Trigger) []Trigger {
+	for _, t := range triggers {
+		if t.name() == trigger.name() {
+			return triggers
+		}
+	}
+	return append(triggers, trigger)
+}
@@ -0,0 +1,168 @@
+package profiling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type captureOutcome struct {
+	bundle *Bundle
+	err    error
+}
+
+func newTestCoordinator(t *testing.T, cfg Config) (*coordinator, <-chan captureOutcome) {
+	t.Helper()
+	outcomes := make(chan captureOutcome, 10)
+	c := newCoordinator(func() Config { return cfg }, newTestStore(t), newTestStore(t), newTestStore(t), func(b *Bundle, err error) {
+		outcomes <- captureOutcome{b, err}
+	})
+	t.Cleanup(c.close)
+	return c, outcomes
+}
+
+func nextOutcome(t *testing.T, outcomes <-chan captureOutcome) captureOutcome {
+	t.Helper()
+	select {
+	case o := <-outcomes:
+		require.NoError(t, o.err)
+		return o
+	case <-time.After(5 * time.Second):
+		t.Fatal("no capture completed")
+		return captureOutcome{}
+	}
+}
+
+func routes(b *Bundle) []string {
+	var out []string
+	for _, t := range b.Triggers {
+		out = append(out, t.Route)
+	}
+	return out
+}
+
+func TestCoordinator(t *testing.T) {
+	t.Run("should attribute one capture to overlapping requests", func(t *testing.T) {
+		c, outcomes := newTestCoordinator(t, Config{Enabled: true, Duration: 300 * time.Millisecond})
+
+		c.request(Trigger{Route: "/a"})
+		c.request(Trigger{Route: "/b"})
+		c.request(Trigger{Route: "/a"})
+
+		o := nextOutcome(t, outcomes)
+		assert.Equal(t, []string{"/a", "/b"}, routes(o.bundle))
+		assert.Contains(t, o.bundle.Types, ProfileCPU)
+		assert.Empty(t, o.bundle.Errors, "requests never compete for the CPU profiler")
+	})
+
+	t.Run("should queue requests late in a capture for the next one", func(t *testing.T) {
+		c, outcomes := newTestCoordinator(t, Config{Enabled: true, Duration: 200 * time.Millisecond})
+
+		c.request(Trigger{Route: "/a"})
+		time.Sleep(150 * time.Millisecond)
+		c.request(Trigger{Route: "/b"})
+		c.request(Trigger{Route: "/c"})
+
+		assert.Equal(t, []string{"/a"}, routes(nextOutcome(t, outcomes).bundle))
+		assert.Equal(t, []string{"/b", "/c"}, routes(nextOutcome(t, outcomes).bundle))
+	})
+
+	t.Run("should space captures by MinInterval", func(t *testing.T) {
+		cfg := Config{Enabled: true, Duration: 20 * time.Millisecond, MinInterval: 300 * time.Millisecond}
+		c, outcomes := newTestCoordinator(t, cfg)
+
+		c.request(Trigger{Route: "/a"})
+		first := nextOutcome(t, outcomes)
+		c.request(Trigger{Route: "/b"})
+		second := nextOutcome(t, outcomes)
+
+		assert.GreaterOrEqual(t, second.bundle.StartedAt.Sub(first.bundle.StartedAt), cfg.MinInterval)
+	})
+
+	t.Run("should end the running capture on close", func(t *testing.T) {
+		c, outcomes := newTestCoordinator(t, Config{Enabled: true, Duration: time.Hour})
+
+		c.request(Trigger{Route: "/a"})
+		time.Sleep(20 * time.Millisecond)
+		closed := make(chan struct{})
+		go func() {
+			c.close()
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("close did not interrupt the capture")
+		}
+		o := nextOutcome(t, outcomes)
+		assert.Contains(t, o.bundle.Types, ProfileCPU, "the interrupted capture is kept")
+		assert.False(t, c.request(Trigger{Route: "/b"}), "requests are refused after close")
+	})
+}
+
+func TestCoordinator_Captured(t *testing.T) {
+	t.Run("should serve requests while captured runs", func(t *testing.T) {
+		cfg := Config{Enabled: true, Duration: 50 * time.Millisecond}
+		entered, release := make(chan string, 10), make(chan struct{})
+		c := newCoordinator(func() Config { return cfg }, newTestStore(t), newTestStore(t), newTestStore(t), func(b *Bundle, err error) {
+			entered <- b.Triggers[0].Route
+			<-release
+		})
+		t.Cleanup(c.close)
+		defer close(release)
+
+		next := func() string {
+			select {
+			case route := <-entered:
+				return route
+			case <-time.After(5 * time.Second):
+				t.Fatal("no capture completed")
+				return ""
+			}
+		}
+
+		c.request(Trigger{Route: "/a"})
+		assert.Equal(t, "/a", next())
+
+		requested := make(chan bool)
+		go func() { requested <- c.request(Trigger{Route: "/b"}) }()
+		select {
+		case ok := <-requested:
+			assert.True(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("the request waited for captured to return")
+		}
+		assert.Equal(t, "/b", next(), "the next capture runs while captured still handles the first")
+	})
+}
+
+func TestCoordinator_Windows(t *testing.T) {
+	t.Run("should skip windows while a capture runs", func(t *testing.T) {
+		c, outcomes := newTestCoordinator(t, Config{Enabled: true, Duration: 200 * time.Millisecond})
+
+		c.request(Trigger{Route: "/a"})
+		assert.False(t, c.requestWindow())
+		assert.False(t, nextOutcome(t, outcomes).bundle.Continuous)
+	})
+
+	t.Run("should let requests wait for a window to end", func(t *testing.T) {
+		cfg := Config{Enabled: true, Duration: 20 * time.Millisecond, Continuous: ContinuousConfig{Duration: 200 * time.Millisecond}}
+		c, outcomes := newTestCoordinator(t, cfg)
+
+		require.True(t, c.requestWindow())
+		c.request(Trigger{Route: "/a"})
+
+		window := nextOutcome(t, outcomes).bundle
+		assert.True(t, window.Continuous)
+		assert.Equal(t, []ProfileType{ProfileCPU, ProfileHeap}, window.Types)
+		assert.Equal(t, []Trigger{{Policy: PolicyContinuous}}, window.Triggers, "requests do not join windows")
+
+		capture := nextOutcome(t, outcomes).bundle
+		assert.False(t, capture.Continuous)
+		assert.Equal(t, []string{"/a"}, routes(capture))
+		assert.Contains(t, capture.Types, ProfileCPU, "the window released the CPU profiler")
+	})
+}
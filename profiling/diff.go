@@ -0,0 +1,384 @@
+package profiling
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/google/pprof/profile"
+)
+
+// PolicyBaselineProfile is the policy recorded on baseline profiles.
+const PolicyBaselineProfile = "baseline_profile"
+
+// BaselinesConfig keeps a baseline profile per route, recorded while the
+// route's latency is normal, and compares the profiles of every capture a
+// route triggers to that route's baseline.
+//
+// A baseline is recorded when a request no policy fires for finds its route
+// without a baseline, or with one older than Refresh. It covers
+// Config.Duration and the types of Config.Types that can be compared: CPU
+// and heap. Like windows of continuous profiling, baselines are skipped
+// while a capture runs or waits.
+type BaselinesConfig struct {
+	Enabled bool
+	// Refresh is the age at which a route's baseline is recorded again.
+	// Zero means one hour.
+	Refresh time.Duration
+	// Interval is the minimum time between two baselines, across routes.
+	// Zero means one minute.
+	Interval time.Duration
+	// Top is the number of functions listed per diff. Zero means 10.
+	Top int
+}
+
+const (
+	defaultBaselineRefresh  = time.Hour
+	defaultBaselineInterval = time.Minute
+	defaultDiffTop          = 10
+)
+
+// Validate reports whether the baselines can be recorded. A disabled
+// configuration is always valid.
+func (c BaselinesConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Refresh < 0 || c.Interval < 0 {
+		return errors.New("baseline refresh and interval must not be negative")
+	}
+	if c.Top < 0 {
+		return errors.New("diff top must not be negative")
+	}
+	return nil
+}
+
+func (c BaselinesConfig) refresh() time.Duration {
+	if c.Refresh == 0 {
+		return defaultBaselineRefresh
+	}
+	return c.Refresh
+}
+
+func (c BaselinesConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultBaselineInterval
+	}
+	return c.Interval
+}
+
+func (c BaselinesConfig) top() int {
+	if c.Top == 0 {
+		return defaultDiffTop
+	}
+	return c.Top
+}
+
+// diffTypes returns the types of types that can be compared to a baseline.
+func diffTypes(types []ProfileType) []ProfileType {
+	var out []ProfileType
+	for _, t := range types {
+		if t == ProfileCPU || t == ProfileHeap {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Diff compares one profile of a capture to the baseline of a route that
+// triggered it. CPU profiles are narrowed down to the samples of the route
+// and compare time; heap profiles cover the whole process and compare the
+// bytes in use.
+type Diff struct {
+	Route string      `json:"route"`
+	Type  ProfileType `json:"type"`
+	// Baseline is the ID of the baseline profile.
+	Baseline          string    `json:"baseline"`
+	BaselineStartedAt time.Time `json:"baseline_started_at"`
+	// SampleType and Unit name the values compared, e.g. cpu in
+	// nanoseconds or inuse_space in bytes.
+	SampleType string `json:"sample_type"`
+	Unit       string `json:"unit"`
+	// Total and BaselineTotal sum the samples of both profiles. A CPU
+	// baseline is scaled to the duration of the capture.
+	Total         int64 `json:"total"`
+	BaselineTotal int64 `json:"baseline_total"`
+	// Functions are the functions that changed the most, by flat and then
+	// cumulative value.
+	Functions []FunctionDelta `json:"functions"`
+}
+
+// FunctionDelta is the flat value of a function, spent in the function
+// itself, and its cumulative value, spent in it and its callees, in a
+// capture and its baseline.
+type FunctionDelta struct {
+	Function     string `json:"function"`
+	Flat         int64  `json:"flat"`
+	Cum          int64  `json:"cum"`
+	BaselineFlat int64  `json:"baseline_flat"`
+	BaselineCum  int64  `json:"baseline_cum"`
+}
+
+func (d FunctionDelta) FlatDelta() int64 { return d.Flat - d.BaselineFlat }
+
+func (d FunctionDelta) CumDelta() int64 { return d.Cum - d.BaselineCum }
+
+// CompareProfiles returns the top functions of p that changed the most from
+// base. It compares the default sample type of p, e.g. cpu time for a CPU
+// profile, which base must have too. The returned Diff only has the fields
+// describing the values set.
+func CompareProfiles(p, base *profile.Profile, top int) (Diff, error) {
+	if len(p.SampleType) == 0 {
+		return Diff{}, errors.New("profile has no sample types")
+	}
+	i := len(p.SampleType) - 1
+	if p.DefaultSampleType != "" {
+		var err error
+		if i, err = sampleIndex(p, p.DefaultSampleType); err != nil {
+			return Diff{}, err
+		}
+	}
+	st := p.SampleType[i]
+	j, err := sampleIndex(base, st.Type)
+	if err != nil {
+		return Diff{}, fmt.Errorf("baseline: %w", err)
+	}
+
+	flat, cum, total := functionValues(p, i)
+	baseFlat, baseCum, baseTotal := functionValues(base, j)
+	deltas := make(map[string]*FunctionDelta)
+	delta := func(fn string) *FunctionDelta {
+		d, ok := deltas[fn]
+		if !ok {
+			d = &FunctionDelta{Function: fn}
+			deltas[fn] = d
+		}
+		return d
+	}
+	for fn, v := range cum {
+		d := delta(fn)
+		d.Flat, d.Cum = flat[fn], v
+	}
+	for fn, v := range baseCum {
+		d := delta(fn)
+		d.BaselineFlat, d.BaselineCum = baseFlat[fn], v
+	}
+
+	functions := make([]FunctionDelta, 0, len(deltas))
+	for _, d := range deltas {
+		if d.FlatDelta() != 0 || d.CumDelta() != 0 {
+			functions = append(functions, *d)
+		}
+	}
+	slices.SortFunc(functions, func(a, b FunctionDelta) int {
+		return cmp.Or(
+			cmp.Compare(abs(b.FlatDelta()), abs(a.FlatDelta())),
+			cmp.Compare(abs(b.CumDelta()), abs(a.CumDelta())),
+			cmp.Compare(a.Function, b.Function),
+		)
+	})
+	if len(functions) > top {
+		functions = functions[:top]
+	}
+	return Diff{
+		SampleType:    st.Type,
+		Unit:          st.Unit,
+		Total:         total,
+		BaselineTotal: baseTotal,
+		Functions:     functions,
+	}, nil
+}
+
+func sampleIndex(p *profile.Profile, typ string) (int, error) {
+	for i, st := range p.SampleType {
+		if st.Type == typ {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("profile has no %s samples", typ)
+}
+
+// functionValues sums the values of sample type i per function. A sample
+// counts towards the flat value of its leaf function and, once, towards
+// the cumulative value of every function on its stack.
+func functionValues(p *profile.Profile, i int) (flat, cum map[string]int64, total int64) {
+	flat = make(map[string]int64)
+	cum = make(map[string]int64)
+	for _, s := range p.Sample {
+		v := s.Value[i]
+		total += v
+		seen := make(map[string]bool)
+		for depth, loc := range s.Location {
+			names := locationFunctions(loc)
+			if depth == 0 && len(names) > 0 {
+				flat[names[0]] += v
+			}
+			for _, name := range names {
+				if !seen[name] {
+					seen[name] = true
+					cum[name] += v
+				}
+			}
+		}
+	}
+	return flat, cum, total
+}
+
+// locationFunctions returns the functions of loc, innermost inlined
+// function first, or its address when it is not symbolized.
+func locationFunctions(loc *profile.Location) []string {
+	var names []string
+	for _, line := range loc.Line {
+		if line.Function != nil {
+			names = append(names, line.Function.Name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, fmt.Sprintf("0x%x", loc.Address))
+	}
+	return names
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Baselines returns the baseline profiles kept, newest first.
+func (p *Profiler) Baselines() []IndexEntry {
+	return p.baselines.List()
+}
+
+// baselineRoute returns the route a baseline was recorded for. Entries
+// loaded from a damaged index may have no trigger, and belong to no route.
+func baselineRoute(entry IndexEntry) (string, bool) {
+	if len(entry.Triggers) == 0 {
+		return "", false
+	}
+	return entry.Triggers[0].Route, true
+}
+
+// baseline returns the newest baseline of route.
+func (p *Profiler) baseline(route string) (IndexEntry, bool) {
+	for _, entry := range p.baselines.List() {
+		if r, ok := baselineRoute(entry); ok && r == route {
+			return entry, true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// recordBaseline starts a baseline of r's route when it has none, or one
+// older than Refresh, unless another baseline started within Interval. A
+// baseline the coordinator turns down, because a capture runs or waits, is
+// tried again with the next request.
+func (p *Profiler) recordBaseline(config Config, r Request) {
+	p.baselinesLock.Lock()
+	recorded, ok := p.baselineAt.get(r.Route)
+	due := (!ok || r.At.Sub(recorded) >= config.Baselines.refresh()) && !r.At.Before(p.nextBaseline)
+	p.baselinesLock.Unlock()
+
+	if !due {
+		return
+	}
+	trigger := Trigger{
+		Route:   r.Route,
+		TraceID: r.TraceID,
+		Latency: r.Latency,
+		Policy:  PolicyBaselineProfile,
+		Reason:  fmt.Sprintf("latency %s is normal", r.Latency),
+	}
+	if !p.coordinator.requestBaseline(trigger) {
+		return
+	}
+	p.baselinesLock.Lock()
+	p.nextBaseline = r.At.Add(config.Baselines.interval())
+	p.baselinesLock.Unlock()
+	logging.Debugf("Profiler: Recording a baseline profile of '%s'.", r.Route)
+}
+
+// baselineRecorded makes entry the baseline of its route and deletes the
+// route's older baselines.
+func (p *Profiler) baselineRecorded(entry IndexEntry) {
+	route, ok := baselineRoute(entry)
+	if !ok {
+		return
+	}
+	p.baselinesLock.Lock()
+	p.baselineAt.put(route, entry.StartedAt)
+	p.baselinesLock.Unlock()
+
+	for _, old := range p.baselines.List() {
+		if r, ok := baselineRoute(old); ok && old.ID != entry.ID && r == route {
+			if err := p.baselines.Delete(old.ID); err != nil && !errors.Is(err, ErrNotFound) {
+				logging.Warnf("Profiler: Error deleting baseline %s: %v", old.ID, err)
+			}
+		}
+	}
+}
+
+// diffs compares the profiles kept by bundle to the baselines of the routes
+// that triggered it.
+func (p *Profiler) diffs(config Config, bundle *Bundle) []Diff {
+	var diffs []Diff
+	for _, trigger := range bundle.Triggers {
+		if trigger.Route == "" {
+			continue
+		}
+		base, ok := p.baseline(trigger.Route)
+		if !ok {
+			continue
+		}
+		for _, t := range diffTypes(bundle.Types) {
+			data := bundle.profiles[t]
+			if len(data) == 0 || !slices.Contains(base.Types, t) {
+				continue
+			}
+			d, err := p.diff(trigger.Route, t, data, bundle.Duration, base, config.Baselines.top())
+			if err != nil {
+				logging.Warnf("Profiler: Error comparing the %s profile of %s to baseline %s: %v", t, bundle.ID, base.ID, err)
+				continue
+			}
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// diff compares data, a t profile of route recorded for duration, to the
+// same profile of base.
+func (p *Profiler) diff(route string, t ProfileType, data []byte, duration time.Duration, base IndexEntry, top int) (Diff, error) {
+	current, err := profile.ParseData(data)
+	if err != nil {
+		return Diff{}, fmt.Errorf("failed to parse profile: %w", err)
+	}
+	r, err := p.baselines.Open(base.ID, t)
+	if err != nil {
+		return Diff{}, err
+	}
+	baseline, err := profile.Parse(r)
+	r.Close()
+	if err != nil {
+		return Diff{}, fmt.Errorf("failed to parse baseline: %w", err)
+	}
+	if t == ProfileCPU {
+		filterSamples(current, LabelRoute, route)
+		filterSamples(baseline, LabelRoute, route)
+		if base.Duration > 0 {
+			baseline.Scale(float64(duration) / float64(base.Duration))
+		}
+	}
+
+	d, err := CompareProfiles(current, baseline, top)
+	if err != nil {
+		return Diff{}, err
+	}
+	d.Route, d.Type = route, t
+	d.Baseline, d.BaselineStartedAt = base.ID, base.StartedAt
+	return d, nil
+}
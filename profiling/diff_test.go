@@ -0,0 +1,181 @@
+package profiling
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type cpuSample struct {
+	ms int64
+	// stack lists the functions, leaf first.
+	stack []string
+}
+
+func cpuProfile(samples ...cpuSample) *profile.Profile {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+	locations := make(map[string]*profile.Location)
+	for _, sample := range samples {
+		s := &profile.Sample{Value: []int64{1, sample.ms * int64(time.Millisecond)}}
+		for _, name := range sample.stack {
+			loc, ok := locations[name]
+			if !ok {
+				fn := &profile.Function{ID: uint64(len(locations) + 1), Name: name}
+				loc = &profile.Location{ID: fn.ID, Line: []profile.Line{{Function: fn}}}
+				locations[name] = loc
+				p.Function = append(p.Function, fn)
+				p.Location = append(p.Location, loc)
+			}
+			s.Location = append(s.Location, loc)
+		}
+		p.Sample = append(p.Sample, s)
+	}
+	return p
+}
+
+func TestCompareProfiles(t *testing.T) {
+	base := cpuProfile(
+		cpuSample{10, []string{"query", "handler", "main"}},
+		cpuSample{5, []string{"render", "handler", "main"}},
+	)
+	slow := cpuProfile(
+		cpuSample{40, []string{"query", "handler", "main"}},
+		cpuSample{5, []string{"render", "handler", "main"}},
+		cpuSample{2, []string{"retry", "query", "handler", "main"}},
+	)
+
+	diff, err := CompareProfiles(slow, base, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "cpu", diff.SampleType)
+	assert.Equal(t, "nanoseconds", diff.Unit)
+	assert.Equal(t, int64(47*time.Millisecond), diff.Total)
+	assert.Equal(t, int64(15*time.Millisecond), diff.BaselineTotal)
+
+	require.Len(t, diff.Functions, 3, "render did not change, and top is 3")
+	query := diff.Functions[0]
+	assert.Equal(t, "query", query.Function)
+	assert.Equal(t, int64(30*time.Millisecond), query.FlatDelta())
+	assert.Equal(t, int64(32*time.Millisecond), query.CumDelta())
+	assert.Equal(t, "retry", diff.Functions[1].Function)
+	assert.Equal(t, int64(2*time.Millisecond), diff.Functions[1].FlatDelta())
+	assert.Equal(t, "handler", diff.Functions[2].Function, "ties on flat are ranked by cum")
+	assert.Zero(t, diff.Functions[2].Flat)
+
+	base.SampleType[1].Type = "wall"
+	_, err = CompareProfiles(slow, base, 3)
+	assert.Error(t, err, "the baseline must have the same sample type")
+}
+
+func TestProfiler_Baselines(t *testing.T) {
+	profiler := NewProfiler(Config{
+		Enabled:          true,
+		LatencyThreshold: 100 * time.Millisecond,
+		Duration:         100 * time.Millisecond,
+		Types:            []ProfileType{ProfileCPU, ProfileHeap, ProfileGoroutine},
+		Dir:              t.TempDir(),
+		Baselines:        BaselinesConfig{Enabled: true, Interval: time.Nanosecond},
+	})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	// Burn CPU on behalf of the route, so that its CPU profiles have samples.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pprof.Do(ctx, pprof.Labels(LabelRoute, "/users"), func(ctx context.Context) {
+		for ctx.Err() == nil {
+		}
+	})
+
+	profiler.ObserveRequest("/users", 10*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Baselines()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	baseline := profiler.Baselines()[0]
+	assert.Equal(t, []ProfileType{ProfileCPU, ProfileHeap}, baseline.Types, "only types that can be compared")
+	assert.Equal(t, PolicyBaselineProfile, baseline.Triggers[0].Policy)
+	assert.Equal(t, "/users", baseline.Triggers[0].Route)
+	assert.Empty(t, profiler.Profiles(), "baselines are kept apart from captures")
+
+	profiler.ObserveRequest("/users", 10*time.Millisecond, false, "")
+	profiler.ObserveRequest("/users", 200*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Profiles()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	capture := profiler.Profiles()[0]
+	require.Len(t, capture.Diffs, 2)
+	cpu, heap := capture.Diffs[0], capture.Diffs[1]
+	assert.Equal(t, ProfileCPU, cpu.Type)
+	assert.Equal(t, "/users", cpu.Route)
+	assert.Equal(t, baseline.ID, cpu.Baseline)
+	assert.Equal(t, "nanoseconds", cpu.Unit)
+	assert.Positive(t, cpu.Total)
+	assert.Positive(t, cpu.BaselineTotal)
+	assert.Equal(t, ProfileHeap, heap.Type)
+	assert.Equal(t, "inuse_space", heap.SampleType)
+
+	assert.Len(t, profiler.Baselines(), 1, "the baseline is fresh")
+	assert.EqualValues(t, 1, profiler.Stats().Baselines)
+}
+
+func TestBaselinesConfig_Validate(t *testing.T) {
+	assert.NoError(t, BaselinesConfig{Enabled: true}.Validate())
+	assert.Error(t, BaselinesConfig{Enabled: true, Top: -1}.Validate())
+	assert.Error(t, Config{Enabled: true, LatencyThreshold: time.Second, Duration: time.Second, Types: []ProfileType{ProfileTrace}, Baselines: BaselinesConfig{Enabled: true}}.Validate(),
+		"no type can be compared")
+}
+
+func TestProfiler_BaselinesWithoutTriggers(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "baselines")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "damaged"), 0o755))
+	index := `[{"id":"damaged","started_at":"` + time.Now().UTC().Format(time.RFC3339) + `","types":["cpu"],"triggers":[]}]`
+	require.NoError(t, os.WriteFile(filepath.Join(root, indexFile), []byte(index), 0o600))
+
+	profiler := NewProfiler(Config{
+		Enabled:          true,
+		LatencyThreshold: 100 * time.Millisecond,
+		Duration:         50 * time.Millisecond,
+		Types:            []ProfileType{ProfileCPU},
+		Dir:              dir,
+		Baselines:        BaselinesConfig{Enabled: true, Interval: time.Nanosecond},
+	})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+	require.Len(t, profiler.Baselines(), 1)
+
+	profiler.ObserveRequest("/users", 10*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Baselines()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	profiler.ObserveRequest("/users", 200*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Profiles()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	_, ok := profiler.baseline("/users")
+	assert.True(t, ok)
+}
+
+func TestProfiler_BaselineDeferredByCapture(t *testing.T) {
+	profiler := NewProfiler(Config{
+		Enabled:          true,
+		LatencyThreshold: 100 * time.Millisecond,
+		Duration:         100 * time.Millisecond,
+		Types:            []ProfileType{ProfileHeap},
+		Dir:              t.TempDir(),
+		Baselines:        BaselinesConfig{Enabled: true, Interval: time.Hour},
+	})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	profiler.ObserveRequest("/slow", 200*time.Millisecond, false, "")
+	profiler.ObserveRequest("/users", 10*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Profiles()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, profiler.Baselines(), "the capture was running")
+
+	profiler.ObserveRequest("/users", 10*time.Millisecond, false, "")
+	require.Eventually(t, func() bool { return len(profiler.Baselines()) == 1 }, 5*time.Second, 10*time.Millisecond,
+		"a turned down baseline does not wait for Interval")
+}
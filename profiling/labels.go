@@ -0,0 +1,33 @@
+package profiling
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/google/pprof/profile"
+)
+
+// FilterByLabel copies the profile read from r to w, keeping only the
+// samples whose label key has the given value, e.g. the samples of one
+// route (LabelRoute) or one trace (LabelTraceID). It returns the number of
+// samples kept.
+func FilterByLabel(r io.Reader, w io.Writer, key, value string) (int, error) {
+	p, err := profile.Parse(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse profile: %w", err)
+	}
+	filterSamples(p, key, value)
+	kept := len(p.Sample)
+	if err := p.Compact().Write(w); err != nil {
+		return 0, fmt.Errorf("failed to write profile: %w", err)
+	}
+	return kept, nil
+}
+
+// filterSamples keeps the samples of p whose label key has the given value.
+func filterSamples(p *profile.Profile, key, value string) {
+	p.Sample = slices.DeleteFunc(p.Sample, func(s *profile.Sample) bool {
+		return !slices.Contains(s.Label[key], value)
+	})
+}
@@ -0,0 +1,58 @@
+package profiling
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labeledProfile builds a CPU profile with one sample per route.
+func labeledProfile(t *testing.T, routes ...string) []byte {
+	t.Helper()
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+	for i, route := range routes {
+		fn := &profile.Function{ID: uint64(i + 1), Name: "handler" + route}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1, 10000000},
+			Label:    map[string][]string{LabelRoute: {route}},
+		})
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	return buf.Bytes()
+}
+
+func TestFilterByLabel(t *testing.T) {
+	in := labeledProfile(t, "/users/{id}", "/orders", "/users/{id}")
+
+	var out bytes.Buffer
+	kept, err := FilterByLabel(bytes.NewReader(in), &out, LabelRoute, "/users/{id}")
+	require.NoError(t, err)
+	assert.Equal(t, 2, kept)
+
+	p, err := profile.Parse(&out)
+	require.NoError(t, err)
+	var samples int64
+	for _, s := range p.Sample {
+		assert.Equal(t, []string{"/users/{id}"}, s.Label[LabelRoute])
+		samples += s.Value[0]
+	}
+	assert.EqualValues(t, 2, samples)
+	for _, fn := range p.Function {
+		assert.NotEqual(t, "handler/orders", fn.Name, "functions of dropped samples are removed")
+	}
+
+	_, err = FilterByLabel(bytes.NewReader([]byte("not a profile")), &out, LabelRoute, "/")
+	assert.Error(t, err)
+}
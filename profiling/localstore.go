@@ -0,0 +1,322 @@
+package profiling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+)
+
+// indexFile is the name of the JSON index in the root of a LocalStore.
+const indexFile = "index.json"
+
+// maxRouteInID caps the part of a capture ID derived from the route.
+const maxRouteInID = 48
+
+// LocalStoreConfig configures a LocalStore.
+type LocalStoreConfig struct {
+	// Root is the directory holding one subdirectory per capture and the
+	// JSON index. It is created if needed.
+	Root string
+	// MaxBytes caps the total size of the stored profiles; the oldest
+	// captures are deleted first. Zero means unlimited.
+	MaxBytes int64
+	// MaxAge deletes captures older than this. Zero keeps them forever.
+	MaxAge time.Duration
+}
+
+// LocalStore keeps profiles in a local directory, one subdirectory per
+// capture, and lists them in index.json. Other files and directories in the
+// root are left alone.
+type LocalStore struct {
+	root string
+
+	mu       sync.Mutex
+	maxBytes int64
+	maxAge   time.Duration
+	entries  []IndexEntry // oldest first
+	pending  map[string]bool
+}
+
+// NewLocalStore opens the store in config.Root, loading its index.
+// Captures listed in the index with an invalid ID, or whose directory is
+// gone, are dropped.
+func NewLocalStore(config LocalStoreConfig) (*LocalStore, error) {
+	if config.Root == "" {
+		return nil, errors.New("profile store root must not be empty")
+	}
+	if err := os.MkdirAll(config.Root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create profile store root: %w", err)
+	}
+	s := &LocalStore{root: config.Root, maxBytes: config.MaxBytes, maxAge: config.MaxAge, pending: make(map[string]bool)}
+
+	data, err := os.ReadFile(filepath.Join(s.root, indexFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read profile index: %w", err)
+	default:
+		if err := json.Unmarshal(data, &s.entries); err != nil {
+			logging.Warnf("Profile store: Ignoring unreadable index %s: %v", filepath.Join(s.root, indexFile), err)
+			s.entries = nil
+		}
+	}
+	kept := s.entries[:0]
+	for _, e := range s.entries {
+		if !validID(e.ID) {
+			logging.Warnf("Profile store: Ignoring index entry with invalid ID %q.", e.ID)
+			continue
+		}
+		if _, err := os.Stat(s.dir(e.ID)); err == nil {
+			kept = append(kept, e)
+		}
+	}
+	s.entries = kept
+	sort.SliceStable(s.entries, func(i, j int) bool { return s.entries[i].StartedAt.Before(s.entries[j].StartedAt) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforceLimits(time.Now())
+	if err := s.writeIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetLimits replaces MaxBytes and MaxAge and applies them immediately.
+func (s *LocalStore) SetLimits(maxBytes int64, maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxBytes, s.maxAge = maxBytes, maxAge
+	if s.enforceLimits(time.Now()) {
+		s.saveIndex()
+	}
+}
+
+func (s *LocalStore) Begin(route string, at time.Time) (string, error) {
+	base := at.UTC().Format("20060102T150405.000000000Z") + "_" + safeName(route)
+	id := base
+	for n := 2; ; n++ {
+		err := os.Mkdir(s.dir(id), 0o755)
+		if err == nil {
+			s.mu.Lock()
+			s.pending[id] = true
+			s.mu.Unlock()
+			return id, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to create profile directory: %w", err)
+		}
+		id = fmt.Sprintf("%s_%d", base, n)
+	}
+}
+
+func (s *LocalStore) Create(id string, t ProfileType) (io.WriteCloser, error) {
+	if !validID(id) || !t.Valid() {
+		return nil, ErrNotFound
+	}
+	return os.Create(filepath.Join(s.dir(id), t.fileName()))
+}
+
+func (s *LocalStore) Commit(entry IndexEntry) error {
+	if !validID(entry.ID) {
+		return ErrNotFound
+	}
+	files, err := os.ReadDir(s.dir(entry.ID))
+	if err != nil {
+		return fmt.Errorf("failed to read profile directory: %w", err)
+	}
+	keep := make(map[string]bool, len(entry.Types))
+	for _, t := range entry.Types {
+		keep[t.fileName()] = true
+	}
+	entry.Bytes = 0
+	for _, f := range files {
+		name := filepath.Join(s.dir(entry.ID), f.Name())
+		if !keep[f.Name()] {
+			os.RemoveAll(name)
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			entry.Bytes += info.Size()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, entry.ID)
+	s.entries = append(s.entries, entry)
+	sort.SliceStable(s.entries, func(i, j int) bool { return s.entries[i].StartedAt.Before(s.entries[j].StartedAt) })
+	s.enforceLimits(time.Now())
+	return s.writeIndex()
+}
+
+func (s *LocalStore) List() []IndexEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enforceLimits(time.Now()) {
+		s.saveIndex()
+	}
+	out := make([]IndexEntry, 0, len(s.entries))
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		out = append(out, s.entries[i])
+	}
+	return out
+}
+
+func (s *LocalStore) Get(id string) (IndexEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return IndexEntry{}, false
+	}
+	return s.entries[i], true
+}
+
+func (s *LocalStore) Open(id string, t ProfileType) (io.ReadCloser, error) {
+	entry, ok := s.Get(id)
+	if !ok || !slices.Contains(entry.Types, t) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(filepath.Join(s.dir(id), t.fileName()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStore) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 && !s.pending[id] {
+		return ErrNotFound
+	}
+	if err := os.RemoveAll(s.dir(id)); err != nil {
+		return fmt.Errorf("failed to delete profile: %w", err)
+	}
+	if i < 0 {
+		delete(s.pending, id)
+		return nil
+	}
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	return s.writeIndex()
+}
+
+// enforceLimits deletes captures beyond MaxAge and MaxBytes, oldest first,
+// and reports whether any was deleted. The caller must hold mu.
+func (s *LocalStore) enforceLimits(now time.Time) bool {
+	var total int64
+	for _, e := range s.entries {
+		total += e.Bytes
+	}
+	removed := 0
+	for len(s.entries) > 0 {
+		oldest := s.entries[0]
+		expired := s.maxAge > 0 && now.Sub(oldest.StartedAt) > s.maxAge
+		over := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !over {
+			break
+		}
+		if err := os.RemoveAll(s.dir(oldest.ID)); err != nil {
+			logging.Warnf("Profile store: Error deleting %s: %v", oldest.ID, err)
+		}
+		total -= oldest.Bytes
+		s.entries = s.entries[1:]
+		removed++
+	}
+	if removed > 0 {
+		logging.Debugf("Profile store: Deleted %d captures over the size or age limit.", removed)
+	}
+	return removed > 0
+}
+
+// saveIndex writes the index, logging failures. The caller must hold mu.
+func (s *LocalStore) saveIndex() {
+	if err := s.writeIndex(); err != nil {
+		logging.Errorf("Profile store: %v", err)
+	}
+}
+
+// writeIndex replaces index.json atomically. The caller must hold mu.
+func (s *LocalStore) writeIndex() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode profile index: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.root, indexFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write profile index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write profile index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write profile index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.root, indexFile)); err != nil {
+		return fmt.Errorf("failed to write profile index: %w", err)
+	}
+	return nil
+}
+
+// find returns the position of a capture in entries, or -1. The caller
+// must hold mu.
+func (s *LocalStore) find(id string) int {
+	for i, e := range s.entries {
+		if e.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *LocalStore) dir(id string) string {
+	return filepath.Join(s.root, id)
+}
+
+// safeName turns a route into a file name fragment: ASCII letters, digits,
+// '-' and '.' are kept, runs of anything else become a single '_'.
+func safeName(route string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range route {
+		if r < 128 && (r == '-' || r == '.' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	name := strings.Trim(b.String(), "_.")
+	if len(name) > maxRouteInID {
+		name = name[:maxRouteInID]
+	}
+	if name == "" {
+		name = "root"
+	}
+	return name
+}
+
+// validID rejects IDs that could escape the store root.
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`) && id != indexFile
+}
@@ -0,0 +1,181 @@
+package profiling
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// saveCapture stores a capture of route with one profile per type, each
+// holding size bytes.
+func saveCapture(t *testing.T, store *LocalStore, route string, at time.Time, size int, types ...ProfileType) string {
+	t.Helper()
+	id, err := store.Begin(route, at)
+	require.NoError(t, err)
+	for _, typ := range types {
+		w, err := store.Create(id, typ)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(strings.Repeat("x", size)))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	require.NoError(t, store.Commit(IndexEntry{ID: id, StartedAt: at, Types: types, Triggers: []Trigger{{Route: route}}}))
+	return id
+}
+
+func TestLocalStore(t *testing.T) {
+	t.Run("should give captures safe and unique IDs", func(t *testing.T) {
+		store := newTestStore(t)
+		at := time.Now()
+
+		first, err := store.Begin("/users/{id}?q=a b", at)
+		require.NoError(t, err)
+		second, err := store.Begin("/users/{id}?q=a b", at)
+		require.NoError(t, err)
+
+		assert.NotEqual(t, first, second, "captures started at the same time do not overwrite each other")
+		assert.Regexp(t, `^[0-9TZ.]+_users_id_q_a_b$`, first)
+		assert.True(t, validID(first))
+		assert.DirExists(t, store.dir(first))
+
+		long, err := store.Begin("/"+strings.Repeat("a", 200), at)
+		require.NoError(t, err)
+		assert.Less(t, len(long), 100)
+		root, err := store.Begin("/", at)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(root, "_root"))
+	})
+
+	t.Run("should list committed captures only, newest first", func(t *testing.T) {
+		store := newTestStore(t)
+		old := saveCapture(t, store, "/a", time.Now().Add(-time.Minute), 10, ProfileCPU)
+		recent := saveCapture(t, store, "/b", time.Now(), 10, ProfileCPU, ProfileHeap)
+		_, err := store.Begin("/pending", time.Now())
+		require.NoError(t, err)
+
+		entries := store.List()
+		require.Len(t, entries, 2)
+		assert.Equal(t, recent, entries[0].ID)
+		assert.Equal(t, old, entries[1].ID)
+		assert.EqualValues(t, 20, entries[0].Bytes)
+	})
+
+	t.Run("should open profiles of committed types only", func(t *testing.T) {
+		store := newTestStore(t)
+		id, err := store.Begin("/a", time.Now())
+		require.NoError(t, err)
+		for _, typ := range []ProfileType{ProfileCPU, ProfileHeap} {
+			w, err := store.Create(id, typ)
+			require.NoError(t, err)
+			io.WriteString(w, string(typ))
+			w.Close()
+		}
+		require.NoError(t, store.Commit(IndexEntry{ID: id, StartedAt: time.Now(), Types: []ProfileType{ProfileCPU}}))
+
+		r, err := store.Open(id, ProfileCPU)
+		require.NoError(t, err)
+		data, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "cpu", string(data))
+
+		_, err = store.Open(id, ProfileHeap)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.NoFileExists(t, filepath.Join(store.dir(id), ProfileHeap.fileName()), "uncommitted profiles are discarded")
+		_, err = store.Open("../"+id, ProfileCPU)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should delete captures", func(t *testing.T) {
+		store := newTestStore(t)
+		id := saveCapture(t, store, "/a", time.Now(), 10, ProfileCPU)
+
+		require.NoError(t, store.Delete(id))
+		assert.NoDirExists(t, store.dir(id))
+		assert.Empty(t, store.List())
+		assert.ErrorIs(t, store.Delete(id), ErrNotFound)
+		assert.ErrorIs(t, store.Delete(".."), ErrNotFound)
+	})
+
+	t.Run("should delete only its own captures", func(t *testing.T) {
+		store := newTestStore(t)
+		require.NoError(t, os.Mkdir(filepath.Join(store.root, "data"), 0o755))
+		assert.ErrorIs(t, store.Delete("data"), ErrNotFound)
+		assert.DirExists(t, filepath.Join(store.root, "data"))
+
+		id, err := store.Begin("/a", time.Now())
+		require.NoError(t, err)
+		require.NoError(t, store.Delete(id), "captures begun but not committed")
+		assert.NoDirExists(t, store.dir(id))
+	})
+
+	t.Run("should evict the oldest captures over MaxBytes", func(t *testing.T) {
+		store, err := NewLocalStore(LocalStoreConfig{Root: t.TempDir(), MaxBytes: 250})
+		require.NoError(t, err)
+		now := time.Now()
+		first := saveCapture(t, store, "/a", now.Add(-3*time.Second), 100, ProfileCPU)
+		second := saveCapture(t, store, "/b", now.Add(-2*time.Second), 100, ProfileCPU)
+		third := saveCapture(t, store, "/c", now.Add(-time.Second), 100, ProfileCPU)
+
+		entries := store.List()
+		require.Len(t, entries, 2)
+		assert.Equal(t, third, entries[0].ID)
+		assert.Equal(t, second, entries[1].ID)
+		assert.NoDirExists(t, store.dir(first))
+	})
+
+	t.Run("should evict captures older than MaxAge", func(t *testing.T) {
+		store, err := NewLocalStore(LocalStoreConfig{Root: t.TempDir(), MaxAge: time.Hour})
+		require.NoError(t, err)
+		expired := saveCapture(t, store, "/a", time.Now().Add(-2*time.Hour), 10, ProfileCPU)
+		fresh := saveCapture(t, store, "/b", time.Now(), 10, ProfileCPU)
+
+		entries := store.List()
+		require.Len(t, entries, 1)
+		assert.Equal(t, fresh, entries[0].ID)
+		assert.NoDirExists(t, store.dir(expired))
+
+		store.SetLimits(0, time.Nanosecond)
+		assert.Empty(t, store.List())
+	})
+
+	t.Run("should reload its index", func(t *testing.T) {
+		root := t.TempDir()
+		store, err := NewLocalStore(LocalStoreConfig{Root: root})
+		require.NoError(t, err)
+		kept := saveCapture(t, store, "/a", time.Now().Add(-time.Second), 10, ProfileCPU)
+		removed := saveCapture(t, store, "/b", time.Now(), 10, ProfileCPU)
+		require.NoError(t, os.RemoveAll(store.dir(removed)))
+
+		reopened, err := NewLocalStore(LocalStoreConfig{Root: root})
+		require.NoError(t, err)
+		entries := reopened.List()
+		require.Len(t, entries, 1, "captures whose directory is gone are dropped")
+		assert.Equal(t, kept, entries[0].ID)
+		assert.Equal(t, []Trigger{{Route: "/a"}}, entries[0].Triggers)
+	})
+
+	t.Run("should drop index entries with invalid IDs", func(t *testing.T) {
+		parent := t.TempDir()
+		root := filepath.Join(parent, "profiles")
+		require.NoError(t, os.Mkdir(root, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(parent, "keep"), nil, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(root, "keep"), nil, 0o600))
+		old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+		index := `[{"id":"","started_at":"` + old + `","bytes":100},{"id":"..","started_at":"` + old + `","bytes":100}]`
+		require.NoError(t, os.WriteFile(filepath.Join(root, indexFile), []byte(index), 0o600))
+
+		store, err := NewLocalStore(LocalStoreConfig{Root: root, MaxAge: time.Hour})
+		require.NoError(t, err)
+		assert.Empty(t, store.List())
+		store.SetLimits(1, time.Nanosecond)
+
+		assert.FileExists(t, filepath.Join(root, "keep"))
+		assert.FileExists(t, filepath.Join(parent, "keep"))
+	})
+}
@@ -0,0 +1,448 @@
+package profiling
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Policy decides when a capture starts. A policy implements RequestPolicy,
+// RuntimePolicy or both; the profiler asks every configured policy and
+// captures when any of them fires. Implementations must be safe for
+// concurrent use.
+type Policy interface {
+	// Name identifies the policy in captured triggers, e.g. "percentile".
+	Name() string
+}
+
+// RequestPolicy is fed every finished server request.
+type RequestPolicy interface {
+	Policy
+	// ObserveRequest records r and reports whether a capture should start,
+	// with a human-readable reason.
+	ObserveRequest(r Request) (reason string, fire bool)
+}
+
+// RuntimePolicy is fed every runtime statistics sample.
+type RuntimePolicy interface {
+	Policy
+	// ObserveRuntime records s and reports whether a capture should start,
+	// with a human-readable reason.
+	ObserveRuntime(s RuntimeStats) (reason string, fire bool)
+}
+
+// statefulPolicy is a policy that learns from the requests or samples it
+// sees. When the configuration changes, the new policy of the same name
+// takes over the state of the old one, so that editing a threshold does not
+// forget the windows and baselines collected so far.
+type statefulPolicy interface {
+	Policy
+	adopt(old Policy)
+}
+
+// carryState hands the state of the stateful policies of old to the
+// policies of the same name in policies.
+func carryState(old, policies []Policy) {
+	for _, policy := range policies {
+		s, ok := policy.(statefulPolicy)
+		if !ok {
+			continue
+		}
+		for _, o := range old {
+			if o, ok := o.(statefulPolicy); ok && o != s && o.Name() == s.Name() {
+				s.adopt(o)
+				break
+			}
+		}
+	}
+}
+
+// Request is a finished server request.
+type Request struct {
+	Route   string
+	Latency time.Duration
+	Failed  bool
+	TraceID string
+	At      time.Time
+}
+
+// RuntimeStats is a sample of the runtime statistics policies can act on.
+type RuntimeStats struct {
+	Goroutines uint64
+	// HeapAlloc is the size of live heap objects.
+	HeapAlloc uint64
+	At        time.Time
+}
+
+// Names of the built-in policies.
+const (
+	PolicyThreshold  = "threshold"
+	PolicyPercentile = "percentile"
+	PolicyBaseline   = "baseline"
+	PolicyErrorRate  = "error_rate"
+	PolicyGoroutines = "goroutines"
+	PolicyHeapGrowth = "heap_growth"
+)
+
+// maxWindowSamples caps the requests a windowed policy keeps per route.
+// Older requests are dropped first, so under heavy load the window is
+// shorter than configured.
+const maxWindowSamples = 1024
+
+// ThresholdPolicy fires when a single request is slower than its route's
+// threshold.
+type ThresholdPolicy struct {
+	// Default applies to routes missing from Routes.
+	Default time.Duration
+	Routes  map[string]time.Duration
+}
+
+func (p ThresholdPolicy) Name() string { return PolicyThreshold }
+
+func (p ThresholdPolicy) Validate() error {
+	if p.Default <= 0 {
+		return errors.New("latency threshold must be positive")
+	}
+	for route, threshold := range p.Routes {
+		if threshold <= 0 {
+			return fmt.Errorf("latency threshold of route %q must be positive", route)
+		}
+	}
+	return nil
+}
+
+func (p ThresholdPolicy) ObserveRequest(r Request) (string, bool) {
+	threshold, ok := p.Routes[r.Route]
+	if !ok {
+		threshold = p.Default
+	}
+	if r.Latency < threshold {
+		return "", false
+	}
+	return fmt.Sprintf("latency %s exceeds %s", r.Latency, threshold), true
+}
+
+// PercentilePolicy fires when a latency percentile of a route, over the
+// requests of the last Window, exceeds Threshold.
+type PercentilePolicy struct {
+	// Percentile is in (0, 100], e.g. 95 for p95.
+	Percentile float64
+	Threshold  time.Duration
+	Window     time.Duration
+	// MinSamples is the number of requests in the window below which the
+	// policy does not fire.
+	MinSamples int
+
+	windows routeWindows
+}
+
+func (p *PercentilePolicy) Name() string { return PolicyPercentile }
+
+func (p *PercentilePolicy) Validate() error {
+	if p.Percentile <= 0 || p.Percentile > 100 {
+		return errors.New("percentile must be in (0, 100]")
+	}
+	if p.Threshold <= 0 {
+		return errors.New("percentile threshold must be positive")
+	}
+	if p.Window <= 0 {
+		return errors.New("percentile window must be positive")
+	}
+	if p.MinSamples < 1 {
+		return errors.New("percentile min samples must be at least 1")
+	}
+	return nil
+}
+
+func (p *PercentilePolicy) adopt(old Policy) {
+	if o, ok := old.(*PercentilePolicy); ok {
+		p.windows.adopt(&o.windows)
+	}
+}
+
+func (p *PercentilePolicy) ObserveRequest(r Request) (string, bool) {
+	var (
+		value time.Duration
+		count int
+	)
+	p.windows.observe(r, p.Window, func(w *requestWindow) {
+		count = len(w.requests)
+		if count >= p.MinSamples {
+			value = w.percentile(p.Percentile)
+		}
+	})
+	if count < p.MinSamples || value < p.Threshold {
+		return "", false
+	}
+	return fmt.Sprintf("p%g %s over %d requests exceeds %s", p.Percentile, value, count, p.Threshold), true
+}
+
+// BaselinePolicy fires when a request is Multiple times slower than its
+// route's baseline, an exponentially weighted moving average of latency.
+type BaselinePolicy struct {
+	Multiple float64
+	// MinSamples is the number of requests a route needs before its
+	// baseline is trusted.
+	MinSamples int
+
+	mu        sync.Mutex
+	baselines routeCache[*baseline]
+}
+
+// baselineWeight is the weight of the newest request in a baseline. With
+// 0.05, the last ~20 requests dominate.
+const baselineWeight = 0.05
+
+type baseline struct {
+	mean  float64
+	count int
+}
+
+func (p *BaselinePolicy) Name() string { return PolicyBaseline }
+
+func (p *BaselinePolicy) Validate() error {
+	if p.Multiple <= 1 {
+		return errors.New("baseline multiple must be greater than 1")
+	}
+	if p.MinSamples < 1 {
+		return errors.New("baseline min samples must be at least 1")
+	}
+	return nil
+}
+
+func (p *BaselinePolicy) adopt(old Policy) {
+	o, ok := old.(*BaselinePolicy)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	baselines := o.baselines
+	o.baselines = routeCache[*baseline]{}
+	o.mu.Unlock()
+
+	p.mu.Lock()
+	p.baselines = baselines
+	p.mu.Unlock()
+}
+
+func (p *BaselinePolicy) ObserveRequest(r Request) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.baselines.get(r.Route)
+	if !ok {
+		b = &baseline{}
+		p.baselines.put(r.Route, b)
+	}
+	current := time.Duration(b.mean)
+	trusted := b.count >= p.MinSamples
+	b.count++
+	// The first requests are averaged evenly, so that none of them
+	// dominates the baseline.
+	b.mean += max(1/float64(b.count), baselineWeight) * (float64(r.Latency) - b.mean)
+
+	if !trusted || current <= 0 || float64(r.Latency) < p.Multiple*float64(current) {
+		return "", false
+	}
+	return fmt.Sprintf("latency %s is %.1fx the baseline of %s", r.Latency, float64(r.Latency)/float64(current), current), true
+}
+
+// ErrorRatePolicy fires when the share of failed requests of a route, over
+// the last Window, reaches Rate.
+type ErrorRatePolicy struct {
+	// Rate is in (0, 1], e.g. 0.2 for 20% of requests failing.
+	Rate       float64
+	Window     time.Duration
+	MinSamples int
+
+	windows routeWindows
+}
+
+func (p *ErrorRatePolicy) Name() string { return PolicyErrorRate }
+
+func (p *ErrorRatePolicy) Validate() error {
+	if p.Rate <= 0 || p.Rate > 1 {
+		return errors.New("error rate must be in (0, 1]")
+	}
+	if p.Window <= 0 {
+		return errors.New("error rate window must be positive")
+	}
+	if p.MinSamples < 1 {
+		return errors.New("error rate min samples must be at least 1")
+	}
+	return nil
+}
+
+func (p *ErrorRatePolicy) adopt(old Policy) {
+	if o, ok := old.(*ErrorRatePolicy); ok {
+		p.windows.adopt(&o.windows)
+	}
+}
+
+func (p *ErrorRatePolicy) ObserveRequest(r Request) (string, bool) {
+	var total, failed int
+	p.windows.observe(r, p.Window, func(w *requestWindow) {
+		total, failed = len(w.requests), w.failed
+	})
+	// Only a failing request fires, so the capture covers the failures.
+	if !r.Failed || total < p.MinSamples {
+		return "", false
+	}
+	rate := float64(failed) / float64(total)
+	if rate < p.Rate {
+		return "", false
+	}
+	return fmt.Sprintf("%d of %d requests failed (%.0f%%)", failed, total, rate*100), true
+}
+
+// GoroutinePolicy fires while the number of goroutines is at least Max.
+type GoroutinePolicy struct {
+	Max uint64
+}
+
+func (p GoroutinePolicy) Name() string { return PolicyGoroutines }
+
+func (p GoroutinePolicy) Validate() error {
+	if p.Max == 0 {
+		return errors.New("goroutine limit must be positive")
+	}
+	return nil
+}
+
+func (p GoroutinePolicy) ObserveRuntime(s RuntimeStats) (string, bool) {
+	if s.Goroutines < p.Max {
+		return "", false
+	}
+	return fmt.Sprintf("%d goroutines reach the limit of %d", s.Goroutines, p.Max), true
+}
+
+// HeapGrowthPolicy fires when the live heap grew by Ratio over the lowest
+// sample of the last Window, e.g. 0.5 for 50% growth.
+type HeapGrowthPolicy struct {
+	Ratio  float64
+	Window time.Duration
+
+	mu      sync.Mutex
+	samples []RuntimeStats
+}
+
+func (p *HeapGrowthPolicy) Name() string { return PolicyHeapGrowth }
+
+func (p *HeapGrowthPolicy) Validate() error {
+	if p.Ratio <= 0 {
+		return errors.New("heap growth ratio must be positive")
+	}
+	if p.Window <= 0 {
+		return errors.New("heap growth window must be positive")
+	}
+	return nil
+}
+
+func (p *HeapGrowthPolicy) adopt(old Policy) {
+	o, ok := old.(*HeapGrowthPolicy)
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	samples := o.samples
+	o.samples = nil
+	o.mu.Unlock()
+
+	p.mu.Lock()
+	p.samples = samples
+	p.mu.Unlock()
+}
+
+func (p *HeapGrowthPolicy) ObserveRuntime(s RuntimeStats) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cutoff := s.At.Add(-p.Window)
+	i := 0
+	for i < len(p.samples) && p.samples[i].At.Before(cutoff) {
+		i++
+	}
+	p.samples = append(p.samples[i:], s)
+
+	lowest := s.HeapAlloc
+	for _, sample := range p.samples {
+		lowest = min(lowest, sample.HeapAlloc)
+	}
+	if lowest == 0 || float64(s.HeapAlloc) < float64(lowest)*(1+p.Ratio) {
+		return "", false
+	}
+	return fmt.Sprintf("heap grew from %d to %d bytes within %s", lowest, s.HeapAlloc, p.Window), true
+}
+
+// routeWindows keeps the requests of the last window per route, for up to
+// maxTrackedRoutes routes.
+type routeWindows struct {
+	mu     sync.Mutex
+	routes routeCache[*requestWindow]
+}
+
+// requestWindow holds the requests of one route, with their latencies kept
+// sorted and their failures counted as requests enter and leave, so that
+// policies read them without scanning the window.
+type requestWindow struct {
+	requests  []Request       // oldest first
+	latencies []time.Duration // of requests, ascending
+	failed    int
+}
+
+// observe adds r to its route's window, drops requests older than window
+// and calls fn with the window while holding the lock.
+func (w *routeWindows) observe(r Request, window time.Duration, fn func(*requestWindow)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rw, ok := w.routes.get(r.Route)
+	if !ok {
+		rw = &requestWindow{}
+		w.routes.put(r.Route, rw)
+	}
+	rw.add(r, window)
+	fn(rw)
+}
+
+// adopt takes over the windows of old.
+func (w *routeWindows) adopt(old *routeWindows) {
+	old.mu.Lock()
+	routes := old.routes
+	old.routes = routeCache[*requestWindow]{}
+	old.mu.Unlock()
+
+	w.mu.Lock()
+	w.routes = routes
+	w.mu.Unlock()
+}
+
+// add appends r and drops the requests older than window, and the oldest
+// beyond maxWindowSamples.
+func (w *requestWindow) add(r Request, window time.Duration) {
+	cutoff := r.At.Add(-window)
+	i := max(len(w.requests)+1-maxWindowSamples, 0)
+	for i < len(w.requests) && w.requests[i].At.Before(cutoff) {
+		i++
+	}
+	for _, old := range w.requests[:i] {
+		j, _ := slices.BinarySearch(w.latencies, old.Latency)
+		w.latencies = slices.Delete(w.latencies, j, j+1)
+		if old.Failed {
+			w.failed--
+		}
+	}
+	w.requests = append(w.requests[i:], r)
+	j, _ := slices.BinarySearch(w.latencies, r.Latency)
+	w.latencies = slices.Insert(w.latencies, j, r.Latency)
+	if r.Failed {
+		w.failed++
+	}
+}
+
+// percentile returns the latency at percentile p, in (0, 100], of a
+// non-empty window.
+func (w *requestWindow) percentile(p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(w.latencies)))) - 1
+	return w.latencies[max(rank, 0)]
+}
@@ -0,0 +1,201 @@
+package profiling
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThresholdPolicy(t *testing.T) {
+	policy := ThresholdPolicy{Default: 500 * time.Millisecond, Routes: map[string]time.Duration{"/reports": 2 * time.Second}}
+	require.NoError(t, policy.Validate())
+
+	_, fire := policy.ObserveRequest(Request{Route: "/users", Latency: 400 * time.Millisecond})
+	assert.False(t, fire)
+	reason, fire := policy.ObserveRequest(Request{Route: "/users", Latency: 600 * time.Millisecond})
+	assert.True(t, fire)
+	assert.Equal(t, "latency 600ms exceeds 500ms", reason)
+	_, fire = policy.ObserveRequest(Request{Route: "/reports", Latency: time.Second})
+	assert.False(t, fire, "the route threshold overrides the default")
+
+	assert.Error(t, ThresholdPolicy{Default: time.Second, Routes: map[string]time.Duration{"/x": 0}}.Validate())
+}
+
+func TestPercentilePolicy(t *testing.T) {
+	t.Run("should fire when the percentile over the window is slow", func(t *testing.T) {
+		policy := &PercentilePolicy{Percentile: 90, Threshold: 100 * time.Millisecond, Window: time.Minute, MinSamples: 10}
+		require.NoError(t, policy.Validate())
+		now := time.Now()
+
+		// A single outlier among fast requests does not move p90.
+		for i := 0; i < 19; i++ {
+			_, fire := policy.ObserveRequest(Request{Route: "/a", Latency: 10 * time.Millisecond, At: now})
+			require.False(t, fire)
+		}
+		_, fire := policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: now})
+		assert.False(t, fire)
+
+		// A steady degradation does.
+		var reason string
+		for i := 0; i < 3 && !fire; i++ {
+			reason, fire = policy.ObserveRequest(Request{Route: "/a", Latency: 200 * time.Millisecond, At: now})
+		}
+		assert.True(t, fire)
+		assert.Contains(t, reason, "p90 200ms over 22 requests exceeds 100ms")
+	})
+
+	t.Run("should wait for MinSamples and forget requests outside the window", func(t *testing.T) {
+		policy := &PercentilePolicy{Percentile: 50, Threshold: 100 * time.Millisecond, Window: time.Minute, MinSamples: 3}
+		start := time.Now()
+
+		policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: start})
+		_, fire := policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: start})
+		assert.False(t, fire, "too few requests")
+		_, fire = policy.ObserveRequest(Request{Route: "/b", Latency: time.Second, At: start})
+		assert.False(t, fire, "routes have separate windows")
+
+		later := start.Add(2 * time.Minute)
+		policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: later})
+		_, fire = policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: later})
+		assert.False(t, fire, "old requests left the window")
+		_, fire = policy.ObserveRequest(Request{Route: "/a", Latency: time.Second, At: later})
+		assert.True(t, fire)
+	})
+}
+
+func TestBaselinePolicy(t *testing.T) {
+	policy := &BaselinePolicy{Multiple: 3, MinSamples: 5}
+	require.NoError(t, policy.Validate())
+
+	_, fire := policy.ObserveRequest(Request{Route: "/a", Latency: time.Second})
+	assert.False(t, fire, "no baseline yet")
+	for i := 0; i < 5; i++ {
+		_, fire := policy.ObserveRequest(Request{Route: "/a", Latency: 100 * time.Millisecond})
+		require.False(t, fire)
+	}
+	_, fire = policy.ObserveRequest(Request{Route: "/b", Latency: time.Second})
+	assert.False(t, fire, "routes have separate baselines")
+
+	reason, fire := policy.ObserveRequest(Request{Route: "/a", Latency: 2 * time.Second})
+	assert.True(t, fire)
+	assert.Contains(t, reason, "the baseline of")
+
+	assert.Error(t, (&BaselinePolicy{Multiple: 1, MinSamples: 1}).Validate())
+}
+
+func TestErrorRatePolicy(t *testing.T) {
+	policy := &ErrorRatePolicy{Rate: 0.5, Window: time.Minute, MinSamples: 4}
+	require.NoError(t, policy.Validate())
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		policy.ObserveRequest(Request{Route: "/a", At: now})
+	}
+	_, fire := policy.ObserveRequest(Request{Route: "/a", Failed: true, At: now})
+	assert.False(t, fire, "too few requests")
+	reason, fire := policy.ObserveRequest(Request{Route: "/a", Failed: true, At: now})
+	assert.True(t, fire)
+	assert.Equal(t, "2 of 4 requests failed (50%)", reason)
+
+	_, fire = policy.ObserveRequest(Request{Route: "/a", At: now})
+	assert.False(t, fire, "only failing requests fire")
+}
+
+func TestRuntimePolicies(t *testing.T) {
+	t.Run("goroutines", func(t *testing.T) {
+		policy := GoroutinePolicy{Max: 100}
+		_, fire := policy.ObserveRuntime(RuntimeStats{Goroutines: 99})
+		assert.False(t, fire)
+		reason, fire := policy.ObserveRuntime(RuntimeStats{Goroutines: 150})
+		assert.True(t, fire)
+		assert.Equal(t, "150 goroutines reach the limit of 100", reason)
+	})
+
+	t.Run("heap growth", func(t *testing.T) {
+		policy := &HeapGrowthPolicy{Ratio: 0.5, Window: time.Minute}
+		require.NoError(t, policy.Validate())
+		start := time.Now()
+
+		_, fire := policy.ObserveRuntime(RuntimeStats{HeapAlloc: 100, At: start})
+		assert.False(t, fire)
+		_, fire = policy.ObserveRuntime(RuntimeStats{HeapAlloc: 140, At: start.Add(10 * time.Second)})
+		assert.False(t, fire)
+		_, fire = policy.ObserveRuntime(RuntimeStats{HeapAlloc: 150, At: start.Add(20 * time.Second)})
+		assert.True(t, fire)
+
+		_, fire = policy.ObserveRuntime(RuntimeStats{HeapAlloc: 160, At: start.Add(90 * time.Second)})
+		assert.False(t, fire, "growth is measured within the window only")
+	})
+}
+
+func TestProfiler_UpdateConfigKeepsPolicyState(t *testing.T) {
+	percentile := &PercentilePolicy{Percentile: 50, Threshold: time.Second, Window: time.Minute, MinSamples: 3}
+	baseline := &BaselinePolicy{Multiple: 3, MinSamples: 3}
+	cfg := Config{
+		Enabled:          true,
+		LatencyThreshold: time.Hour,
+		Duration:         50 * time.Millisecond,
+		Types:            []ProfileType{ProfileHeap},
+		Dir:              t.TempDir(),
+		Policies:         []Policy{ThresholdPolicy{Default: time.Hour}, percentile, baseline},
+	}
+	profiler := NewProfiler(cfg)
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+	for i := 0; i < 3; i++ {
+		profiler.ObserveRequest("/a", 200*time.Millisecond, false, "")
+	}
+
+	// Only the percentile threshold changes.
+	rebuilt := &PercentilePolicy{Percentile: 50, Threshold: 100 * time.Millisecond, Window: time.Minute, MinSamples: 3}
+	fresh := &BaselinePolicy{Multiple: 3, MinSamples: 3}
+	cfg.Policies = []Policy{ThresholdPolicy{Default: time.Hour}, rebuilt, fresh}
+	require.NoError(t, profiler.UpdateConfig(cfg))
+
+	reason, fire := rebuilt.ObserveRequest(Request{Route: "/a", Latency: 200 * time.Millisecond, At: time.Now()})
+	assert.True(t, fire, "the window of the old policy carries over")
+	assert.Contains(t, reason, "over 4 requests")
+	_, fire = fresh.ObserveRequest(Request{Route: "/a", Latency: time.Second})
+	assert.True(t, fire, "so does the baseline")
+}
+
+func TestRouteWindows(t *testing.T) {
+	t.Run("should keep latencies sorted as requests leave", func(t *testing.T) {
+		var w requestWindow
+		start := time.Now()
+		for i, ms := range []int{50, 10, 40, 30, 20} {
+			w.add(Request{Latency: time.Duration(ms) * time.Millisecond, Failed: ms >= 40, At: start.Add(time.Duration(i) * time.Second)}, time.Minute)
+		}
+		assert.Equal(t, 30*time.Millisecond, w.percentile(50))
+		assert.Equal(t, 50*time.Millisecond, w.percentile(100))
+		assert.Equal(t, 2, w.failed)
+
+		// The first three requests leave the window.
+		w.add(Request{Latency: 60 * time.Millisecond, At: start.Add(63 * time.Second)}, time.Minute)
+		assert.Equal(t, []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 60 * time.Millisecond}, w.latencies)
+		assert.Zero(t, w.failed)
+
+		for i := 0; i < maxWindowSamples; i++ {
+			w.add(Request{Latency: time.Millisecond, At: start.Add(63 * time.Second)}, time.Minute)
+		}
+		assert.Len(t, w.latencies, maxWindowSamples)
+		assert.Equal(t, time.Millisecond, w.percentile(100))
+	})
+
+	t.Run("should track up to maxTrackedRoutes routes", func(t *testing.T) {
+		percentile := &PercentilePolicy{Percentile: 50, Threshold: time.Second, Window: time.Minute, MinSamples: 1}
+		baseline := &BaselinePolicy{Multiple: 3, MinSamples: 1}
+		for i := 0; i < maxTrackedRoutes+10; i++ {
+			r := Request{Route: fmt.Sprintf("/users/%d", i), Latency: time.Millisecond, At: time.Now()}
+			percentile.ObserveRequest(r)
+			baseline.ObserveRequest(r)
+		}
+		assert.Equal(t, maxTrackedRoutes, percentile.windows.routes.len())
+		assert.Equal(t, maxTrackedRoutes, baseline.baselines.len())
+		_, ok := percentile.windows.routes.get("/users/0")
+		assert.False(t, ok, "the oldest route is forgotten")
+	})
+}
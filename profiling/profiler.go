@@ -1,85 +1,437 @@
 package profiling
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"runtime/pprof"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
 )
 
 type Config struct {
-	Enabled          bool
+	Enabled bool
+	// LatencyThreshold is the threshold of the default policy, used when
+	// Policies is empty.
 	LatencyThreshold time.Duration
-	Duration         time.Duration
-	Cooldown         time.Duration
+	// Policies decide when a capture starts; any of them firing is enough.
+	// Empty means a ThresholdPolicy with LatencyThreshold. Stateful
+	// policies start over when they are replaced by UpdateConfig.
+	Policies []Policy
+	Duration time.Duration
+	Cooldown time.Duration
+	// Types are the profiles captured for each slow endpoint. Empty means
+	// a CPU profile only.
+	Types []ProfileType
+	// Store keeps the captured profiles. Nil means a LocalStore in Dir,
+	// limited to MaxBytes and MaxAge.
+	Store Store
+	// Dir is the root of the default store. Empty means an apm-profiles
+	// directory in os.TempDir().
+	Dir string
+	// MaxBytes and MaxAge bound the default store; the oldest captures are
+	// deleted first. Zero means unlimited.
+	MaxBytes int64
+	MaxAge   time.Duration
+	// MutexProfileFraction and BlockProfileRate are applied while mutex
+	// and block profiles are captured; see runtime.SetMutexProfileFraction
+	// and runtime.SetBlockProfileRate. Zero means the defaults of 5 and
+	// 10000 (one blocking event per 10µs).
+	MutexProfileFraction int
+	BlockProfileRate     int
+	// MinInterval is the minimum time between the starts of two captures,
+	// across all endpoints. Zero means no limit.
+	MinInterval time.Duration
+	// Continuous profiles on a schedule besides the policies. Its windows
+	// are kept in a LocalStore in the continuous subdirectory of Dir,
+	// whatever Store is.
+	Continuous ContinuousConfig
+	// Baselines records a baseline profile per route and compares captures
+	// to it. Baselines are kept in a LocalStore in the baselines
+	// subdirectory of Dir, limited to MaxAge.
+	Baselines BaselinesConfig
+}
+
+const (
+	defaultMutexProfileFraction = 5
+	defaultBlockProfileRate     = 10000
+)
+
+// DefaultConfig returns the profiler settings used when none are supplied.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:          true,
+		LatencyThreshold: 500 * time.Millisecond,
+		Duration:         10 * time.Second,
+		Cooldown:         1 * time.Minute,
+		Types:            []ProfileType{ProfileCPU},
+		MinInterval:      30 * time.Second,
+		MaxBytes:         256 << 20,
+		MaxAge:           24 * time.Hour,
+	}
+}
+
+// Validate reports whether the configuration can be used to build a profiler.
+// A disabled configuration is always valid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Policies) == 0 && c.LatencyThreshold <= 0 {
+		return errors.New("latency threshold must be positive")
+	}
+	for _, policy := range c.Policies {
+		_, onRequest := policy.(RequestPolicy)
+		_, onRuntime := policy.(RuntimePolicy)
+		if !onRequest && !onRuntime {
+			return fmt.Errorf("policy %q observes neither requests nor runtime stats", policy.Name())
+		}
+		if v, ok := policy.(interface{ Validate() error }); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("policy %q: %w", policy.Name(), err)
+			}
+		}
+	}
+	if c.Duration <= 0 {
+		return errors.New("profile duration must be positive")
+	}
+	if c.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	for _, t := range c.Types {
+		if !t.Valid() {
+			return fmt.Errorf("unknown profile type %q", t)
+		}
+	}
+	if c.MutexProfileFraction < 0 {
+		return errors.New("mutex profile fraction must not be negative")
+	}
+	if c.BlockProfileRate < 0 {
+		return errors.New("block profile rate must not be negative")
+	}
+	if c.MinInterval < 0 {
+		return errors.New("min interval must not be negative")
+	}
+	if c.MaxBytes < 0 {
+		return errors.New("max bytes must not be negative")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("max age must not be negative")
+	}
+	if err := c.Continuous.Validate(); err != nil {
+		return err
+	}
+	if err := c.Baselines.Validate(); err != nil {
+		return err
+	}
+	if c.Baselines.Enabled && len(diffTypes(c.types())) == 0 {
+		return errors.New("baselines need a cpu or heap profile type")
+	}
+	return nil
+}
+
+func (c Config) policies() []Policy {
+	if len(c.Policies) == 0 {
+		return []Policy{ThresholdPolicy{Default: c.LatencyThreshold}}
+	}
+	return c.Policies
+}
+
+func (c Config) types() []ProfileType {
+	if len(c.Types) == 0 {
+		return []ProfileType{ProfileCPU}
+	}
+	return c.Types
+}
+
+func (c Config) dir() string {
+	if c.Dir == "" {
+		return filepath.Join(os.TempDir(), "apm-profiles")
+	}
+	return c.Dir
+}
+
+func (c Config) mutexProfileFraction() int {
+	if c.MutexProfileFraction == 0 {
+		return defaultMutexProfileFraction
+	}
+	return c.MutexProfileFraction
+}
+
+func (c Config) blockProfileRate() int {
+	if c.BlockProfileRate == 0 {
+		return defaultBlockProfileRate
+	}
+	return c.BlockProfileRate
 }
 
 type Profiler struct {
-	config        Config
-	cooldowns     map[string]time.Time
+	config        atomic.Pointer[Config]
+	cooldowns     routeCache[time.Time]
 	cooldownsLock sync.Mutex
+	coordinator   *coordinator
+	store         Store
+	// local is the default store, whose limits follow UpdateConfig.
+	local *LocalStore
+	// windows keeps the windows of continuous profiling.
+	windows *LocalStore
+	// baselines keeps the newest baseline profile of each route.
+	baselines     *LocalStore
+	baselineAt    routeCache[time.Time]
+	nextBaseline  time.Time
+	baselinesLock sync.Mutex
+
+	stats     Stats
+	statsLock sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// NewProfiler starts a profiler. Call Close to stop it. It returns nil when
+// the profiler is disabled or its default store cannot be opened.
 func NewProfiler(config Config) *Profiler {
 	if !config.Enabled {
 		return nil
 	}
-	log.Println("Initializing on-demand profiler.")
-	return &Profiler{
-		config:    config,
-		cooldowns: make(map[string]time.Time),
+	logging.Infof("Initializing on-demand profiler.")
+	p := &Profiler{
+		store: config.Store,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if p.store == nil {
+		local, err := NewLocalStore(LocalStoreConfig{Root: config.dir(), MaxBytes: config.MaxBytes, MaxAge: config.MaxAge})
+		if err != nil {
+			logging.Errorf("Profiler: Error opening profile store, profiling disabled: %v", err)
+			return nil
+		}
+		p.store, p.local = local, local
+	}
+	windows, err := NewLocalStore(LocalStoreConfig{Root: filepath.Join(config.dir(), "continuous"), MaxAge: config.Continuous.retention()})
+	if err != nil {
+		logging.Errorf("Profiler: Error opening continuous profile store, profiling disabled: %v", err)
+		return nil
+	}
+	p.windows = windows
+	baselines, err := NewLocalStore(LocalStoreConfig{Root: filepath.Join(config.dir(), "baselines"), MaxAge: config.MaxAge})
+	if err != nil {
+		logging.Errorf("Profiler: Error opening baseline profile store, profiling disabled: %v", err)
+		return nil
+	}
+	p.baselines = baselines
+	for _, entry := range baselines.List() {
+		route, ok := baselineRoute(entry)
+		if !ok {
+			continue
+		}
+		if _, ok := p.baselineAt.get(route); !ok {
+			p.baselineAt.put(route, entry.StartedAt)
+		}
+	}
+	p.config.Store(&config)
+	p.coordinator = newCoordinator(p.Config, p.store, p.windows, p.baselines, p.captured)
+	go p.runContinuous()
+	return p
+}
+
+// Close interrupts the running capture or window, keeping the profiles
+// recorded so far, and stops the profiler. It is safe to call Close more
+// than once.
+func (p *Profiler) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+	p.coordinator.close()
+}
+
+// UpdateConfig atomically replaces the profiler settings. Setting Enabled to
+// false pauses the profiler; profiles already running are not interrupted.
+// Store and Dir are fixed when the profiler is created. Policies of the
+// new settings take over the windows and baselines of the old policies of
+// the same name.
+func (p *Profiler) UpdateConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	carryState(p.Config().policies(), config.policies())
+	p.config.Store(&config)
+	if p.local != nil {
+		p.local.SetLimits(config.MaxBytes, config.MaxAge)
+	}
+	p.windows.SetLimits(0, config.Continuous.retention())
+	p.baselines.SetLimits(0, config.MaxAge)
+	return nil
+}
+
+// Config returns the settings currently in effect.
+func (p *Profiler) Config() Config {
+	return *p.config.Load()
+}
+
+// ObserveRequest feeds a finished request to the request policies and
+// requests a capture when one of them fires, unless the route is cooling
+// down. When none fires, the request may start a baseline of its route.
+// traceID identifies the request in the profile index; it may be empty.
+func (p *Profiler) ObserveRequest(route string, latency time.Duration, failed bool, traceID string) {
+	config := p.Config()
+	if !config.Enabled {
+		return
+	}
+	r := Request{Route: route, Latency: latency, Failed: failed, TraceID: traceID, At: time.Now()}
+
+	var trigger *Trigger
+	for _, policy := range config.policies() {
+		rp, ok := policy.(RequestPolicy)
+		if !ok {
+			continue
+		}
+		// Every policy sees every request to keep its windows complete.
+		if reason, fire := rp.ObserveRequest(r); fire && trigger == nil {
+			trigger = &Trigger{Route: route, TraceID: traceID, Latency: latency, Policy: policy.Name(), Reason: reason}
+		}
+	}
+	switch {
+	case trigger != nil:
+		p.request(config, route, *trigger)
+	case config.Baselines.Enabled:
+		p.recordBaseline(config, r)
 	}
 }
 
-func (p *Profiler) ProfileEndpointIfSlow(path string, duration time.Duration) {
-	if duration < p.config.LatencyThreshold {
+// ObserveRuntime feeds a runtime statistics sample to the runtime policies
+// and requests a capture when one of them fires, unless that policy is
+// cooling down.
+func (p *Profiler) ObserveRuntime(stats RuntimeStats) {
+	config := p.Config()
+	if !config.Enabled {
 		return
 	}
+	for _, policy := range config.policies() {
+		rp, ok := policy.(RuntimePolicy)
+		if !ok {
+			continue
+		}
+		if reason, fire := rp.ObserveRuntime(stats); fire {
+			p.request(config, policy.Name(), Trigger{Policy: policy.Name(), Reason: reason})
+		}
+	}
+}
 
-	if p.isCoolingDown(path) {
-		log.Printf("Profiler: Endpoint '%s' is slow, but is in cooldown.", path)
+// request asks the coordinator for a capture unless key, a route or the
+// name of a runtime policy, is cooling down.
+func (p *Profiler) request(config Config, key string, trigger Trigger) {
+	if p.isCoolingDown(key) {
+		logging.Debugf("Profiler: Policy '%s' fired for '%s', but it is in cooldown.", trigger.Policy, key)
 		return
 	}
 
-	log.Printf("Profiler: Endpoint '%s' exceeded latency threshold (%.2fms). Starting CPU profile.", path, float64(duration.Milliseconds()))
-	p.setCooldown(path)
-	go p.startProfiling(path)
+	logging.Infof("Profiler: Policy '%s' fired for '%s': %s. Requesting profiles %v.", trigger.Policy, key, trigger.Reason, config.types())
+	p.setCooldown(key)
+	p.coordinator.request(trigger)
 }
 
-func (p *Profiler) startProfiling(path string) {
-	sanitizedPath := strings.ReplaceAll(path, "/", "_")
-	filename := fmt.Sprintf("%s/profile_%s_%d.pprof", os.TempDir(), sanitizedPath, time.Now().Unix())
+// captured logs the outcome of a capture for every endpoint it covers,
+// compares it to the baselines of its routes, publishes it in its store
+// and updates the stats.
+func (p *Profiler) captured(bundle *Bundle, err error) {
+	p.statsLock.Lock()
+	p.stats.Profiling += bundle.Duration
+	p.stats.Overhead += bundle.Overhead
+	p.stats.Bytes += bundle.Bytes
+	switch {
+	case err != nil:
+		p.stats.Failures++
+	case bundle.Continuous:
+		p.stats.Windows++
+	case bundle.Baseline:
+		p.stats.Baselines++
+	default:
+		p.stats.Captures++
+	}
+	p.statsLock.Unlock()
 
-	f, err := os.Create(filename)
 	if err != nil {
-		log.Printf("Profiler: Error creating profile file for '%s': %v", path, err)
+		logging.Errorf("Profiler: Error capturing profiles for '%s': %v", bundle.Triggers[0].name(), err)
 		return
 	}
-	defer f.Close()
-
-	if err := pprof.StartCPUProfile(f); err != nil {
-		log.Printf("Profiler: Error starting CPU profile for '%s': %v", path, err)
+	for t, err := range bundle.Errors {
+		logging.Warnf("Profiler: %s profile of %s failed: %v", t, bundle.ID, err)
+	}
+	entry := IndexEntry{
+		ID:        bundle.ID,
+		StartedAt: bundle.StartedAt,
+		Duration:  bundle.Duration,
+		Types:     bundle.Types,
+		Triggers:  bundle.Triggers,
+	}
+	store := p.store
+	switch {
+	case bundle.Continuous:
+		store = p.windows
+	case bundle.Baseline:
+		store = p.baselines
+	default:
+		entry.Diffs = p.diffs(p.Config(), bundle)
+	}
+	if err := store.Commit(entry); err != nil {
+		logging.Errorf("Profiler: Error saving profiles %s: %v", bundle.ID, err)
 		return
 	}
+	switch {
+	case bundle.Continuous:
+		logging.Debugf("Profiler: Continuous window %s completed (%d types, %d bytes).", bundle.ID, len(bundle.Types), bundle.Bytes)
+		return
+	case bundle.Baseline:
+		p.baselineRecorded(entry)
+		logging.Debugf("Profiler: Baseline %s of '%s' completed (%d types).", bundle.ID, bundle.Triggers[0].Route, len(bundle.Types))
+		return
+	}
+	for _, trigger := range bundle.Triggers {
+		logging.Infof("Profiler: Profiles for '%s' (policy %s, trace %s) completed (%d types). Saved as %s", trigger.name(), trigger.Policy, trigger.TraceID, len(bundle.Types), bundle.ID)
+	}
+}
 
-	time.Sleep(p.config.Duration)
-	pprof.StopCPUProfile()
+// Stats returns the profiler's self-metrics.
+func (p *Profiler) Stats() Stats {
+	p.statsLock.Lock()
+	stats := p.stats
+	p.statsLock.Unlock()
+	for _, w := range p.windows.List() {
+		stats.WindowBytes += w.Bytes
+	}
+	return stats
+}
+
+// Store returns the store the captured profiles are kept in.
+func (p *Profiler) Store() Store {
+	return p.store
+}
+
+// Profiles returns the captures in the store, newest first.
+func (p *Profiler) Profiles() []IndexEntry {
+	return p.store.List()
+}
 
-	log.Printf("Profiler: CPU profile for endpoint '%s' completed. Saved to %s", path, filename)
+// Profile returns the capture with the given ID.
+func (p *Profiler) Profile(id string) (IndexEntry, bool) {
+	return p.store.Get(id)
 }
 
 func (p *Profiler) isCoolingDown(path string) bool {
 	p.cooldownsLock.Lock()
 	defer p.cooldownsLock.Unlock()
 
-	if cooldownEnd, exists := p.cooldowns[path]; exists {
+	if cooldownEnd, exists := p.cooldowns.get(path); exists {
 		if time.Now().Before(cooldownEnd) {
 			return true
 		}
-		delete(p.cooldowns, path)
+		p.cooldowns.remove(path)
 	}
 	return false
 }
@@ -88,5 +440,5 @@ func (p *Profiler) setCooldown(path string) {
 	p.cooldownsLock.Lock()
 	defer p.cooldownsLock.Unlock()
 
-	p.cooldowns[path] = time.Now().Add(p.config.Cooldown)
+	p.cooldowns.put(path, time.Now().Add(p.Config().Cooldown))
 }
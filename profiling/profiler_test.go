@@ -1,6 +1,7 @@
 package profiling
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -8,20 +9,22 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestProfiler_ProfileEndpointIfSlow(t *testing.T) {
+func TestProfiler_ObserveRequest(t *testing.T) {
 	cfg := Config{
 		Enabled:          true,
 		LatencyThreshold: 100 * time.Millisecond,
 		Duration:         1 * time.Second,
 		Cooldown:         200 * time.Millisecond,
+		Dir:              t.TempDir(),
 	}
 
 	t.Run("should not trigger on fast endpoint", func(t *testing.T) {
 		profiler := NewProfiler(cfg)
 		require.NotNil(t, profiler)
+		t.Cleanup(profiler.Close)
 
 		fastDuration := 50 * time.Millisecond
-		profiler.ProfileEndpointIfSlow("/fast", fastDuration)
+		profiler.ObserveRequest("/fast", fastDuration, false, "")
 
 		assert.False(t, profiler.isCoolingDown("/fast"), "cooldown should not be set for a fast endpoint")
 	})
@@ -29,9 +32,10 @@ func TestProfiler_ProfileEndpointIfSlow(t *testing.T) {
 	t.Run("should trigger on slow endpoint", func(t *testing.T) {
 		profiler := NewProfiler(cfg)
 		require.NotNil(t, profiler)
+		t.Cleanup(profiler.Close)
 
 		slowDuration := 150 * time.Millisecond
-		profiler.ProfileEndpointIfSlow("/slow", slowDuration)
+		profiler.ObserveRequest("/slow", slowDuration, false, "")
 
 		assert.True(t, profiler.isCoolingDown("/slow"), "cooldown should be set for a slow endpoint")
 	})
@@ -39,29 +43,114 @@ func TestProfiler_ProfileEndpointIfSlow(t *testing.T) {
 	t.Run("should respect cooldown period", func(t *testing.T) {
 		profiler := NewProfiler(cfg)
 		require.NotNil(t, profiler)
+		t.Cleanup(profiler.Close)
 
 		slowDuration := 150 * time.Millisecond
-		profiler.ProfileEndpointIfSlow("/slow-cooldown", slowDuration)
+		profiler.ObserveRequest("/slow-cooldown", slowDuration, false, "")
 		require.True(t, profiler.isCoolingDown("/slow-cooldown"), "cooldown should be set after the first slow request")
 
-		cooldownEnd := profiler.cooldowns["/slow-cooldown"]
+		cooldownEnd, _ := profiler.cooldowns.get("/slow-cooldown")
 
-		profiler.ProfileEndpointIfSlow("/slow-cooldown", slowDuration)
-		assert.Equal(t, cooldownEnd, profiler.cooldowns["/slow-cooldown"], "cooldown time should not be extended on second call")
+		profiler.ObserveRequest("/slow-cooldown", slowDuration, false, "")
+		again, _ := profiler.cooldowns.get("/slow-cooldown")
+		assert.Equal(t, cooldownEnd, again, "cooldown time should not be extended on second call")
 	})
 
 	t.Run("should allow profiling again after cooldown", func(t *testing.T) {
 		profiler := NewProfiler(cfg)
 		require.NotNil(t, profiler)
+		t.Cleanup(profiler.Close)
 
-		profiler.ProfileEndpointIfSlow("/slow-after-cooldown", 150*time.Millisecond)
+		profiler.ObserveRequest("/slow-after-cooldown", 150*time.Millisecond, false, "")
 		require.True(t, profiler.isCoolingDown("/slow-after-cooldown"))
 
 		time.Sleep(cfg.Cooldown + 50*time.Millisecond)
 
 		assert.False(t, profiler.isCoolingDown("/slow-after-cooldown"), "cooldown should have expired")
 
-		profiler.ProfileEndpointIfSlow("/slow-after-cooldown", 150*time.Millisecond)
+		profiler.ObserveRequest("/slow-after-cooldown", 150*time.Millisecond, false, "")
 		assert.True(t, profiler.isCoolingDown("/slow-after-cooldown"), "cooldown should be set again after it expires")
 	})
 }
+
+func TestProfiler_Index(t *testing.T) {
+	store := newTestStore(t)
+	profiler := NewProfiler(Config{Enabled: true, LatencyThreshold: time.Second, Duration: time.Second, Store: store, Dir: t.TempDir()})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := store.Begin("/slow", time.Unix(int64(i), 0))
+		require.NoError(t, err)
+		for _, typ := range []ProfileType{ProfileHeap, ProfileCPU} {
+			w, err := store.Create(id, typ)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+		}
+		profiler.captured(&Bundle{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Types:     []ProfileType{ProfileCPU, ProfileHeap},
+			Triggers:  []Trigger{{Route: "/slow", TraceID: "0af7651916cd43dd8448eb211c80319c", Latency: 2 * time.Second}},
+		}, nil)
+		ids = append(ids, id)
+	}
+
+	entries := profiler.Profiles()
+	require.Len(t, entries, 3)
+	assert.Equal(t, ids[2], entries[0].ID, "newest first")
+	assert.Equal(t, []ProfileType{ProfileCPU, ProfileHeap}, entries[0].Types)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", entries[0].Triggers[0].TraceID)
+
+	entry, ok := profiler.Profile(ids[1])
+	require.True(t, ok)
+	assert.Equal(t, time.Unix(1, 0), entry.StartedAt)
+}
+
+func TestProfiler_DefaultStore(t *testing.T) {
+	dir := t.TempDir()
+	profiler := NewProfiler(Config{Enabled: true, LatencyThreshold: time.Second, Duration: time.Second, Dir: dir})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	require.IsType(t, &LocalStore{}, profiler.Store())
+	assert.FileExists(t, filepath.Join(dir, indexFile))
+
+	require.NoError(t, profiler.UpdateConfig(Config{Enabled: true, LatencyThreshold: time.Second, Duration: time.Second, MaxAge: time.Minute}))
+	assert.Equal(t, time.Minute, profiler.local.maxAge, "limits follow UpdateConfig")
+}
+
+func TestProfiler_Policies(t *testing.T) {
+	store := newTestStore(t)
+	profiler := NewProfiler(Config{
+		Enabled:  true,
+		Duration: 20 * time.Millisecond,
+		Store:    store,
+		Dir:      t.TempDir(),
+		Policies: []Policy{
+			&ErrorRatePolicy{Rate: 0.5, Window: time.Minute, MinSamples: 2},
+			GoroutinePolicy{Max: 1},
+		},
+	})
+	require.NotNil(t, profiler)
+	t.Cleanup(profiler.Close)
+
+	profiler.ObserveRequest("/orders", 10*time.Millisecond, false, "")
+	profiler.ObserveRequest("/orders", 10*time.Millisecond, true, "0af7651916cd43dd8448eb211c80319c")
+	require.Eventually(t, func() bool { return len(profiler.Profiles()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	trigger := profiler.Profiles()[0].Triggers[0]
+	assert.Equal(t, "/orders", trigger.Route)
+	assert.Equal(t, PolicyErrorRate, trigger.Policy, "the capture records the policy that fired")
+	assert.Equal(t, "1 of 2 requests failed (50%)", trigger.Reason)
+
+	profiler.ObserveRuntime(RuntimeStats{Goroutines: 10, At: time.Now()})
+	require.Eventually(t, func() bool { return len(profiler.Profiles()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	trigger = profiler.Profiles()[0].Triggers[0]
+	assert.Empty(t, trigger.Route)
+	assert.Equal(t, PolicyGoroutines, trigger.Policy)
+	assert.Contains(t, profiler.Profiles()[0].ID, "_goroutines")
+
+	assert.Error(t, profiler.UpdateConfig(Config{Enabled: true, Duration: time.Second, Policies: []Policy{&PercentilePolicy{Percentile: 95}}}))
+}
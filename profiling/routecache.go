@@ -0,0 +1,68 @@
+package profiling
+
+import "container/list"
+
+// maxTrackedRoutes caps the routes a policy, and the profiler's cooldowns
+// and baselines, keep state for. The least recently seen route is forgotten
+// first, so that many distinct or unnormalized routes cannot grow them
+// without bound.
+const maxTrackedRoutes = 1000
+
+// routeCache keeps a value per route and evicts the least recently used
+// route beyond its capacity. The zero value is ready to use. It is not safe
+// for concurrent use.
+type routeCache[V any] struct {
+	// capacity is the number of routes kept. Zero means maxTrackedRoutes.
+	capacity int
+	byRoute  map[string]*list.Element
+	order    *list.List // of *routeEntry[V], least recently used first
+}
+
+type routeEntry[V any] struct {
+	route string
+	value V
+}
+
+// get returns the value of route and marks the route as used.
+func (c *routeCache[V]) get(route string) (V, bool) {
+	el, ok := c.byRoute[route]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToBack(el)
+	return el.Value.(*routeEntry[V]).value, true
+}
+
+// put sets the value of route, evicting the least recently used route when
+// the cache is full.
+func (c *routeCache[V]) put(route string, value V) {
+	if el, ok := c.byRoute[route]; ok {
+		el.Value.(*routeEntry[V]).value = value
+		c.order.MoveToBack(el)
+		return
+	}
+	if c.byRoute == nil {
+		c.byRoute = make(map[string]*list.Element)
+		c.order = list.New()
+	}
+	capacity := c.capacity
+	if capacity <= 0 {
+		capacity = maxTrackedRoutes
+	}
+	for len(c.byRoute) >= capacity {
+		oldest := c.order.Remove(c.order.Front()).(*routeEntry[V])
+		delete(c.byRoute, oldest.route)
+	}
+	c.byRoute[route] = c.order.PushBack(&routeEntry[V]{route: route, value: value})
+}
+
+// remove forgets route.
+func (c *routeCache[V]) remove(route string) {
+	if el, ok := c.byRoute[route]; ok {
+		c.order.Remove(el)
+		delete(c.byRoute, route)
+	}
+}
+
+func (c *routeCache[V]) len() int { return len(c.byRoute) }
@@ -0,0 +1,30 @@
+package profiling
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteCache(t *testing.T) {
+	c := routeCache[int]{capacity: 2}
+	c.put("/a", 1)
+	c.put("/b", 2)
+	_, _ = c.get("/a")
+	c.put("/c", 3)
+
+	assert.Equal(t, 2, c.len())
+	_, ok := c.get("/b")
+	assert.False(t, ok, "the least recently used route is evicted")
+	v, ok := c.get("/a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.put("/a", 4)
+	v, _ = c.get("/a")
+	assert.Equal(t, 4, v)
+	c.remove("/a")
+	_, ok = c.get("/a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.len())
+}
@@ -0,0 +1,44 @@
+package profiling
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for unknown captures or profile types.
+var ErrNotFound = errors.New("profile not found")
+
+// IndexEntry describes one capture and the slow requests it covers.
+type IndexEntry struct {
+	ID        string        `json:"id"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Types     []ProfileType `json:"types"`
+	Triggers  []Trigger     `json:"triggers"`
+	// Bytes is the total size of the profiles, set by the store.
+	Bytes int64 `json:"bytes"`
+	// Diffs compare the profiles to the baselines of the routes that
+	// triggered the capture, when baselines are recorded.
+	Diffs []Diff `json:"diffs,omitempty"`
+}
+
+// Store keeps captured profiles. A capture is reserved with Begin, written
+// one profile at a time with Create and published with Commit; until then
+// it is not listed. Implementations must be safe for concurrent use.
+type Store interface {
+	// Begin reserves a new capture of route and returns its ID.
+	Begin(route string, at time.Time) (string, error)
+	// Create returns a writer for one profile of a reserved capture.
+	Create(id string, t ProfileType) (io.WriteCloser, error)
+	// Commit publishes a capture. Profiles created for types missing from
+	// entry.Types are discarded.
+	Commit(entry IndexEntry) error
+	// List returns the published captures, newest first.
+	List() []IndexEntry
+	Get(id string) (IndexEntry, bool)
+	// Open returns one profile of a published capture.
+	Open(id string, t ProfileType) (io.ReadCloser, error)
+	// Delete removes a capture, published or not.
+	Delete(id string) error
+}
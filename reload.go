@@ -0,0 +1,156 @@
+package apm_probe
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/fllarpy/apm-probe/config"
+	"github.com/fllarpy/apm-probe/internal/logging"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// dynamicSampler delegates to a sampler that can be replaced while the
+// tracer provider is running.
+type dynamicSampler struct {
+	current atomic.Pointer[sdktrace.Sampler]
+}
+
+func newDynamicSampler(s sdktrace.Sampler) *dynamicSampler {
+	d := &dynamicSampler{}
+	d.set(s)
+	return d
+}
+
+func (d *dynamicSampler) set(s sdktrace.Sampler) {
+	d.current.Store(&s)
+}
+
+func (d *dynamicSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	return (*d.current.Load()).ShouldSample(p)
+}
+
+func (d *dynamicSampler) Description() string {
+	return (*d.current.Load()).Description()
+}
+
+// switchableExporter forwards spans to the wrapped exporter only while it is
+// enabled, so exporters can be toggled without touching the tracer provider.
+type switchableExporter struct {
+	sdktrace.SpanExporter
+	enabled atomic.Bool
+}
+
+func newSwitchableExporter(exp sdktrace.SpanExporter, enabled bool) *switchableExporter {
+	s := &switchableExporter{SpanExporter: exp}
+	s.enabled.Store(enabled)
+	return s
+}
+
+func (s *switchableExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if !s.enabled.Load() {
+		return nil
+	}
+	return s.SpanExporter.ExportSpans(ctx, spans)
+}
+
+// watchConfig applies every valid change of the loader's file until
+// Shutdown. Invalid files leave the last good configuration in place.
+func (p *Probe) watchConfig(loader *config.Loader, initial config.Config) error {
+	p.config.Store(&initial)
+	p.appliedProfiler = initial.Profiler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := loader.Watch(ctx, func(cfg config.Config, err error) {
+		if err != nil {
+			logging.Errorf("Probe: Ignoring configuration change in %s, keeping last good config: %v", loader.Path(), err)
+			return
+		}
+		p.reload(cfg)
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	p.stopWatch = cancel
+	p.watchDone = done
+	logging.Infof("Probe: Watching %s for configuration changes.", loader.Path())
+	return nil
+}
+
+func (p *Probe) reload(cfg config.Config) {
+	previous := p.config.Load()
+	if err := p.applyConfig(cfg); err != nil {
+		logging.Errorf("Probe: Failed to apply configuration, rolling back: %v", err)
+		if rollbackErr := p.applyConfig(*previous); rollbackErr != nil {
+			logging.Errorf("Probe: Rollback failed: %v", rollbackErr)
+		}
+		return
+	}
+	p.config.Store(&cfg)
+	keys := restartRequired(*previous, cfg)
+	if p.profiler == nil && cfg.Profiler.Enabled && !previous.Profiler.Enabled {
+		keys = append(keys, "profiler.enabled")
+	}
+	if p.detector == nil && cfg.NPlusOne.Enabled && !previous.NPlusOne.Enabled {
+		keys = append(keys, "nplusone.enabled")
+	}
+	for _, key := range keys {
+		logging.Warnf("Probe: Configuration key %q changed but only takes effect after a restart.", key)
+	}
+	logging.Infof("Probe: Configuration reloaded (log_level=%s, profiler.latency_threshold=%s, nplusone.threshold=%d, sampling.ratio=%v).",
+		cfg.LogLevel, cfg.Profiler.LatencyThreshold, cfg.NPlusOne.Threshold, cfg.Sampling.Ratio)
+}
+
+// applyConfig pushes the hot-reloadable parts of cfg into the running
+// components.
+func (p *Probe) applyConfig(cfg config.Config) error {
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	sampler, err := samplerFromConfig(cfg.Sampling)
+	if err != nil {
+		return err
+	}
+	// Policies are rebuilt only when the profiler section changed, so that
+	// they keep their windows and baselines across unrelated changes.
+	if p.profiler != nil && !reflect.DeepEqual(cfg.Profiler, p.appliedProfiler) {
+		if err := p.profiler.UpdateConfig(profilerConfig(cfg.Profiler)); err != nil {
+			return fmt.Errorf("invalid profiler config: %w", err)
+		}
+		p.appliedProfiler = cfg.Profiler
+	}
+	if p.detector != nil {
+		if err := p.detector.UpdateConfig(nPlusOneConfig(cfg.NPlusOne)); err != nil {
+			return fmt.Errorf("invalid N+1 detector config: %w", err)
+		}
+	}
+
+	logging.SetLevel(level)
+	p.sampler.set(sampler)
+	p.customExporter.enabled.Store(cfg.Exporters.Custom.Enabled)
+	p.loggingExporter.enabled.Store(cfg.Exporters.Logging.Enabled)
+	return nil
+}
+
+// restartRequired lists the keys that differ between old and new but cannot
+// be applied to a running probe.
+func restartRequired(old, new config.Config) []string {
+	var keys []string
+	add := func(changed bool, key string) {
+		if changed {
+			keys = append(keys, key)
+		}
+	}
+	add(old.Enabled != new.Enabled, "enabled")
+	add(old.ServiceName != new.ServiceName, "service_name")
+	add(old.ServiceVersion != new.ServiceVersion, "service_version")
+	add(old.Store != new.Store, "store")
+	add(old.Reporter != new.Reporter, "reporter")
+	add(old.Runtime != new.Runtime, "runtime")
+	add(old.HotReload != new.HotReload, "hot_reload")
+	add(old.Profiler.Dir != new.Profiler.Dir, "profiler.dir")
+	return keys
+}
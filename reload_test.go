@@ -0,0 +1,88 @@
+package apm_probe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe_HotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apm.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write(`
+service_name: "reloading"
+log_level: "info"
+profiler:
+  latency_threshold: 500ms
+nplusone:
+  threshold: 5
+`)
+
+	ctx := context.Background()
+	probe, _, err := NewProbeFromConfig(ctx, path, WithoutGlobalProvider())
+	require.NoError(t, err)
+	defer probe.Shutdown(ctx)
+	defer logging.SetLevel(logging.LevelInfo)
+
+	write(`
+service_name: "reloading"
+log_level: "debug"
+profiler:
+  latency_threshold: 200ms
+nplusone:
+  threshold: 9
+exporters:
+  logging:
+    enabled: true
+`)
+	require.Eventually(t, func() bool {
+		return probe.profiler.Config().LatencyThreshold == 200*time.Millisecond
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 9, probe.detector.Config().Threshold)
+	assert.Equal(t, logging.LevelDebug, logging.GetLevel())
+	assert.True(t, probe.loggingExporter.enabled.Load())
+
+	write(`
+service_name: "reloading"
+nplusone:
+  threshold: 1
+`)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 200*time.Millisecond, probe.profiler.Config().LatencyThreshold, "invalid file must not be applied")
+	assert.Equal(t, 9, probe.detector.Config().Threshold, "invalid file must not be applied")
+}
+
+func TestProbe_HotReloadKeepsPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apm.yaml")
+	write := func(logLevel string) {
+		require.NoError(t, os.WriteFile(path, []byte(`
+service_name: "reloading"
+log_level: "`+logLevel+`"
+profiler:
+  triggers:
+    percentile:
+      threshold: 300ms
+`), 0o600))
+	}
+	write("info")
+
+	ctx := context.Background()
+	probe, _, err := NewProbeFromConfig(ctx, path, WithoutGlobalProvider())
+	require.NoError(t, err)
+	defer probe.Shutdown(ctx)
+	defer logging.SetLevel(logging.LevelInfo)
+	policies := probe.profiler.Config().Policies
+	require.Len(t, policies, 2)
+
+	write("debug")
+	require.Eventually(t, func() bool { return logging.GetLevel() == logging.LevelDebug }, 5*time.Second, 20*time.Millisecond)
+	assert.Same(t, policies[1], probe.profiler.Config().Policies[1], "the profiler section did not change")
+}
@@ -0,0 +1,275 @@
+package runtimestats
+
+import (
+	"errors"
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/fllarpy/apm-probe/internal/logging"
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+)
+
+type Config struct {
+	Enabled  bool
+	Interval time.Duration
+}
+
+// DefaultConfig returns the collector settings used when none are supplied.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:  true,
+		Interval: 10 * time.Second,
+	}
+}
+
+// Validate reports whether the configuration can be used to build a
+// collector. A disabled configuration is always valid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Interval <= 0 {
+		return errors.New("collection interval must be positive")
+	}
+	return nil
+}
+
+const (
+	metricGoroutines   = "/sched/goroutines:goroutines"
+	metricThreads      = "/sched/threads/total:threads"
+	metricHeapObjects  = "/memory/classes/heap/objects:bytes"
+	metricHeapUnused   = "/memory/classes/heap/unused:bytes"
+	metricHeapFree     = "/memory/classes/heap/free:bytes"
+	metricHeapReleased = "/memory/classes/heap/released:bytes"
+	metricHeapGoal     = "/gc/heap/goal:bytes"
+	metricAllocBytes   = "/gc/heap/allocs:bytes"
+	metricAllocObjects = "/gc/heap/allocs:objects"
+	metricGCCycles     = "/gc/cycles/total:gc-cycles"
+	metricCgoCalls     = "/cgo/go-to-c-calls:calls"
+	metricGCPauses     = "/sched/pauses/total/gc:seconds"
+	metricSchedLatency = "/sched/latencies:seconds"
+)
+
+// Observer is notified of every sample after it is stored. The profiler's
+// runtime trigger policies are fed this way.
+type Observer interface {
+	ObserveRuntime(sample inmemory.RuntimeSample)
+}
+
+// Collector periodically reads runtime/metrics and stores a sample in the
+// store.
+type Collector struct {
+	config   Config
+	store    *inmemory.Store
+	observer Observer
+	samples  []metrics.Sample
+	index    map[string]int
+
+	// Cumulative histograms from the previous read, used to compute the
+	// per-interval distributions.
+	prevGCPauses     *metrics.Float64Histogram
+	prevSchedLatency *metrics.Float64Histogram
+
+	stop      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// NewCollector returns a collector writing to store. observer may be nil.
+func NewCollector(config Config, store *inmemory.Store, observer Observer) *Collector {
+	if !config.Enabled {
+		return nil
+	}
+	logging.Infof("Initializing runtime metrics collector.")
+
+	supported := make(map[string]bool)
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+
+	c := &Collector{
+		config:   config,
+		store:    store,
+		observer: observer,
+		index:    make(map[string]int),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, name := range []string{
+		metricGoroutines, metricThreads,
+		metricHeapObjects, metricHeapUnused, metricHeapFree, metricHeapReleased, metricHeapGoal,
+		metricAllocBytes, metricAllocObjects, metricGCCycles, metricCgoCalls,
+		metricGCPauses, metricSchedLatency,
+	} {
+		if !supported[name] {
+			logging.Debugf("Runtime collector: Metric %s is not supported by this Go version.", name)
+			continue
+		}
+		c.index[name] = len(c.samples)
+		c.samples = append(c.samples, metrics.Sample{Name: name})
+	}
+	return c
+}
+
+// Start launches the collection goroutine. It takes a first sample
+// immediately. Calls after the first, or after Stop, do nothing.
+func (c *Collector) Start() {
+	c.startOnce.Do(func() {
+		go c.run()
+	})
+}
+
+// Stop ends the collection goroutine and waits for it to exit. It is safe to
+// call Stop more than once, and without calling Start.
+func (c *Collector) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	c.startOnce.Do(func() {
+		close(c.done)
+	})
+	<-c.done
+}
+
+func (c *Collector) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	c.Collect()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Collect()
+		}
+	}
+}
+
+// Collect takes a single sample and records it in the store.
+func (c *Collector) Collect() {
+	metrics.Read(c.samples)
+
+	sample := inmemory.RuntimeSample{
+		Timestamp:  time.Now(),
+		Goroutines: c.uint64Value(metricGoroutines),
+		Threads:    c.uint64Value(metricThreads),
+		HeapAlloc:  c.uint64Value(metricHeapObjects),
+		HeapSys: c.uint64Value(metricHeapObjects) + c.uint64Value(metricHeapUnused) +
+			c.uint64Value(metricHeapFree) + c.uint64Value(metricHeapReleased),
+		HeapGoal:   c.uint64Value(metricHeapGoal),
+		TotalAlloc: c.uint64Value(metricAllocBytes),
+		Mallocs:    c.uint64Value(metricAllocObjects),
+		GCCycles:   c.uint64Value(metricGCCycles),
+		CgoCalls:   c.uint64Value(metricCgoCalls),
+	}
+
+	if h := c.histogram(metricGCPauses); h != nil {
+		delta := subtract(h, c.prevGCPauses)
+		sample.GCPauses = summarize(delta)
+		sample.GCPauseCount = total(delta)
+		c.prevGCPauses = h
+	}
+	if h := c.histogram(metricSchedLatency); h != nil {
+		sample.SchedLatency = summarize(subtract(h, c.prevSchedLatency))
+		c.prevSchedLatency = h
+	}
+
+	c.store.UpdateRuntime(sample)
+	if c.observer != nil {
+		c.observer.ObserveRuntime(sample)
+	}
+}
+
+func (c *Collector) uint64Value(name string) uint64 {
+	i, ok := c.index[name]
+	if !ok || c.samples[i].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return c.samples[i].Value.Uint64()
+}
+
+// histogram returns a copy of the named histogram; metrics.Read may reuse
+// the memory of the previous value.
+func (c *Collector) histogram(name string) *metrics.Float64Histogram {
+	i, ok := c.index[name]
+	if !ok || c.samples[i].Value.Kind() != metrics.KindFloat64Histogram {
+		return nil
+	}
+	h := c.samples[i].Value.Float64Histogram()
+	return &metrics.Float64Histogram{
+		Counts:  append([]uint64(nil), h.Counts...),
+		Buckets: append([]float64(nil), h.Buckets...),
+	}
+}
+
+// subtract returns cur-prev bucket by bucket. Both are cumulative
+// histograms with identical buckets; a nil prev yields cur.
+func subtract(cur, prev *metrics.Float64Histogram) *metrics.Float64Histogram {
+	if prev == nil || len(prev.Counts) != len(cur.Counts) {
+		return cur
+	}
+	delta := &metrics.Float64Histogram{
+		Counts:  make([]uint64, len(cur.Counts)),
+		Buckets: cur.Buckets,
+	}
+	for i := range cur.Counts {
+		delta.Counts[i] = cur.Counts[i] - prev.Counts[i]
+	}
+	return delta
+}
+
+func total(h *metrics.Float64Histogram) uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// summarize estimates percentiles from a runtime histogram, using the upper
+// bound of the bucket that holds each rank.
+func summarize(h *metrics.Float64Histogram) inmemory.LatencySummary {
+	n := total(h)
+	if n == 0 {
+		return inmemory.LatencySummary{}
+	}
+	quantile := func(q float64) time.Duration {
+		rank := uint64(math.Ceil(q * float64(n)))
+		var seen uint64
+		for i, count := range h.Counts {
+			seen += count
+			if seen >= rank && count > 0 {
+				return bucketBound(h, i)
+			}
+		}
+		return bucketBound(h, len(h.Counts)-1)
+	}
+	summary := inmemory.LatencySummary{
+		P50: quantile(0.50),
+		P90: quantile(0.90),
+		P99: quantile(0.99),
+	}
+	for i := len(h.Counts) - 1; i >= 0; i-- {
+		if h.Counts[i] > 0 {
+			summary.Max = bucketBound(h, i)
+			break
+		}
+	}
+	return summary
+}
+
+// bucketBound returns the upper bound of bucket i, falling back to the lower
+// bound for the open-ended last bucket.
+func bucketBound(h *metrics.Float64Histogram, i int) time.Duration {
+	upper := h.Buckets[i+1]
+	if math.IsInf(upper, 1) {
+		upper = h.Buckets[i]
+	}
+	return time.Duration(upper * float64(time.Second))
+}
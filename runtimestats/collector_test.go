@@ -0,0 +1,87 @@
+package runtimestats
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fllarpy/apm-probe/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	t.Run("disabled config yields no collector", func(t *testing.T) {
+		assert.Nil(t, NewCollector(Config{Enabled: false}, inmemory.NewStore(), nil))
+	})
+
+	t.Run("collects samples periodically and stops cleanly", func(t *testing.T) {
+		store := inmemory.NewStore()
+		c := NewCollector(Config{Enabled: true, Interval: 10 * time.Millisecond}, store, nil)
+		require.NotNil(t, c)
+
+		before := runtime.NumGoroutine()
+		c.Start()
+		runtime.GC()
+		require.Eventually(t, func() bool {
+			return len(store.RuntimeSeries(time.Time{})) >= 3
+		}, time.Second, 5*time.Millisecond)
+		c.Stop()
+		c.Stop()
+
+		series := store.RuntimeSeries(time.Time{})
+		latest := series[len(series)-1]
+		assert.Positive(t, latest.Goroutines)
+		assert.Positive(t, latest.HeapAlloc)
+		assert.GreaterOrEqual(t, latest.HeapSys, latest.HeapAlloc)
+		assert.Positive(t, latest.TotalAlloc)
+		assert.Positive(t, latest.GCCycles)
+
+		n := len(store.RuntimeSeries(time.Time{}))
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, n, len(store.RuntimeSeries(time.Time{})), "no samples after Stop")
+		assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+	})
+
+	t.Run("stops without having started", func(t *testing.T) {
+		store := inmemory.NewStore()
+		c := NewCollector(Config{Enabled: true, Interval: 10 * time.Millisecond}, store, nil)
+		require.NotNil(t, c)
+
+		stopped := make(chan struct{})
+		go func() {
+			c.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("Stop blocked without Start")
+		}
+
+		c.Start()
+		time.Sleep(30 * time.Millisecond)
+		assert.Empty(t, store.RuntimeSeries(time.Time{}), "Start after Stop does nothing")
+	})
+
+	t.Run("notifies the observer of every sample", func(t *testing.T) {
+		store := inmemory.NewStore()
+		observer := &recordingObserver{}
+		c := NewCollector(Config{Enabled: true, Interval: time.Hour}, store, observer)
+		require.NotNil(t, c)
+
+		c.Collect()
+		c.Collect()
+
+		require.Len(t, observer.samples, 2)
+		assert.Equal(t, store.RuntimeSeries(time.Time{}), observer.samples)
+	})
+}
+
+type recordingObserver struct {
+	samples []inmemory.RuntimeSample
+}
+
+func (o *recordingObserver) ObserveRuntime(sample inmemory.RuntimeSample) {
+	o.samples = append(o.samples, sample)
+}
@@ -0,0 +1,212 @@
+package inmemory
+
+import (
+	"sort"
+	"time"
+)
+
+// Kinds of downstream dependencies.
+const (
+	DependencyDatabase = "db"
+	DependencyHTTP     = "http"
+)
+
+// Dependency identifies a downstream service called by the application.
+// Databases are identified by system, database name and server address,
+// HTTP services by their peer host (kept in Address).
+type Dependency struct {
+	Kind    string
+	System  string // db.system, e.g. "postgresql"; empty for HTTP
+	Name    string // database name; empty for HTTP
+	Address string // server address, host[:port]
+}
+
+// String returns a compact label such as "postgresql://db:5432/shop" or
+// "http://api.example.com".
+func (d Dependency) String() string {
+	scheme := d.System
+	if scheme == "" {
+		scheme = d.Kind
+	}
+	label := scheme + "://" + d.Address
+	if d.Name != "" {
+		label += "/" + d.Name
+	}
+	return label
+}
+
+// ClientCall is a single outgoing call to a dependency.
+type ClientCall struct {
+	Dependency Dependency
+	// Route is the path template of HTTP calls; empty for databases.
+	Route      string
+	Duration   time.Duration
+	StatusCode int
+	// Failed marks calls that returned an error, a 5xx response or no
+	// response at all.
+	Failed bool
+}
+
+// DependencyStats aggregates the calls made to one dependency.
+type DependencyStats struct {
+	Dependency Dependency
+	Count      int
+	Errors     int
+	Latency    LatencySummary
+}
+
+// DependencyEdge aggregates the calls made to one dependency while serving
+// one route.
+type DependencyEdge struct {
+	Route      string
+	Dependency Dependency
+	Count      int
+	Errors     int
+	Latency    LatencySummary
+}
+
+// DependencyGraph links the server routes to the downstreams they call.
+type DependencyGraph struct {
+	Nodes []DependencyStats
+	Edges []DependencyEdge
+}
+
+type dependencyEdgeKey struct {
+	route string
+	dep   Dependency
+}
+
+// overflowDependency collects calls to dependencies beyond Config.MaxRoutes.
+var overflowDependency = Dependency{Kind: OverflowRoute, Address: OverflowRoute}
+
+// AddClientRequest records an outgoing call in the aggregates of its
+// dependency. Database calls are additionally kept as raw events, HTTP calls
+// are aggregated per host and route.
+func (s *Store) AddClientRequest(call ClientCall) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	now := time.Now()
+	agg, ok := s.dependencies[call.Dependency]
+	if !ok {
+		dep := call.Dependency
+		if s.config.MaxRoutes > 0 && len(s.dependencies) >= s.config.MaxRoutes {
+			dep = overflowDependency
+			agg = s.dependencies[dep]
+		}
+		if agg == nil {
+			agg = newRouteAggregate(now)
+			s.dependencies[dep] = agg
+		}
+	}
+	agg.recordOutcome(now, call.Duration, call.StatusCode, call.Failed)
+
+	switch call.Dependency.Kind {
+	case DependencyDatabase:
+		s.clientRequests.push(now, clientEntrySize, clientEntry{now, call.Duration, call.Failed})
+		s.enforceRetention(now)
+	case DependencyHTTP:
+		s.addHTTPClientRequest(now, call)
+	}
+}
+
+// AddDependencyEdges attributes calls to the server route that made them.
+// They must already have been recorded with AddClientRequest.
+func (s *Store) AddDependencyEdges(route string, calls []ClientCall) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	now := time.Now()
+	for _, call := range calls {
+		key := dependencyEdgeKey{route, call.Dependency}
+		agg, ok := s.dependencyEdges[key]
+		if !ok {
+			if s.config.MaxRoutes > 0 && len(s.dependencyEdges) >= s.config.MaxRoutes {
+				key = dependencyEdgeKey{OverflowRoute, overflowDependency}
+				agg = s.dependencyEdges[key]
+			}
+			if agg == nil {
+				agg = newRouteAggregate(now)
+				s.dependencyEdges[key] = agg
+			}
+		}
+		agg.recordOutcome(now, call.Duration, call.StatusCode, call.Failed)
+	}
+}
+
+// DependencyGraph returns the dependency graph selected by q. Only the
+// Window and Route fields of q apply; Route keeps the edges of that route
+// and the dependencies they reach.
+func (s *Store) DependencyGraph(q Query) DependencyGraph {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.dependencyGraph(time.Now(), q)
+}
+
+// dependencyGraph builds the graph. The caller must hold s.mu.
+func (s *Store) dependencyGraph(now time.Time, q Query) DependencyGraph {
+	var graph DependencyGraph
+	reached := make(map[Dependency]bool)
+
+	for key, agg := range s.dependencyEdges {
+		if q.Route != "" && key.route != q.Route {
+			continue
+		}
+		stats := windowOrLifetime(agg, now, q.Window)
+		if stats == nil {
+			continue
+		}
+		reached[key.dep] = true
+		graph.Edges = append(graph.Edges, DependencyEdge{
+			Route:      key.route,
+			Dependency: key.dep,
+			Count:      stats.count,
+			Errors:     stats.errors,
+			Latency:    stats.latency.Summary(),
+		})
+	}
+
+	for dep, agg := range s.dependencies {
+		if q.Route != "" && !reached[dep] {
+			continue
+		}
+		stats := windowOrLifetime(agg, now, q.Window)
+		if stats == nil {
+			continue
+		}
+		graph.Nodes = append(graph.Nodes, DependencyStats{
+			Dependency: dep,
+			Count:      stats.count,
+			Errors:     stats.errors,
+			Latency:    stats.latency.Summary(),
+		})
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].Dependency.String() < graph.Nodes[j].Dependency.String()
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		return a.Dependency.String() < b.Dependency.String()
+	})
+	return graph
+}
+
+// windowOrLifetime returns the aggregate over window, or over the lifetime
+// when window is zero. It returns nil when the window holds no requests.
+func windowOrLifetime(agg *routeAggregate, now time.Time, window time.Duration) *requestStats {
+	if window <= 0 {
+		return agg.lifetime
+	}
+	stats := agg.window(now, window)
+	if stats.count == 0 {
+		return nil
+	}
+	return stats
+}
@@ -0,0 +1,141 @@
+package inmemory
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// histogramAccuracy is the relative error guaranteed for every quantile
+// returned by a Histogram.
+const histogramAccuracy = 0.01
+
+// histogramMinValue is the smallest latency tracked with relative accuracy;
+// anything faster is counted in a single zero bucket.
+const histogramMinValue = time.Microsecond
+
+var (
+	histogramGamma    = (1 + histogramAccuracy) / (1 - histogramAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// Histogram is a DDSketch-style latency histogram. Buckets grow
+// geometrically, so memory depends on the range of observed latencies (about
+// a thousand buckets between 1µs and one hour) and never on the number of
+// observations. Two histograms can be merged losslessly.
+type Histogram struct {
+	buckets map[int32]uint64
+	zero    uint64
+	count   uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{buckets: make(map[int32]uint64)}
+}
+
+// Record adds one observation.
+func (h *Histogram) Record(d time.Duration) {
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+	if d <= histogramMinValue {
+		h.zero++
+		return
+	}
+	h.buckets[bucketIndex(d)]++
+}
+
+// Merge adds every observation of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+	h.zero += o.zero
+	for idx, n := range o.buckets {
+		h.buckets[idx] += n
+	}
+}
+
+func (h *Histogram) Count() uint64      { return h.count }
+func (h *Histogram) Sum() time.Duration { return h.sum }
+func (h *Histogram) Min() time.Duration { return h.min }
+func (h *Histogram) Max() time.Duration { return h.max }
+
+// Quantile returns the q-quantile (0 ≤ q ≤ 1) of the recorded latencies,
+// or 0 when the histogram is empty.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.min
+	}
+	if q >= 1 {
+		return h.max
+	}
+
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	if rank <= h.zero {
+		return h.min
+	}
+	seen := h.zero
+
+	indexes := make([]int32, 0, len(h.buckets))
+	for idx := range h.buckets {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for _, idx := range indexes {
+		seen += h.buckets[idx]
+		if seen >= rank {
+			return clampDuration(bucketValue(idx), h.min, h.max)
+		}
+	}
+	return h.max
+}
+
+// Summary returns the percentiles used throughout the store.
+func (h *Histogram) Summary() LatencySummary {
+	return LatencySummary{
+		P50: h.Quantile(0.50),
+		P90: h.Quantile(0.90),
+		P99: h.Quantile(0.99),
+		Max: h.max,
+	}
+}
+
+func (h *Histogram) reset() {
+	clear(h.buckets)
+	h.zero, h.count, h.sum, h.min, h.max = 0, 0, 0, 0, 0
+}
+
+func bucketIndex(d time.Duration) int32 {
+	return int32(math.Ceil(math.Log(float64(d)) / histogramLogGamma))
+}
+
+// bucketValue returns the value whose relative distance to both bucket bounds
+// is histogramAccuracy.
+func bucketValue(idx int32) time.Duration {
+	return time.Duration(2 * math.Pow(histogramGamma, float64(idx)) / (histogramGamma + 1))
+}
+
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	return max(lo, min(d, hi))
+}
@@ -0,0 +1,57 @@
+package inmemory
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Run("quantiles stay within relative accuracy", func(t *testing.T) {
+		h := NewHistogram()
+		for i := 1; i <= 1000; i++ {
+			h.Record(time.Duration(i) * time.Millisecond)
+		}
+
+		assert.InEpsilon(t, float64(500*time.Millisecond), float64(h.Quantile(0.50)), histogramAccuracy)
+		assert.InEpsilon(t, float64(900*time.Millisecond), float64(h.Quantile(0.90)), histogramAccuracy)
+		assert.InEpsilon(t, float64(990*time.Millisecond), float64(h.Quantile(0.99)), histogramAccuracy)
+		assert.Equal(t, 1000*time.Millisecond, h.Max())
+		assert.Equal(t, time.Millisecond, h.Min())
+		assert.EqualValues(t, 1000, h.Count())
+	})
+
+	t.Run("merge equals recording into one histogram", func(t *testing.T) {
+		a, b, all := NewHistogram(), NewHistogram(), NewHistogram()
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			d := time.Duration(rng.Int63n(int64(2 * time.Second)))
+			all.Record(d)
+			if i%2 == 0 {
+				a.Record(d)
+			} else {
+				b.Record(d)
+			}
+		}
+		a.Merge(b)
+
+		assert.Equal(t, all.Summary(), a.Summary())
+		assert.Equal(t, all.Count(), a.Count())
+		assert.Equal(t, all.Sum(), a.Sum())
+	})
+
+	t.Run("memory does not grow with traffic", func(t *testing.T) {
+		h := NewHistogram()
+		for i := 0; i < 200000; i++ {
+			h.Record(time.Duration(i%5000) * time.Millisecond)
+		}
+		assert.Less(t, len(h.buckets), 1000)
+	})
+
+	t.Run("empty histogram", func(t *testing.T) {
+		h := NewHistogram()
+		assert.Equal(t, LatencySummary{}, h.Summary())
+	})
+}
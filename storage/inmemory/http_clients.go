@@ -0,0 +1,73 @@
+package inmemory
+
+import (
+	"sort"
+	"time"
+)
+
+// HTTPClientStats aggregates the outgoing HTTP calls to one route of one
+// peer host.
+type HTTPClientStats struct {
+	Host          string
+	Route         string
+	Count         int
+	Errors        int
+	StatusClasses map[string]int
+	Latency       LatencySummary
+}
+
+type httpClientKey struct {
+	host  string
+	route string
+}
+
+// addHTTPClientRequest aggregates an HTTP call per host and route. Once
+// Config.MaxRoutes (host, route) pairs are tracked, further pairs are
+// counted under OverflowRoute for both host and route. The caller must hold
+// s.mu.
+func (s *Store) addHTTPClientRequest(now time.Time, call ClientCall) {
+	key := httpClientKey{call.Dependency.Address, call.Route}
+	agg, ok := s.httpClients[key]
+	if !ok {
+		if s.config.MaxRoutes > 0 && len(s.httpClients) >= s.config.MaxRoutes {
+			key = httpClientKey{OverflowRoute, OverflowRoute}
+			agg = s.httpClients[key]
+		}
+		if agg == nil {
+			agg = newRouteAggregate(now)
+			s.httpClients[key] = agg
+		}
+	}
+	agg.recordOutcome(now, call.Duration, call.StatusCode, call.Failed)
+}
+
+// httpClientStats returns the per-(host, route) aggregates over window, or
+// over their lifetime when window is zero, sorted by host then route.
+func (s *Store) httpClientStats(now time.Time, window time.Duration) []HTTPClientStats {
+	var out []HTTPClientStats
+	for key, agg := range s.httpClients {
+		stats := windowOrLifetime(agg, now, window)
+		if stats == nil {
+			continue
+		}
+		hs := HTTPClientStats{
+			Host:          key.host,
+			Route:         key.route,
+			Count:         stats.count,
+			Errors:        stats.errors,
+			StatusClasses: make(map[string]int, len(stats.statusClasses)),
+			Latency:       stats.latency.Summary(),
+		}
+		for class, n := range stats.statusClasses {
+			hs.StatusClasses[class] = n
+		}
+		out = append(out, hs)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		return out[i].Route < out[j].Route
+	})
+	return out
+}
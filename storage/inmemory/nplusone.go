@@ -0,0 +1,248 @@
+package inmemory
+
+import (
+	"container/list"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// maxNPlusOneExemplars is the number of recent findings kept per group.
+const maxNPlusOneExemplars = 5
+
+// NPlusOneFinding is a single N+1 problem found in one trace: the same
+// client call repeated under one parent span.
+type NPlusOneFinding struct {
+	// Path is the route of the request the calls were made in.
+	Path string
+	// Kind names the extractor that keyed the calls, such as "sql" or
+	// "http".
+	Kind string
+	// Fingerprint is the normalized call, Statement a raw sample.
+	Fingerprint string
+	Statement   string
+	// Count is the final number of repeats under the parent span.
+	Count int
+	// TraceID, ParentName and ParentSpanID identify the span the
+	// statements ran under.
+	TraceID      string
+	ParentName   string
+	ParentSpanID string
+	// TotalDuration and AvgDuration cover every execution of the statement
+	// under the parent. WastedDuration estimates the time a single batched
+	// query would have saved: all executions but one.
+	TotalDuration  time.Duration
+	AvgDuration    time.Duration
+	WastedDuration time.Duration
+	// FirstSeen is the start of the first execution, LastSeen the end of
+	// the last one.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// CallSite is the application code that issued the first execution,
+	// when the SQL instrumentation recorded it.
+	CallSite CallSite
+}
+
+// CallSite is a location in the application source.
+type CallSite struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// NPlusOneGroup aggregates the findings that share a route, a kind and a
+// fingerprint across traces.
+type NPlusOneGroup struct {
+	Path        string
+	Kind        string
+	Fingerprint string
+	// Statement is a raw sample of the calls behind the fingerprint.
+	Statement string
+	// Occurrences is the number of traces the problem was found in.
+	Occurrences int
+	// FirstSeen and LastSeen are the times of the first and latest
+	// detection.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// MinCount, AvgCount and MaxCount describe the repeats per finding.
+	MinCount int
+	AvgCount float64
+	MaxCount int
+	// WastedDuration sums the estimated time lost over all findings.
+	WastedDuration time.Duration
+	// Exemplars are the most recent findings, newest first.
+	Exemplars []NPlusOneFinding
+}
+
+type nPlusOneKey struct {
+	path        string
+	kind        string
+	fingerprint string
+}
+
+type nPlusOneAggregate struct {
+	key       nPlusOneKey
+	statement string
+	firstSeen time.Time
+	lastSeen  time.Time
+	count     int
+	sumCount  int
+	minCount  int
+	maxCount  int
+	wasted    time.Duration
+	exemplars []NPlusOneFinding // oldest first
+	size      int64
+}
+
+// nPlusOneGroups keeps one aggregate per (route, kind, fingerprint), ordered from
+// the least to the most recently updated, so that retention evicts the
+// groups that stopped occurring.
+type nPlusOneGroups struct {
+	byKey    map[nPlusOneKey]*list.Element
+	order    *list.List // of *nPlusOneAggregate
+	capacity int
+	bytes    int64
+	dropped  DropCounters
+}
+
+func newNPlusOneGroups(capacity int) *nPlusOneGroups {
+	return &nPlusOneGroups{
+		byKey:    make(map[nPlusOneKey]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+	}
+}
+
+func (g *nPlusOneGroups) add(now time.Time, f NPlusOneFinding) {
+	key := nPlusOneKey{f.Path, f.Kind, f.Fingerprint}
+	var agg *nPlusOneAggregate
+	if el, ok := g.byKey[key]; ok {
+		agg = el.Value.(*nPlusOneAggregate)
+		g.order.MoveToBack(el)
+	} else {
+		if g.capacity > 0 && len(g.byKey) >= g.capacity {
+			g.pop()
+			g.dropped.Capacity++
+		}
+		agg = &nPlusOneAggregate{
+			key:       key,
+			statement: f.Statement,
+			firstSeen: now,
+			minCount:  f.Count,
+		}
+		g.byKey[key] = g.order.PushBack(agg)
+	}
+
+	agg.lastSeen = now
+	agg.count++
+	agg.sumCount += f.Count
+	agg.minCount = min(agg.minCount, f.Count)
+	agg.maxCount = max(agg.maxCount, f.Count)
+	agg.wasted += f.WastedDuration
+	agg.exemplars = append(agg.exemplars, f)
+	if len(agg.exemplars) > maxNPlusOneExemplars {
+		agg.exemplars = append(agg.exemplars[:0], agg.exemplars[1:]...)
+	}
+
+	g.bytes -= agg.size
+	agg.size = int64(unsafe.Sizeof(*agg)) + int64(len(key.path)+len(key.kind)+len(key.fingerprint)+len(agg.statement))
+	for _, e := range agg.exemplars {
+		agg.size += e.size()
+	}
+	g.bytes += agg.size
+}
+
+// pop removes the least recently updated group and returns its size.
+func (g *nPlusOneGroups) pop() int64 {
+	el := g.order.Front()
+	if el == nil {
+		return 0
+	}
+	agg := g.order.Remove(el).(*nPlusOneAggregate)
+	delete(g.byKey, agg.key)
+	g.bytes -= agg.size
+	return agg.size
+}
+
+func (g *nPlusOneGroups) oldest() (time.Time, bool) {
+	el := g.order.Front()
+	if el == nil {
+		return time.Time{}, false
+	}
+	return el.Value.(*nPlusOneAggregate).lastSeen, true
+}
+
+// expire drops groups not updated since cutoff.
+func (g *nPlusOneGroups) expire(cutoff time.Time) (freed int64) {
+	for {
+		at, ok := g.oldest()
+		if !ok || !at.Before(cutoff) {
+			return freed
+		}
+		freed += g.pop()
+		g.dropped.Expired++
+	}
+}
+
+func (g *nPlusOneGroups) evictForBudget() int64 {
+	g.dropped.Budget++
+	return g.pop()
+}
+
+func (g *nPlusOneGroups) len() int               { return len(g.byKey) }
+func (g *nPlusOneGroups) size() int64            { return g.bytes }
+func (g *nPlusOneGroups) counters() DropCounters { return g.dropped }
+
+// report returns the groups seen since the given time whose route matches,
+// sorted by occurrences.
+func (g *nPlusOneGroups) report(since time.Time, matches func(string) bool) []NPlusOneGroup {
+	var out []NPlusOneGroup
+	for el := g.order.Front(); el != nil; el = el.Next() {
+		agg := el.Value.(*nPlusOneAggregate)
+		if agg.lastSeen.Before(since) || !matches(agg.key.path) {
+			continue
+		}
+		group := NPlusOneGroup{
+			Path:           agg.key.path,
+			Kind:           agg.key.kind,
+			Fingerprint:    agg.key.fingerprint,
+			Statement:      agg.statement,
+			Occurrences:    agg.count,
+			FirstSeen:      agg.firstSeen,
+			LastSeen:       agg.lastSeen,
+			MinCount:       agg.minCount,
+			AvgCount:       float64(agg.sumCount) / float64(agg.count),
+			MaxCount:       agg.maxCount,
+			WastedDuration: agg.wasted,
+			Exemplars:      make([]NPlusOneFinding, 0, len(agg.exemplars)),
+		}
+		for i := len(agg.exemplars) - 1; i >= 0; i-- {
+			group.Exemplars = append(group.Exemplars, agg.exemplars[i])
+		}
+		out = append(out, group)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Occurrences > out[j].Occurrences
+	})
+	return out
+}
+
+// RecordNPlusOne adds a detected N+1 problem to the group of its route,
+// kind and fingerprint.
+func (s *Store) RecordNPlusOne(finding NPlusOneFinding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	now := time.Now()
+	s.nPlusOne.add(now, finding)
+	s.enforceRetention(now)
+}
+
+// NPlusOneLen returns how many N+1 groups are held. This helper is used
+// exclusively in unit tests.
+func (s *Store) NPlusOneLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.nPlusOne.len()
+}
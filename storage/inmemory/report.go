@@ -0,0 +1,191 @@
+package inmemory
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Query selects the data returned by Store.Report.
+type Query struct {
+	// Window limits the report to events newer than now-Window. Zero means
+	// everything the store still holds. Route statistics are kept at 15s
+	// resolution for at most MaxWindow, so longer windows are truncated
+	// for them.
+	Window time.Duration
+	// Route keeps only server requests, errors, N+1 events and dependency
+	// edges for this route. Empty means all routes.
+	Route string
+	// MaxErrors caps the number of recent errors returned. Zero means no
+	// cap.
+	MaxErrors int
+}
+
+// LatencySummary holds latency percentiles of a group of requests.
+type LatencySummary struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// RouteStats aggregates the server requests of a single route over the
+// queried window, plus each of the StandardWindows.
+type RouteStats struct {
+	Route         string
+	Count         int
+	Errors        int
+	StatusClasses map[string]int
+	Latency       LatencySummary
+	Windows       []WindowStats
+}
+
+// ClientStats aggregates outgoing database calls.
+type ClientStats struct {
+	Count   int
+	Errors  int
+	Latency LatencySummary
+}
+
+// Report is a point-in-time view of the store, shaped by a Query.
+type Report struct {
+	GeneratedAt  time.Time
+	Routes       []RouteStats
+	Database     ClientStats
+	HTTPClients  []HTTPClientStats
+	Dependencies DependencyGraph
+	Errors       []ErrorEvent
+	NPlusOne     []NPlusOneGroup
+	Runtime      []RuntimeSample
+	Retention    RetentionStats
+}
+
+// Report aggregates the stored events selected by q. Routes are sorted by
+// name, errors from newest to oldest and N+1 groups by occurrences.
+func (s *Store) Report(q Query) *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+
+	now := time.Now()
+	s.enforceRetention(now)
+	var since time.Time
+	if q.Window > 0 {
+		since = now.Add(-q.Window)
+	}
+	matches := func(path string) bool {
+		return q.Route == "" || q.Route == path
+	}
+
+	report := &Report{
+		GeneratedAt: now,
+		Retention:   s.retentionStats(),
+	}
+
+	for route, agg := range s.routes {
+		if !matches(route) {
+			continue
+		}
+		stats := agg.lifetime
+		if q.Window > 0 {
+			stats = agg.window(now, q.Window)
+			if stats.count == 0 {
+				continue
+			}
+		}
+		rs := RouteStats{
+			Route:         route,
+			Count:         stats.count,
+			Errors:        stats.errors,
+			StatusClasses: make(map[string]int, len(stats.statusClasses)),
+			Latency:       stats.latency.Summary(),
+		}
+		for class, n := range stats.statusClasses {
+			rs.StatusClasses[class] = n
+		}
+		for _, w := range StandardWindows {
+			rs.Windows = append(rs.Windows, agg.windowStats(now, w))
+		}
+		report.Routes = append(report.Routes, rs)
+	}
+	sort.Slice(report.Routes, func(i, j int) bool {
+		return report.Routes[i].Route < report.Routes[j].Route
+	})
+
+	var clientDurations []time.Duration
+	s.clientRequests.each(func(c clientEntry) {
+		if c.Timestamp.Before(since) {
+			return
+		}
+		clientDurations = append(clientDurations, c.Duration)
+		if c.Failed {
+			report.Database.Errors++
+		}
+	})
+	report.Database.Count = len(clientDurations)
+	report.Database.Latency = summarize(clientDurations)
+
+	report.HTTPClients = s.httpClientStats(now, q.Window)
+	report.Dependencies = s.dependencyGraph(now, q)
+
+	s.errors.reverse(func(e ErrorEvent) bool {
+		if e.Timestamp.Before(since) || !matches(e.Path) {
+			return true
+		}
+		if q.MaxErrors > 0 && len(report.Errors) >= q.MaxErrors {
+			return false
+		}
+		report.Errors = append(report.Errors, e)
+		return true
+	})
+
+	report.NPlusOne = s.nPlusOne.report(since, matches)
+
+	report.Runtime = s.runtimeSeries(since)
+
+	return report
+}
+
+// StatusClass maps an HTTP status code to "1xx" … "5xx". Codes outside that
+// range (including 0, used when no status was recorded) map to "unknown".
+func StatusClass(code int) string {
+	switch {
+	case code >= 100 && code < 200:
+		return "1xx"
+	case code >= 200 && code < 300:
+		return "2xx"
+	case code >= 300 && code < 400:
+		return "3xx"
+	case code >= 400 && code < 500:
+		return "4xx"
+	case code >= 500 && code < 600:
+		return "5xx"
+	}
+	return "unknown"
+}
+
+// summarize sorts durations in place and returns their percentiles.
+func summarize(durations []time.Duration) LatencySummary {
+	if len(durations) == 0 {
+		return LatencySummary{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return LatencySummary{
+		P50: percentile(durations, 0.50),
+		P90: percentile(durations, 0.90),
+		P99: percentile(durations, 0.99),
+		Max: durations[len(durations)-1],
+	}
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
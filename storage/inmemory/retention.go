@@ -0,0 +1,89 @@
+package inmemory
+
+import (
+	"time"
+	"unsafe"
+)
+
+// Names of the raw event lists, as used in RetentionStats.Dropped.
+const (
+	EventsClientRequests = "client_requests"
+	EventsErrors         = "errors"
+	EventsNPlusOne       = "n_plus_one"
+)
+
+// RetentionStats describes how much raw data the store holds and how much
+// it had to discard.
+type RetentionStats struct {
+	Events   int
+	Bytes    int64
+	MaxBytes int64
+	Dropped  map[string]DropCounters
+}
+
+var clientEntrySize = int64(unsafe.Sizeof(clientEntry{}))
+
+func (e ErrorEvent) size() int64 {
+	return int64(unsafe.Sizeof(e)) + int64(len(e.Method)+len(e.Path)+len(e.Error))
+}
+
+func (f NPlusOneFinding) size() int64 {
+	return int64(unsafe.Sizeof(f)) + int64(len(f.Path)+len(f.Kind)+len(f.Fingerprint)+len(f.Statement)+
+		len(f.TraceID)+len(f.ParentName)+len(f.ParentSpanID)+len(f.CallSite.Function)+len(f.CallSite.File))
+}
+
+func (s *Store) eventLists() map[string]evictable {
+	return map[string]evictable{
+		EventsClientRequests: s.clientRequests,
+		EventsErrors:         s.errors,
+		EventsNPlusOne:       s.nPlusOne,
+	}
+}
+
+// enforceRetention applies MaxAge and MaxBytes. MaxEvents is enforced by
+// the rings themselves. The caller must hold s.mu.
+func (s *Store) enforceRetention(now time.Time) {
+	lists := s.eventLists()
+
+	if s.config.MaxAge > 0 {
+		cutoff := now.Add(-s.config.MaxAge)
+		for _, l := range lists {
+			l.expire(cutoff)
+		}
+	}
+
+	if s.config.MaxBytes <= 0 {
+		return
+	}
+	var total int64
+	for _, l := range lists {
+		total += l.size()
+	}
+	for total > s.config.MaxBytes {
+		var victim evictable
+		var victimAt time.Time
+		for _, l := range lists {
+			if at, ok := l.oldest(); ok && (victim == nil || at.Before(victimAt)) {
+				victim, victimAt = l, at
+			}
+		}
+		if victim == nil {
+			return
+		}
+		total -= victim.evictForBudget()
+	}
+}
+
+// retentionStats must be called with s.mu held.
+func (s *Store) retentionStats() RetentionStats {
+	stats := RetentionStats{
+		MaxBytes: s.config.MaxBytes,
+		Dropped:  make(map[string]DropCounters),
+	}
+	for name, l := range s.eventLists() {
+		stats.Events += l.len()
+		stats.Bytes += l.size()
+		stats.Dropped[name] = l.counters()
+	}
+	return stats
+}
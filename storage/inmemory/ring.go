@@ -0,0 +1,144 @@
+package inmemory
+
+import "time"
+
+// DropCounters counts events discarded by the retention policy, by reason.
+type DropCounters struct {
+	Capacity uint64 // evicted because the list reached Config.MaxEvents
+	Expired  uint64 // older than Config.MaxAge
+	Budget   uint64 // evicted to stay within Config.MaxBytes
+}
+
+// Total returns the number of dropped events regardless of reason.
+func (d DropCounters) Total() uint64 {
+	return d.Capacity + d.Expired + d.Budget
+}
+
+type ringEntry[T any] struct {
+	at    time.Time
+	size  int64
+	value T
+}
+
+// ring is a FIFO buffer of raw events. With a positive capacity it never
+// grows beyond it and overwrites the oldest entry; with capacity zero it
+// grows as needed and relies on age and byte limits alone.
+type ring[T any] struct {
+	buf      []ringEntry[T]
+	head     int
+	n        int
+	capacity int
+	bytes    int64
+	dropped  DropCounters
+}
+
+func newRing[T any](capacity int) *ring[T] {
+	return &ring[T]{capacity: capacity}
+}
+
+// push appends v and returns the number of bytes freed by evicting the
+// oldest entry, if the ring was full.
+func (r *ring[T]) push(at time.Time, size int64, v T) (freed int64) {
+	if r.capacity > 0 && r.n == r.capacity {
+		freed = r.pop()
+		r.dropped.Capacity++
+	}
+	if r.n == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = ringEntry[T]{at: at, size: size, value: v}
+	r.n++
+	r.bytes += size
+	return freed
+}
+
+func (r *ring[T]) grow() {
+	size := max(2*len(r.buf), 16)
+	if r.capacity > 0 {
+		size = min(size, r.capacity)
+	}
+	buf := make([]ringEntry[T], size)
+	for i := 0; i < r.n; i++ {
+		buf[i] = r.buf[(r.head+i)%len(r.buf)]
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+// pop removes the oldest entry and returns its size.
+func (r *ring[T]) pop() int64 {
+	if r.n == 0 {
+		return 0
+	}
+	e := &r.buf[r.head]
+	size := e.size
+	*e = ringEntry[T]{}
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	r.bytes -= size
+	return size
+}
+
+func (r *ring[T]) oldest() (time.Time, bool) {
+	if r.n == 0 {
+		return time.Time{}, false
+	}
+	return r.buf[r.head].at, true
+}
+
+// expire drops entries recorded before cutoff and returns the bytes freed.
+func (r *ring[T]) expire(cutoff time.Time) (freed int64) {
+	for {
+		at, ok := r.oldest()
+		if !ok || !at.Before(cutoff) {
+			return freed
+		}
+		freed += r.pop()
+		r.dropped.Expired++
+	}
+}
+
+// each calls fn from the oldest to the newest entry.
+func (r *ring[T]) each(fn func(v T)) {
+	for i := 0; i < r.n; i++ {
+		fn(r.buf[(r.head+i)%len(r.buf)].value)
+	}
+}
+
+// reverse calls fn from the newest to the oldest entry until fn returns
+// false.
+func (r *ring[T]) reverse(fn func(v T) bool) {
+	for i := r.n - 1; i >= 0; i-- {
+		if !fn(r.buf[(r.head+i)%len(r.buf)].value) {
+			return
+		}
+	}
+}
+
+func (r *ring[T]) len() int {
+	return r.n
+}
+
+// evictable lets the store enforce the global byte budget across rings of
+// different element types.
+type evictable interface {
+	oldest() (time.Time, bool)
+	evictForBudget() int64
+	expire(cutoff time.Time) int64
+	len() int
+	size() int64
+	counters() DropCounters
+}
+
+func (r *ring[T]) evictForBudget() int64 {
+	r.dropped.Budget++
+	return r.pop()
+}
+
+func (r *ring[T]) size() int64 {
+	return r.bytes
+}
+
+func (r *ring[T]) counters() DropCounters {
+	return r.dropped
+}
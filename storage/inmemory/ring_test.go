@@ -0,0 +1,47 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	collect := func(r *ring[int]) []int {
+		var out []int
+		r.each(func(v int) { out = append(out, v) })
+		return out
+	}
+
+	t.Run("overwrites the oldest entry when full", func(t *testing.T) {
+		r := newRing[int](3)
+		now := time.Now()
+		for i := 1; i <= 5; i++ {
+			r.push(now, 8, i)
+		}
+		assert.Equal(t, []int{3, 4, 5}, collect(r))
+		assert.EqualValues(t, 24, r.size())
+		assert.EqualValues(t, 2, r.counters().Capacity)
+	})
+
+	t.Run("grows without a capacity", func(t *testing.T) {
+		r := newRing[int](0)
+		for i := 0; i < 100; i++ {
+			r.push(time.Now(), 1, i)
+		}
+		assert.Equal(t, 100, r.len())
+		assert.Equal(t, 0, collect(r)[0])
+	})
+
+	t.Run("expires by time", func(t *testing.T) {
+		r := newRing[int](0)
+		base := time.Now()
+		for i := 0; i < 5; i++ {
+			r.push(base.Add(time.Duration(i)*time.Second), 1, i)
+		}
+		r.expire(base.Add(3 * time.Second))
+		assert.Equal(t, []int{3, 4}, collect(r))
+		assert.EqualValues(t, 3, r.counters().Expired)
+	})
+}
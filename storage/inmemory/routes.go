@@ -0,0 +1,151 @@
+package inmemory
+
+import (
+	"time"
+)
+
+const (
+	// slotDuration is the resolution of the sliding windows.
+	slotDuration = 15 * time.Second
+	// MaxWindow is the longest sliding window the store can answer.
+	MaxWindow = 15 * time.Minute
+	numSlots  = int(MaxWindow / slotDuration)
+
+	// OverflowRoute collects requests for routes beyond Config.MaxRoutes.
+	OverflowRoute = "<other>"
+)
+
+// StandardWindows are the sliding windows reported for every route.
+var StandardWindows = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// WindowStats aggregates a route's requests over a sliding window.
+type WindowStats struct {
+	Window      time.Duration
+	Count       int
+	Errors      int
+	RequestRate float64 // requests per second
+	ErrorRate   float64 // share of requests that failed, 0–1
+	Latency     LatencySummary
+}
+
+// requestStats is the mergeable aggregate kept per route and per time slot.
+type requestStats struct {
+	count         int
+	errors        int
+	statusClasses map[string]int
+	latency       *Histogram
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		statusClasses: make(map[string]int),
+		latency:       NewHistogram(),
+	}
+}
+
+func (r *requestStats) record(duration time.Duration, statusCode int, failed bool) {
+	r.count++
+	if failed {
+		r.errors++
+	}
+	r.statusClasses[StatusClass(statusCode)]++
+	r.latency.Record(duration)
+}
+
+func (r *requestStats) merge(o *requestStats) {
+	r.count += o.count
+	r.errors += o.errors
+	for class, n := range o.statusClasses {
+		r.statusClasses[class] += n
+	}
+	r.latency.Merge(o.latency)
+}
+
+func (r *requestStats) reset() {
+	r.count, r.errors = 0, 0
+	clear(r.statusClasses)
+	r.latency.reset()
+}
+
+type timeSlot struct {
+	epoch int64
+	stats *requestStats
+}
+
+// routeAggregate holds the lifetime totals of a route plus a ring of time
+// slots covering MaxWindow. Its size does not depend on traffic volume.
+type routeAggregate struct {
+	firstSeen time.Time
+	lifetime  *requestStats
+	slots     [numSlots]timeSlot
+}
+
+func newRouteAggregate(now time.Time) *routeAggregate {
+	return &routeAggregate{
+		firstSeen: now,
+		lifetime:  newRequestStats(),
+	}
+}
+
+func slotEpoch(t time.Time) int64 {
+	return t.UnixNano() / int64(slotDuration)
+}
+
+// record counts a request as failed when its status is a 5xx.
+func (a *routeAggregate) record(now time.Time, duration time.Duration, statusCode int) {
+	a.recordOutcome(now, duration, statusCode, statusCode >= 500)
+}
+
+func (a *routeAggregate) recordOutcome(now time.Time, duration time.Duration, statusCode int, failed bool) {
+	a.lifetime.record(duration, statusCode, failed)
+
+	epoch := slotEpoch(now)
+	slot := &a.slots[epoch%int64(numSlots)]
+	if slot.stats == nil {
+		slot.stats = newRequestStats()
+	}
+	if slot.epoch != epoch {
+		slot.epoch = epoch
+		slot.stats.reset()
+	}
+	slot.stats.record(duration, statusCode, failed)
+}
+
+// window merges the slots that overlap the last window. Windows are rounded
+// up to the slot resolution and capped at MaxWindow.
+func (a *routeAggregate) window(now time.Time, window time.Duration) *requestStats {
+	if window > MaxWindow {
+		window = MaxWindow
+	}
+	current := slotEpoch(now)
+	oldest := slotEpoch(now.Add(-window))
+
+	merged := newRequestStats()
+	for i := range a.slots {
+		slot := &a.slots[i]
+		if slot.stats != nil && slot.epoch >= oldest && slot.epoch <= current {
+			merged.merge(slot.stats)
+		}
+	}
+	return merged
+}
+
+func (a *routeAggregate) windowStats(now time.Time, window time.Duration) WindowStats {
+	stats := a.window(now, window)
+	ws := WindowStats{
+		Window:  window,
+		Count:   stats.count,
+		Errors:  stats.errors,
+		Latency: stats.latency.Summary(),
+	}
+	// Routes younger than the window would otherwise report a diluted rate.
+	elapsed := min(window, now.Sub(a.firstSeen))
+	if elapsed < slotDuration {
+		elapsed = slotDuration
+	}
+	ws.RequestRate = float64(stats.count) / elapsed.Seconds()
+	if stats.count > 0 {
+		ws.ErrorRate = float64(stats.errors) / float64(stats.count)
+	}
+	return ws
+}
@@ -0,0 +1,60 @@
+package inmemory
+
+import "time"
+
+// RuntimeSample is one observation of the Go runtime, taken by the runtime
+// collector. Counters marked cumulative grow over the process lifetime;
+// distributions cover only the interval since the previous sample.
+type RuntimeSample struct {
+	Timestamp time.Time
+
+	Goroutines uint64
+	Threads    uint64
+
+	// Heap statistics, named after their runtime.MemStats equivalents.
+	HeapAlloc  uint64 // live heap objects (also reported as Alloc)
+	HeapSys    uint64 // heap memory obtained from the OS
+	HeapGoal   uint64
+	TotalAlloc uint64 // cumulative
+	Mallocs    uint64 // cumulative
+
+	GCCycles uint64 // cumulative
+	CgoCalls uint64 // cumulative
+
+	// GCPauses is the distribution of stop-the-world GC pauses.
+	GCPauses LatencySummary
+	// GCPauseCount is the number of pauses in the interval.
+	GCPauseCount uint64
+	// SchedLatency is the time goroutines spent runnable before running.
+	SchedLatency LatencySummary
+}
+
+// UpdateRuntime appends a runtime sample to the time series. The series
+// keeps the most recent Config.MaxRuntimeSamples samples.
+func (s *Store) UpdateRuntime(sample RuntimeSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = time.Now()
+	}
+	s.runtime.push(sample.Timestamp, 0, sample)
+}
+
+// RuntimeSeries returns the samples taken at or after since, oldest first.
+func (s *Store) RuntimeSeries(since time.Time) []RuntimeSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	return s.runtimeSeries(since)
+}
+
+func (s *Store) runtimeSeries(since time.Time) []RuntimeSample {
+	var series []RuntimeSample
+	s.runtime.each(func(sample RuntimeSample) {
+		if !sample.Timestamp.Before(since) {
+			series = append(series, sample)
+		}
+	})
+	return series
+}
@@ -15,92 +15,152 @@ type ErrorEvent struct {
 }
 
 // Snapshot is a very lightweight representation of the current aggregated data.
-// Only the tests need this at the moment.
 type Snapshot struct {
 	TotalRequests int
 	TotalErrors   int
+	Retention     RetentionStats
+}
+
+// Config controls how much data the store keeps.
+type Config struct {
+	// MaxEvents caps each raw event list (client requests and errors) and
+	// the number of N+1 groups. Once the cap is reached the oldest entries
+	// are discarded. Zero means unlimited.
+	MaxEvents int
+	// MaxAge discards raw events recorded longer ago than this. Zero keeps
+	// events until another limit applies.
+	MaxAge time.Duration
+	// MaxBytes is an approximate memory budget shared by all raw event
+	// lists. When it is exceeded the globally oldest events are discarded.
+	// Zero means unlimited.
+	MaxBytes int64
+	// MaxRuntimeSamples is the length of the runtime metrics time series.
+	// Zero means the default of 360 samples.
+	MaxRuntimeSamples int
+	// MaxRoutes caps the number of routes aggregated separately; requests
+	// for further routes are counted under OverflowRoute. The same cap
+	// applies separately to outgoing HTTP (host, route) pairs, dependencies
+	// and route-to-dependency edges. Zero means unlimited.
+	MaxRoutes int
+}
+
+// defaultMaxRuntimeSamples covers one hour at the default 10s interval.
+const defaultMaxRuntimeSamples = 360
+
+// DefaultConfig returns the retention settings used by NewStore.
+func DefaultConfig() Config {
+	return Config{
+		MaxEvents: 10000,
+		MaxAge:    1 * time.Hour,
+		MaxBytes:  32 << 20,
+		MaxRoutes: 1000,
+
+		MaxRuntimeSamples: defaultMaxRuntimeSamples,
+	}
 }
 
 // Store is a minimal, goroutine-safe in-memory implementation that collects
 // basic statistics required by CustomExporter, Profiler and N+1 detector.
 type Store struct {
-	mu sync.Mutex
+	mu     sync.Mutex
+	config Config
 
-	requests       []requestEntry
-	clientRequests []clientEntry
-	errors         []ErrorEvent
+	routes          map[string]*routeAggregate
+	httpClients     map[httpClientKey]*routeAggregate
+	dependencies    map[Dependency]*routeAggregate
+	dependencyEdges map[dependencyEdgeKey]*routeAggregate
+	totalRequests   int
+	totalErrors     int
+	clientRequests  *ring[clientEntry]
+	errors          *ring[ErrorEvent]
 
-	nPlusOneEvents []nPlusOneEntry
-}
+	nPlusOne *nPlusOneGroups
 
-type requestEntry struct {
-	Path       string
-	Duration   time.Duration
-	StatusCode int
+	runtime *ring[RuntimeSample]
 }
 
 type clientEntry struct {
-	Duration   time.Duration
-	StatusCode int
-}
-
-type nPlusOneEntry struct {
-	Path      string
-	Statement string
-	Count     int
+	Timestamp time.Time
+	Duration  time.Duration
+	Failed    bool
 }
 
-// NewStore returns a ready-to-use Store instance.
+// NewStore returns a ready-to-use Store instance with default retention.
 func NewStore() *Store {
-	return &Store{}
+	return NewStoreWithConfig(DefaultConfig())
 }
 
-// AddRequest records a server request.
-func (s *Store) AddRequest(path string, duration time.Duration, statusCode int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.requests = append(s.requests, requestEntry{path, duration, statusCode})
+// NewStoreWithConfig returns a Store that applies the given retention
+// settings.
+func NewStoreWithConfig(config Config) *Store {
+	s := &Store{config: config}
+	s.init()
+	return s
 }
 
-// AddClientRequest records a downstream client request (e.g., DB query).
-func (s *Store) AddClientRequest(duration time.Duration, statusCode int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.clientRequests = append(s.clientRequests, clientEntry{duration, statusCode})
+// init allocates the containers lazily so that a zero Store is usable.
+func (s *Store) init() {
+	if s.routes != nil {
+		return
+	}
+	s.routes = make(map[string]*routeAggregate)
+	s.httpClients = make(map[httpClientKey]*routeAggregate)
+	s.dependencies = make(map[Dependency]*routeAggregate)
+	s.dependencyEdges = make(map[dependencyEdgeKey]*routeAggregate)
+	s.clientRequests = newRing[clientEntry](s.config.MaxEvents)
+	s.errors = newRing[ErrorEvent](s.config.MaxEvents)
+	s.nPlusOne = newNPlusOneGroups(s.config.MaxEvents)
+
+	runtimeSamples := s.config.MaxRuntimeSamples
+	if runtimeSamples <= 0 {
+		runtimeSamples = defaultMaxRuntimeSamples
+	}
+	s.runtime = newRing[RuntimeSample](runtimeSamples)
 }
 
-// AddError records an application error.
-func (s *Store) AddError(event ErrorEvent) {
+// AddRequest records a server request in the aggregates of its route.
+func (s *Store) AddRequest(path string, duration time.Duration, statusCode int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.errors = append(s.errors, event)
-}
 
-// RecordNPlusOne registers a detected N+1 query problem.
-func (s *Store) RecordNPlusOne(path, statement string, count int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.nPlusOneEvents = append(s.nPlusOneEvents, nPlusOneEntry{path, statement, count})
+	s.init()
+
+	now := time.Now()
+	route, ok := s.routes[path]
+	if !ok {
+		if s.config.MaxRoutes > 0 && len(s.routes) >= s.config.MaxRoutes {
+			path = OverflowRoute
+			route = s.routes[path]
+		}
+		if route == nil {
+			route = newRouteAggregate(now)
+			s.routes[path] = route
+		}
+	}
+	route.record(now, duration, statusCode)
+	s.totalRequests++
 }
 
-// NPlusOneLen returns how many N+1 events were recorded. This helper is used
-// exclusively in unit tests.
-func (s *Store) NPlusOneLen() int {
+// AddError records an application error.
+func (s *Store) AddError(event ErrorEvent) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return len(s.nPlusOneEvents)
+	s.init()
+	now := time.Now()
+	s.errors.push(now, event.size(), event)
+	s.totalErrors++
+	s.enforceRetention(now)
 }
 
-// UpdateRuntime is a stub kept for backward compatibility. It can later be
-// wired to collect runtime stats (GC, mem, etc.).
-func (s *Store) UpdateRuntime() {}
-
 // GetSnapshot returns a very simple snapshot – sufficient for unit tests.
 func (s *Store) GetSnapshot() *Snapshot {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.init()
+	s.enforceRetention(time.Now())
 	return &Snapshot{
-		TotalRequests: len(s.requests),
-		TotalErrors:   len(s.errors),
+		TotalRequests: s.totalRequests,
+		TotalErrors:   s.totalErrors,
+		Retention:     s.retentionStats(),
 	}
 }
@@ -0,0 +1,135 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_RouteWindows(t *testing.T) {
+	start := time.Now()
+	agg := newRouteAggregate(start.Add(-time.Hour))
+
+	agg.record(start.Add(-10*time.Minute), 100*time.Millisecond, 500)
+	agg.record(start.Add(-3*time.Minute), 20*time.Millisecond, 200)
+	agg.record(start, 10*time.Millisecond, 200)
+
+	one := agg.windowStats(start, time.Minute)
+	assert.Equal(t, 1, one.Count)
+	assert.Equal(t, 0, one.Errors)
+
+	five := agg.windowStats(start, 5*time.Minute)
+	assert.Equal(t, 2, five.Count)
+	assert.InDelta(t, 2.0/300, five.RequestRate, 1e-9)
+
+	fifteen := agg.windowStats(start, 15*time.Minute)
+	assert.Equal(t, 3, fifteen.Count)
+	assert.Equal(t, 1, fifteen.Errors)
+	assert.InDelta(t, 1.0/3, fifteen.ErrorRate, 1e-9)
+	assert.Equal(t, 100*time.Millisecond, fifteen.Latency.Max)
+
+	// The ring wraps after MaxWindow: the slot of the request recorded at
+	// start is reused and everything older falls out of the window.
+	agg.record(start.Add(MaxWindow), time.Millisecond, 200)
+	later := agg.windowStats(start.Add(MaxWindow), MaxWindow)
+	assert.Equal(t, 1, later.Count)
+	assert.Equal(t, 4, agg.lifetime.count)
+}
+
+func TestStore_Report(t *testing.T) {
+	store := NewStoreWithConfig(Config{MaxRoutes: 2})
+	store.AddRequest("/a", 10*time.Millisecond, 200)
+	store.AddRequest("/a", 20*time.Millisecond, 404)
+	store.AddRequest("/b", 30*time.Millisecond, 503)
+	store.AddRequest("/c", 40*time.Millisecond, 200)
+	store.AddRequest("/d", 50*time.Millisecond, 200)
+
+	report := store.Report(Query{})
+	require.Len(t, report.Routes, 3)
+
+	a := report.Routes[0]
+	assert.Equal(t, "/a", a.Route)
+	assert.Equal(t, 2, a.Count)
+	assert.Equal(t, map[string]int{"2xx": 1, "4xx": 1}, a.StatusClasses)
+	assert.Len(t, a.Windows, len(StandardWindows))
+
+	other := report.Routes[2]
+	assert.Equal(t, OverflowRoute, other.Route)
+	assert.Equal(t, 2, other.Count)
+
+	assert.Equal(t, 5, store.GetSnapshot().TotalRequests)
+
+	filtered := store.Report(Query{Route: "/b", Window: time.Minute})
+	require.Len(t, filtered.Routes, 1)
+	assert.Equal(t, 1, filtered.Routes[0].Errors)
+}
+
+func TestStore_Retention(t *testing.T) {
+	t.Run("caps each list and counts evictions", func(t *testing.T) {
+		store := NewStoreWithConfig(Config{MaxEvents: 3})
+		for i := 0; i < 10; i++ {
+			store.AddError(ErrorEvent{Timestamp: time.Now(), Path: "/e"})
+			store.AddClientRequest(ClientCall{Dependency: Dependency{Kind: DependencyDatabase}, Duration: time.Millisecond})
+		}
+
+		snap := store.GetSnapshot()
+		assert.Equal(t, 10, snap.TotalErrors, "totals keep counting dropped events")
+		assert.Equal(t, 6, snap.Retention.Events)
+		assert.EqualValues(t, 7, snap.Retention.Dropped[EventsErrors].Capacity)
+		assert.EqualValues(t, 7, snap.Retention.Dropped[EventsClientRequests].Capacity)
+		assert.Len(t, store.Report(Query{}).Errors, 3)
+	})
+
+	t.Run("expires old events", func(t *testing.T) {
+		store := NewStoreWithConfig(Config{MaxAge: 20 * time.Millisecond})
+		store.RecordNPlusOne(NPlusOneFinding{Path: "/n", Fingerprint: "select ?", Statement: "SELECT 1", Count: 5})
+		time.Sleep(30 * time.Millisecond)
+
+		snap := store.GetSnapshot()
+		assert.Equal(t, 0, store.NPlusOneLen())
+		assert.EqualValues(t, 1, snap.Retention.Dropped[EventsNPlusOne].Expired)
+	})
+
+	t.Run("keeps within the byte budget", func(t *testing.T) {
+		budget := 10 * ErrorEvent{}.size()
+		store := NewStoreWithConfig(Config{MaxBytes: budget})
+		for i := 0; i < 100; i++ {
+			store.AddError(ErrorEvent{Timestamp: time.Now(), Path: "/e"})
+		}
+
+		snap := store.GetSnapshot()
+		assert.LessOrEqual(t, snap.Retention.Bytes, budget)
+		assert.Positive(t, snap.Retention.Dropped[EventsErrors].Budget)
+		assert.EqualValues(t, 100, uint64(snap.Retention.Events)+snap.Retention.Dropped[EventsErrors].Total())
+	})
+}
+
+func TestStore_NPlusOneGroups(t *testing.T) {
+	store := NewStoreWithConfig(Config{MaxEvents: 2})
+	for i := 1; i <= 7; i++ {
+		store.RecordNPlusOne(NPlusOneFinding{Path: "/a", Fingerprint: "select ?", Count: i, TraceID: string(rune('0' + i))})
+	}
+	store.RecordNPlusOne(NPlusOneFinding{Path: "/b", Fingerprint: "select ?", Count: 3})
+
+	report := store.Report(Query{})
+	require.Len(t, report.NPlusOne, 2, "one group per route and fingerprint")
+	a := report.NPlusOne[0]
+	assert.Equal(t, "/a", a.Path)
+	assert.Equal(t, 7, a.Occurrences)
+	assert.Equal(t, 1, a.MinCount)
+	assert.Equal(t, 4.0, a.AvgCount)
+	assert.Equal(t, 7, a.MaxCount)
+	require.Len(t, a.Exemplars, maxNPlusOneExemplars)
+	assert.Equal(t, "7", a.Exemplars[0].TraceID)
+
+	// A third group evicts the least recently updated one.
+	store.RecordNPlusOne(NPlusOneFinding{Path: "/c", Fingerprint: "select ?", Count: 3})
+	report = store.Report(Query{})
+	require.Len(t, report.NPlusOne, 2)
+	for _, g := range report.NPlusOne {
+		assert.NotEqual(t, "/a", g.Path)
+	}
+	assert.EqualValues(t, 1, report.Retention.Dropped[EventsNPlusOne].Capacity)
+}